@@ -0,0 +1,302 @@
+package kbgp
+
+import (
+	"log"
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// Adj-RIBs-Out: The Adj-RIBs-Out stores information the local BGP speaker
+// selected for advertisement to its peers.  The routing information stored
+// in the Adj-RIBs-Out will be carried in the local BGP speaker's UPDATE
+// messages and advertised to its peers.
+// https://tools.ietf.org/html/rfc4271#section-3.2
+//
+// Changes to the Loc-RIB are handed to each peer without waiting for it,
+// since a peer's event loop may itself be busy handing a change to the
+// Loc-RIB. The peer picks them up in its event loop, runs them through its
+// export policy, and sends whatever differs from what it advertised before.
+
+// exports are the changes to the Loc-RIB a peer has yet to pick up. Only
+// the latest change to each destination matters.
+type exports struct {
+	mu      sync.Mutex
+	pending map[netip.Prefix]*path
+	// Signalled when there are changes pending
+	ready chan struct{}
+}
+
+func newExports() *exports {
+	return &exports{pending: map[netip.Prefix]*path{}, ready: make(chan struct{}, 1)}
+}
+
+// add queues the best path to prefix, or nil if there is none, and wakes
+// the event loop without waiting for it
+func (e *exports) add(prefix netip.Prefix, best *path) {
+	e.mu.Lock()
+	e.pending[prefix] = best
+	e.mu.Unlock()
+	select {
+	case e.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the pending changes and forgets them
+func (e *exports) take() map[netip.Prefix]*path {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	pending := e.pending
+	e.pending = map[netip.Prefix]*path{}
+	return pending
+}
+
+// export hands a change to the best path to prefix to every peer
+func (s *Speaker) export(prefix netip.Prefix, best *path) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, p := range s.peers {
+		p.exports.add(prefix, best)
+	}
+}
+
+// dump queues the best path to every destination for p, as for a session
+// that has just been established
+func (l *locRIB) dump(p *Peer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for prefix, best := range l.best {
+		p.exports.add(prefix, &best)
+	}
+}
+
+// SetExportPolicy sets the policy routes are advertised to the peer by,
+// overriding its group's. A nil policy advertises every route.
+func (p *Peer) SetExportPolicy(policy Policy) {
+	p.configure(func() { p.settings.exportPolicy = policy })
+}
+
+// SetExportPolicy sets the policy routes are advertised to the group's
+// peers by
+func (g *PeerGroup) SetExportPolicy(policy Policy) {
+	g.set(func(s *peerSettings) { s.exportPolicy = policy })
+}
+
+// advertiseAll sends the peer every best path, or whatever has changed
+// about them since they were last sent
+func (p *Peer) advertiseAll() {
+	if p.speaker != nil && p.fsm.state == established {
+		p.speaker.locRIB.dump(p)
+	}
+}
+
+// export picks up the changes to the Loc-RIB and sends the peer UPDATE
+// messages for whatever it should now be told differently
+func (p *Peer) export() {
+	pending := p.exports.take()
+	if p.fsm.state != established {
+		// The Adj-RIB-Out is filled in again once the session is up
+		return
+	}
+	var advertised []Route
+	var withdrawn []netip.Prefix
+	for prefix, best := range pending {
+		r, ok := p.exportable(best)
+		current, sent := p.adjRIBOut.lookup(prefix)
+		switch {
+		case ok && sent && sameAttributes(r.attrs, current.attrs):
+		case ok:
+			advertised = append(advertised, p.speaker.attrs.store(p.adjRIBOut, r))
+		case sent:
+			p.speaker.attrs.drop(p.adjRIBOut, prefix)
+			withdrawn = append(withdrawn, prefix)
+		}
+	}
+	if len(advertised) == 0 && len(withdrawn) == 0 {
+		return
+	}
+	log.Println("Advertising", len(advertised), "and withdrawing", len(withdrawn), "routes to", p)
+	for _, u := range packUpdates(advertised, withdrawn, p.fourOctet()) {
+		p.send(update, u)
+	}
+}
+
+// forgetAdvertised empties the Adj-RIB-Out
+func (p *Peer) forgetAdvertised() {
+	if p.speaker != nil {
+		p.speaker.attrs.releaseAll(p.adjRIBOut)
+	}
+	p.adjRIBOut = table{}
+}
+
+// sameAttributes returns true if a and b would be advertised the same way
+func sameAttributes(a, b *pathAttributes) bool {
+	return a == b || attrKey(a) == attrKey(b)
+}
+
+// exportable returns the route to advertise to the peer for a best path,
+// or false if the peer should not be sent one
+func (p *Peer) exportable(best *path) (Route, bool) {
+	if best == nil || best.from.peer == p {
+		return Route{}, false
+	}
+	// When a BGP speaker receives an UPDATE message from an internal
+	// peer, the receiving BGP speaker SHALL NOT re-distribute the routing
+	// information contained in that UPDATE message to other internal
+	// peers
+	// https://tools.ietf.org/html/rfc4271#section-9.2
+	if best.from.internal && p.internal() {
+		return Route{}, false
+	}
+	if !p.familyNegotiated(best.route.Family()) {
+		return Route{}, false
+	}
+	r := best.route.with(func(attrs *pathAttributes) {
+		p.rewrite(attrs, best.route)
+	})
+	return apply(p.resolved().exportPolicy, r)
+}
+
+// rewrite changes the attributes of a route for advertising to the peer
+// https://tools.ietf.org/html/rfc4271#section-5.1
+func (p *Peer) rewrite(attrs *pathAttributes, r Route) {
+	nextHop := r.NextHop()
+	if p.external() {
+		// When a given BGP speaker advertises the route to an external
+		// peer, the advertising speaker updates the AS_PATH attribute by
+		// prepending its own AS number as the first element.
+		// https://tools.ietf.org/html/rfc4271#section-5.1.2
+		attrs.asPath = attrs.asPath.prepend(p.myAS)
+		// A BGP speaker MUST NOT include this attribute in UPDATE
+		// messages it sends to external peers
+		// https://tools.ietf.org/html/rfc4271#section-5.1.5
+		attrs.localPref = nil
+		// The MULTI_EXIT_DISC attribute received from a neighboring AS
+		// MUST NOT be propagated to other neighboring ASes.
+		// https://tools.ietf.org/html/rfc4271#section-5.1.4
+		attrs.multiExitDisc = nil
+		// When sending a message to an external peer X, the BGP speaker
+		// uses the IP address of the interface it uses to reach X.
+		// https://tools.ietf.org/html/rfc4271#section-5.1.3
+		if local := p.localAddr(); local.Is4() == nextHop.Is4() {
+			nextHop = local
+		}
+	} else if attrs.localPref == nil {
+		// A BGP speaker MUST include the LOCAL_PREF attribute in UPDATE
+		// messages it sends to internal peers
+		lp := preference(r)
+		attrs.localPref = &lp
+	}
+	attrs.mpUnreach = nil
+	attrs.mpReach = nil
+	attrs.nextHop = netip.Addr{}
+	if r.Family() == IPv4Unicast {
+		attrs.nextHop = nextHop
+		return
+	}
+	attrs.mpReach = &mpReachNLRIAttr{family: r.Family(), nextHop: nextHop}
+}
+
+// localAddr returns the address of our end of the connection to the peer
+func (p *Peer) localAddr() netip.Addr {
+	if p.conn == nil {
+		return netip.Addr{}
+	}
+	ip, _ := splitAddr(p.conn.LocalAddr())
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
+
+// packUpdates puts routes in as few UPDATE messages as will hold them.
+// Routes with the same attributes share UPDATE messages, as do
+// withdrawals.
+func packUpdates(advertised []Route, withdrawn []netip.Prefix, fourOctet bool) []updateMsg {
+	var updates []updateMsg
+	slices.SortFunc(withdrawn, comparePrefixes)
+	var v4, v6 []netip.Prefix
+	for _, prefix := range withdrawn {
+		if familyOf(prefix) == IPv4Unicast {
+			v4 = append(v4, prefix)
+		} else {
+			v6 = append(v6, prefix)
+		}
+	}
+	for _, chunk := range chunkPrefixes(v4, maxUpdateLength(newUpdate(nil, nil, nil))) {
+		updates = append(updates, newUpdate(chunk, nil, nil))
+	}
+	unreach := func(prefixes []netip.Prefix) pathAttributes {
+		return pathAttributes{mpUnreach: &mpUnreachNLRIAttr{IPv6Unicast, prefixes}}
+	}
+	for _, chunk := range chunkPrefixes(v6, maxUpdateLength(newUpdate(nil, unreach(nil).raw(fourOctet), nil))) {
+		updates = append(updates, newUpdate(nil, unreach(chunk).raw(fourOctet), nil))
+	}
+
+	// Group the routes by the attributes they are advertised with
+	slices.SortFunc(advertised, func(a, b Route) int {
+		return comparePrefixes(a.prefix, b.prefix)
+	})
+	type group struct {
+		attrs    pathAttributes
+		prefixes []netip.Prefix
+	}
+	groups := map[string]*group{}
+	var order []string
+	for _, r := range advertised {
+		key := string(newUpdate(nil, r.attrs.raw(fourOctet), nil).bytes())
+		g, ok := groups[key]
+		if !ok {
+			g = &group{attrs: *r.attrs}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.prefixes = append(g.prefixes, r.prefix)
+	}
+	for _, key := range order {
+		g := groups[key]
+		if g.attrs.mpReach == nil {
+			raw := g.attrs.raw(fourOctet)
+			for _, chunk := range chunkPrefixes(g.prefixes, maxUpdateLength(newUpdate(nil, raw, nil))) {
+				updates = append(updates, newUpdate(nil, raw, chunk))
+			}
+			continue
+		}
+		// The NLRI of other address families goes in MP_REACH_NLRI
+		reach := func(prefixes []netip.Prefix) []pathAttribute {
+			attrs := g.attrs
+			mp := *attrs.mpReach
+			mp.nlri = prefixes
+			attrs.mpReach = &mp
+			return attrs.raw(fourOctet)
+		}
+		for _, chunk := range chunkPrefixes(g.prefixes, maxUpdateLength(newUpdate(nil, reach(nil), nil))) {
+			updates = append(updates, newUpdate(nil, reach(chunk), nil))
+		}
+	}
+	return updates
+}
+
+// maxUpdateLength returns how many octets of prefixes can be added to u
+// before it is too long to send. An attribute the prefixes are added to may
+// need 1 more octet for an extended length.
+func maxUpdateLength(u updateMsg) int {
+	return maxMessageLength - messageHeaderLength - u.length() - 1
+}
+
+// chunkPrefixes splits prefixes into runs that fit in size octets each
+func chunkPrefixes(prefixes []netip.Prefix, size int) [][]netip.Prefix {
+	var chunks [][]netip.Prefix
+	start, used := 0, 0
+	for i, prefix := range prefixes {
+		n := 1 + prefixOctets(prefix.Bits())
+		if used+n > size {
+			chunks = append(chunks, prefixes[start:i])
+			start, used = i, 0
+		}
+		used += n
+	}
+	if start < len(prefixes) {
+		chunks = append(chunks, prefixes[start:])
+	}
+	return chunks
+}
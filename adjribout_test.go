@@ -0,0 +1,279 @@
+package kbgp
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+// exportingPeer adds a peer in AS as to s with an Established session for
+// IPv4 and IPv6 over a loopback connection, and returns the peer's end of
+// that connection
+func exportingPeer(t *testing.T, s *Speaker, as asn) (*Peer, net.Conn) {
+	local, remote := tcpPair(t)
+	p := NewPeer(as, net.ParseIP("127.0.0.1"))
+	p.EnableFamilies(IPv4Unicast, IPv6Unicast)
+	if err := s.AddPeer(p); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	p.do(func() {
+		p.conn = local
+		p.negotiate([]capability{
+			multiprotocolCapability{IPv4Unicast},
+			multiprotocolCapability{IPv6Unicast},
+			fourOctetASCapability{as},
+		})
+		p.fsm.transition(established)
+	})
+	return p, remote
+}
+
+// paused holds up the peer's event loop until the returned function is
+// called, so that changes made meanwhile are picked up together
+func paused(p *Peer) func() {
+	running, resume := make(chan struct{}), make(chan struct{})
+	go p.do(func() {
+		close(running)
+		<-resume
+	})
+	<-running
+	return func() { close(resume) }
+}
+
+// expectUpdate reads an UPDATE message from conn
+func expectUpdate(t *testing.T, conn net.Conn) (updateMsg, pathAttributes) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	header, body, err := readHeader(conn)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if header.msgType != update {
+		t.Fatal("Expected an UPDATE message got", header.msgType)
+	}
+	u, err := readUpdate(body)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	// Our loopback address is not one a peer would accept as a NEXT_HOP,
+	// so that is left for the test to look at
+	attrs, err := newPathAttributes(u.pathAttributes, true)
+	if err != nil && updateErrorAction(err) == sessionReset {
+		t.Fatal("Unexpected error", err)
+	}
+	return u, attrs
+}
+
+func TestAdjRIBOut(t *testing.T) {
+	s := NewSpeaker(65000, "")
+	a := NewPeer(65001, net.ParseIP("192.0.2.2"))
+	addPeer(t, s, a)
+	b, conn := exportingPeer(t, s, 65002)
+
+	// Routes with the same attributes go in one UPDATE message
+	routes := testRoutes("10.0.0.0/16", "10.1.0.0/16", "10.2.0.0/16")
+	resume := paused(b)
+	a.do(func() {
+		a.adjRIBIn.update(routes, nil, nil)
+	})
+	resume()
+	u, attrs := expectUpdate(t, conn)
+	if len(u.nlri) != 3 || len(u.withdrawnRoutes) != 0 {
+		t.Fatalf("Expected 3 prefixes advertised in one UPDATE got %v", u)
+	}
+	if got := attrs.asPath.String(); got != (asPathAttr{sequence(65000, 65001)}).String() {
+		t.Error("Expected our AS to be prepended got", got)
+	}
+	for _, a := range u.pathAttributes {
+		if a.attributeType.code == nextHop && !slices.Equal(a.value, []byte{127, 0, 0, 1}) {
+			t.Error("Expected the next hop to be our address got", a.value)
+		}
+	}
+	if attrs.localPref != nil {
+		t.Error("Expected no LOCAL_PREF to be sent to an external peer")
+	}
+
+	// Losing the best path withdraws the route
+	a.do(func() {
+		a.adjRIBIn.update(nil, []netip.Prefix{routes[1].Prefix()}, nil)
+	})
+	u, _ = expectUpdate(t, conn)
+	if !slices.Equal(u.withdrawnRoutes, []netip.Prefix{routes[1].Prefix()}) || len(u.nlri) != 0 {
+		t.Errorf("Expected %s to be withdrawn got %v", routes[1].Prefix(), u)
+	}
+
+	// Nothing is sent again for a route that is no different
+	a.do(func() {
+		a.adjRIBIn.update(testRoutes("10.0.0.0/16"), nil, nil)
+	})
+	// IPv6 routes are carried in MP_REACH_NLRI
+	v6 := newRoutes([]netip.Prefix{netip.MustParsePrefix("2001:db8::/32")}, pathAttributes{
+		present: map[uint8]bool{origin: true, asPath: true},
+		asPath:  asPathAttr{sequence(65001)},
+		mpReach: &mpReachNLRIAttr{family: IPv6Unicast, nextHop: netip.MustParseAddr("2001:db8::1")},
+	})
+	a.do(func() {
+		a.adjRIBIn.update(v6, nil, nil)
+	})
+	u, attrs = expectUpdate(t, conn)
+	if len(u.nlri) != 0 || attrs.mpReach == nil || !slices.Equal(attrs.mpReach.nlri, []netip.Prefix{v6[0].Prefix()}) {
+		t.Fatalf("Expected %s in MP_REACH_NLRI got %v", v6[0].Prefix(), u)
+	}
+	if attrs.mpReach.nextHop != netip.MustParseAddr("2001:db8::1") {
+		t.Error("Expected the next hop to be kept got", attrs.mpReach.nextHop)
+	}
+
+	// Every route goes when the session with the peer they came from does
+	resume = paused(b)
+	a.do(func() {
+		a.adjRIBIn.flush()
+	})
+	resume()
+	u, _ = expectUpdate(t, conn)
+	if len(u.withdrawnRoutes) != 2 {
+		t.Errorf("Expected 2 IPv4 routes to be withdrawn got %v", u)
+	}
+	_, attrs = expectUpdate(t, conn)
+	if attrs.mpUnreach == nil || !slices.Equal(attrs.mpUnreach.withdrawn, []netip.Prefix{v6[0].Prefix()}) {
+		t.Errorf("Expected %s in MP_UNREACH_NLRI got %v", v6[0].Prefix(), attrs)
+	}
+	b.do(func() {
+		if n := b.adjRIBOut.count(IPv4Unicast) + b.adjRIBOut.count(IPv6Unicast); n != 0 {
+			t.Errorf("Expected nothing left in the Adj-RIB-Out got %d routes", n)
+		}
+	})
+}
+
+func TestAdjRIBOutOnEstablished(t *testing.T) {
+	s := NewSpeaker(65000, "")
+	a := NewPeer(65001, net.ParseIP("192.0.2.2"))
+	addPeer(t, s, a)
+	a.do(func() {
+		a.adjRIBIn.update(testRoutes("10.0.0.0/16", "10.1.0.0/16"), nil, nil)
+	})
+	b, conn := exportingPeer(t, s, 65002)
+	u, _ := expectUpdate(t, conn)
+	if len(u.nlri) != 2 {
+		t.Errorf("Expected the Loc-RIB to be advertised got %v", u)
+	}
+
+	// A change of export policy withdraws what it no longer allows
+	b.SetExportPolicy(PolicyFunc(func(r Route) (Route, bool) {
+		return r, r.Prefix().Addr() != netip.MustParseAddr("10.1.0.0")
+	}))
+	u, _ = expectUpdate(t, conn)
+	if !slices.Equal(u.withdrawnRoutes, []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}) {
+		t.Errorf("Expected 10.1.0.0/16 to be withdrawn got %v", u)
+	}
+}
+
+func TestExportedPathOutlivesWithdrawals(t *testing.T) {
+	s := NewSpeaker(65000, "")
+	prefix := netip.MustParsePrefix("10.0.0.0/8")
+	var exported *path
+	s.locRIB.changed = func(_ netip.Prefix, best *path) { exported = best }
+	a := testPath("192.0.2.1")
+	b := testPath("192.0.2.2", withLocalPref(200))
+	s.locRIB.update(a.from, prefix, a.route, true)
+	s.locRIB.update(b.from, prefix, b.route, true)
+	// Withdrawing a path that is not the best leaves what was exported
+	// alone
+	s.locRIB.update(a.from, prefix, Route{}, false)
+	if exported == nil || exported.from.peer != b.from.peer || exported.route.attrs != b.route.attrs {
+		t.Errorf("Expected the exported path to still be via %s got %+v", b.route.NextHop(), exported)
+	}
+}
+
+func TestExportable(t *testing.T) {
+	s := NewSpeaker(65000, "")
+	p := NewPeer(65000, net.ParseIP("192.0.2.9"))
+	addPeer(t, s, p)
+	p.do(func() {
+		p.negotiate([]capability{multiprotocolCapability{IPv4Unicast}})
+	})
+	v6 := testPath("192.0.2.1")
+	v6.route.prefix = netip.MustParsePrefix("2001:db8::/32")
+	own := testPath("192.0.2.1")
+	own.from.peer = p
+	cases := map[string]struct {
+		path   path
+		policy Policy
+		ok     bool
+	}{
+		"external path":            {testPath("192.0.2.1"), nil, true},
+		"learned from the peer":    {own, nil, false},
+		"internal to internal":     {testPath("192.0.2.1", internalPath), nil, false},
+		"family not negotiated":    {v6, nil, false},
+		"rejected by policy":       {testPath("192.0.2.1"), PolicyFunc(func(r Route) (Route, bool) { return r, false }), false},
+		"changed by export policy": {testPath("192.0.2.1"), PolicyFunc(func(r Route) (Route, bool) { return r.WithMED(5), true }), true},
+	}
+	for name, c := range cases {
+		var r Route
+		var ok bool
+		p.SetExportPolicy(c.policy)
+		p.do(func() {
+			r, ok = p.exportable(&c.path)
+		})
+		if ok != c.ok {
+			t.Errorf("%s: expected %t got %t", name, c.ok, ok)
+		}
+		if !ok {
+			continue
+		}
+		// Internal peers are told our degree of preference, and the path
+		// is otherwise left alone
+		if lp, _ := r.LocalPref(); lp != defaultLocalPref {
+			t.Errorf("%s: expected LOCAL_PREF %d got %d", name, defaultLocalPref, lp)
+		}
+		if r.ASPathLength() != c.path.route.ASPathLength() || r.NextHop() != c.path.route.NextHop() {
+			t.Errorf("%s: expected the path to be unchanged got %s", name, r)
+		}
+		if c.path.route.attrs.localPref != nil {
+			t.Errorf("%s: the Loc-RIB's route was changed", name)
+		}
+	}
+}
+
+func TestPackUpdates(t *testing.T) {
+	attrs := func(as asn) pathAttributes {
+		return pathAttributes{
+			present: map[uint8]bool{origin: true, asPath: true, nextHop: true},
+			asPath:  asPathAttr{sequence(as)},
+			nextHop: netip.MustParseAddr("192.0.2.2"),
+		}
+	}
+	var many, few, withdrawn []netip.Prefix
+	for i := range 2000 {
+		many = append(many, netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 24))
+		withdrawn = append(withdrawn, netip.PrefixFrom(netip.AddrFrom4([4]byte{172, byte(i >> 8), byte(i), 0}), 24))
+	}
+	for i := range 10 {
+		few = append(few, netip.PrefixFrom(netip.AddrFrom4([4]byte{192, 168, byte(i), 0}), 24))
+	}
+	advertised := slices.Concat(newRoutes(many, attrs(65001)), newRoutes(few, attrs(65002)))
+
+	updates := packUpdates(advertised, withdrawn, true)
+	// 2 UPDATE messages of withdrawals, 2 for the many routes with the same
+	// attributes and 1 for the few
+	if len(updates) != 5 {
+		t.Errorf("Expected 5 UPDATE messages got %d", len(updates))
+	}
+	var nlri, withdrawals int
+	for _, u := range updates {
+		if n := messageHeaderLength + u.length(); n > maxMessageLength {
+			t.Errorf("UPDATE message is %d octets", n)
+		}
+		read, err := readUpdate(u.bytes())
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		nlri += len(read.nlri)
+		withdrawals += len(read.withdrawnRoutes)
+	}
+	if nlri != len(advertised) || withdrawals != len(withdrawn) {
+		t.Errorf("Expected %d routes advertised and %d withdrawn got %d and %d",
+			len(advertised), len(withdrawn), nlri, withdrawals)
+	}
+}
@@ -0,0 +1,119 @@
+package kbgp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// BGP Support for Four-Octet Autonomous System (AS) Number Space
+// https://tools.ietf.org/html/rfc6793
+
+// AS_TRANS is a reserved 2-octet AS number that stands in for a 4-octet
+// AS number wherever only 2 octets are available
+const asTrans asn = 23456
+
+// Capability Code for the 4-octet AS number capability
+const fourOctetASCapabilityCode = 65
+
+// A BGP speaker that supports 4-octet AS numbers advertises this
+// capability with its own AS number as the value.
+// https://tools.ietf.org/html/rfc6793#section-3
+type fourOctetASCapability struct {
+	as asn
+}
+
+func init() {
+	registerCapability(fourOctetASCapabilityCode, readFourOctetASCapability)
+}
+
+func readFourOctetASCapability(value []byte) (capability, error) {
+	if len(value) != 4 {
+		return nil, newBGPError(openMessageError, 0, "malformed 4-octet AS number capability")
+	}
+	return fourOctetASCapability{asn(binary.BigEndian.Uint32(value))}, nil
+}
+
+// code implements capability
+func (c fourOctetASCapability) code() uint8 { return fourOctetASCapabilityCode }
+
+// matches implements capability
+func (c fourOctetASCapability) matches(remote capability) bool {
+	return remote.code() == fourOctetASCapabilityCode
+}
+
+// bytes implements byter
+func (c fourOctetASCapability) bytes() []byte { return c.as.bytes() }
+
+// length implements byter
+func (c fourOctetASCapability) length() int { return c.as.length() }
+
+// String implements strings.Stringer
+func (c fourOctetASCapability) String() string {
+	return fmt.Sprintf("%s AS%d", capabilityString(c), c.as)
+}
+
+// fourOctet returns true if both sides of the session support 4-octet AS
+// numbers, in which case AS_PATH and AGGREGATOR carry them directly
+func (p *Peer) fourOctet() bool {
+	return len(p.negotiatedCapabilities(fourOctetASCapabilityCode)) > 0
+}
+
+// peerAS returns the AS number of the speaker that sent the OPEN message.
+// A speaker with a 4-octet AS number puts AS_TRANS in the My Autonomous
+// System field and its real AS number in the capability.
+func (o openMsg) peerAS() asn {
+	caps, _ := o.capabilities()
+	for _, c := range caps {
+		if c, ok := c.(fourOctetASCapability); ok {
+			return c.as
+		}
+	}
+	return o.as
+}
+
+// mergeAS4Path reconstructs the full AS path received from a speaker that
+// does not support 4-octet AS numbers. The AS4_PATH carries the 4-octet
+// form of the rightmost part of the path, and the AS_PATH supplies any ASes
+// prepended by other old speakers along the way.
+// https://tools.ietf.org/html/rfc6793#section-4.2.3
+func mergeAS4Path(path asPathAttr, as4Path asPathAttr) asPathAttr {
+	// If the number of AS numbers in the AS_PATH attribute is less than
+	// the number of AS numbers in the AS4_PATH attribute, then the
+	// AS4_PATH attribute SHALL be ignored, and the AS_PATH attribute
+	// SHALL be taken as the AS path information.
+	keep := path.pathLength() - as4Path.pathLength()
+	if keep < 0 {
+		return path
+	}
+	merged := asPathAttr{}
+	for _, s := range path {
+		if keep == 0 {
+			break
+		}
+		if s.segmentType == asSet {
+			merged = append(merged, s)
+			keep--
+			continue
+		}
+		n := len(s.asns)
+		if n > keep {
+			n = keep
+		}
+		merged = append(merged, asPathSegment{asSequence, append([]asn{}, s.asns[:n]...)})
+		keep -= n
+	}
+	return append(merged, as4Path...)
+}
+
+// needsAS4 returns true if the path has an AS number that does not fit
+// in 2 octets
+func (p asPathAttr) needsAS4() bool {
+	for _, s := range p {
+		for _, a := range s.asns {
+			if a.mappable() != a {
+				return true
+			}
+		}
+	}
+	return false
+}
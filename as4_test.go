@@ -0,0 +1,148 @@
+package kbgp
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func sequence(asns ...asn) asPathSegment {
+	return asPathSegment{asSequence, asns}
+}
+
+func set(asns ...asn) asPathSegment {
+	return asPathSegment{asSet, asns}
+}
+
+func TestMappable(t *testing.T) {
+	if asn(65000).mappable() != 65000 {
+		t.Error("Expected a 2-octet AS to map to itself")
+	}
+	if asn(4200000000).mappable() != asTrans {
+		t.Error("Expected a 4-octet AS to map to AS_TRANS")
+	}
+	if !bytes.Equal(asn(4200000000).twoOctetBytes(), []byte{0x5b, 0xa0}) {
+		t.Errorf("Unexpected encoding %v", asn(4200000000).twoOctetBytes())
+	}
+}
+
+func TestOpenUsesASTrans(t *testing.T) {
+	p := NewPeer(65001, net.ParseIP("192.0.2.1"))
+	p.myAS = 4200000000
+	o, err := readOpen(newOpen(p).bytes())
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if o.as != asTrans {
+		t.Errorf("Expected AS_TRANS in the OPEN got %d", o.as)
+	}
+	if o.peerAS() != 4200000000 {
+		t.Errorf("Expected the capability's AS got %d", o.peerAS())
+	}
+	if (openMsg{as: 65001}).peerAS() != 65001 {
+		t.Error("Expected the OPEN's AS without the capability")
+	}
+}
+
+func TestMergeAS4Path(t *testing.T) {
+	cases := map[string]struct {
+		path, as4Path, expected asPathAttr
+	}{
+		"old speaker prepended": {
+			asPathAttr{sequence(65001, 65002, asTrans, asTrans)},
+			asPathAttr{sequence(65002, 4200000001, 4200000002)},
+			asPathAttr{sequence(65001), sequence(65002, 4200000001, 4200000002)},
+		},
+		"same length": {
+			asPathAttr{sequence(asTrans, 65002)},
+			asPathAttr{sequence(4200000001, 65002)},
+			asPathAttr{sequence(4200000001, 65002)},
+		},
+		"as4 path longer is ignored": {
+			asPathAttr{sequence(65001)},
+			asPathAttr{sequence(4200000001, 65002)},
+			asPathAttr{sequence(65001)},
+		},
+		"set counts as one": {
+			asPathAttr{set(65001, 65003), sequence(65002, asTrans)},
+			asPathAttr{sequence(65002, 4200000001)},
+			asPathAttr{set(65001, 65003), sequence(65002, 4200000001)},
+		},
+	}
+	for name, c := range cases {
+		merged := mergeAS4Path(c.path, c.as4Path)
+		if merged.String() != c.expected.String() {
+			t.Errorf("%s: expected %s got %s", name, c.expected, merged)
+		}
+	}
+}
+
+func TestAS4RoundTripThroughOldSpeaker(t *testing.T) {
+	attrs := pathAttributes{
+		present:    map[uint8]bool{origin: true, asPath: true},
+		asPath:     asPathAttr{sequence(4200000001, 65002)},
+		nextHop:    netip.MustParseAddr("192.0.2.1"),
+		aggregator: &aggregatorAttr{4200000001, netip.MustParseAddr("10.0.0.1")},
+	}
+	raw := attrs.raw(false)
+	codes := []uint8{}
+	for _, a := range raw {
+		codes = append(codes, a.attributeType.code)
+	}
+	if !bytes.Equal(codes, []byte{origin, asPath, nextHop, aggregator, as4Path, as4Aggregator}) {
+		t.Fatalf("Unexpected attributes %v", raw)
+	}
+	if !bytes.Equal(raw[1].value, []byte{asSequence, 2, 0x5b, 0xa0, 0xfd, 0xea}) {
+		t.Errorf("Expected AS_TRANS in the AS_PATH got %v", raw[1].value)
+	}
+	if !bytes.Equal(raw[3].value[:2], []byte{0x5b, 0xa0}) {
+		t.Errorf("Expected AS_TRANS in the AGGREGATOR got %v", raw[3].value)
+	}
+
+	read, err := newPathAttributes(raw, false)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if read.asPath.String() != attrs.asPath.String() {
+		t.Errorf("Expected %s got %s", attrs.asPath, read.asPath)
+	}
+	if *read.aggregator != *attrs.aggregator {
+		t.Errorf("Expected %s got %s", attrs.aggregator, read.aggregator)
+	}
+	if read.present[as4Path] || read.present[as4Aggregator] {
+		t.Error("Did not expect the AS4 attributes to be kept")
+	}
+}
+
+func TestAS4BetweenNewSpeakers(t *testing.T) {
+	attrs := pathAttributes{
+		present: map[uint8]bool{asPath: true},
+		asPath:  asPathAttr{sequence(4200000001, 65002)},
+	}
+	raw := attrs.raw(true)
+	if len(raw) != 1 || !bytes.Equal(raw[0].value, []byte{asSequence, 2, 0xfa, 0x56, 0xea, 0x01, 0, 0, 0xfd, 0xea}) {
+		t.Fatalf("Unexpected attributes %v", raw)
+	}
+	read, err := newPathAttributes(append(raw, rawAttribute(optional|transitive, as4Path, asSequence, 1, 0, 0, 0, 1)), true)
+	if updateErrorAction(err) != attributeDiscard {
+		t.Errorf("Expected an AS4_PATH between new speakers to be discarded, got %v", err)
+	}
+	if read.asPath.String() != "4200000001 65002" {
+		t.Errorf("Unexpected path %s", read.asPath)
+	}
+}
+
+func TestAS4IgnoredWithoutASTransAggregator(t *testing.T) {
+	read, err := newPathAttributes([]pathAttribute{
+		rawAttribute(transitive, asPath, asSequence, 1, 0xfd, 0xea),
+		rawAttribute(optional|transitive, aggregator, 0xfd, 0xea, 10, 0, 0, 1),
+		rawAttribute(optional|transitive, as4Path, asSequence, 1, 0, 0, 0, 1),
+	}, false)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if read.asPath.String() != "65002" {
+		t.Errorf("Expected the AS4_PATH to be ignored, got %s", read.asPath)
+	}
+}
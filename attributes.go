@@ -0,0 +1,559 @@
+package kbgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// pathAttributes is the typed form of the path attributes carried in an
+// UPDATE message. Optional attributes that are absent are left nil.
+// https://tools.ietf.org/html/rfc4271#section-5
+type pathAttributes struct {
+	origin          originAttr
+	asPath          asPathAttr
+	nextHop         netip.Addr
+	multiExitDisc   *uint32
+	localPref       *uint32
+	atomicAggregate bool
+	aggregator      *aggregatorAttr
+	// Routes for address families other than IPv4 unicast
+	// https://tools.ietf.org/html/rfc4760
+	mpReach   *mpReachNLRIAttr
+	mpUnreach *mpUnreachNLRIAttr
+	// AS4_PATH and AS4_AGGREGATOR as received from a speaker that does
+	// not support 4-octet AS numbers, until they are merged in
+	as4Path       asPathAttr
+	as4Aggregator *aggregatorAttr
+	// Unrecognized optional transitive attributes, retained so they can
+	// be passed along to other peers
+	unknown []pathAttribute
+	// Which attributes were present in the UPDATE message
+	present map[uint8]bool
+}
+
+// ORIGIN is a well-known mandatory attribute that defines the
+// origin of the path information.
+type originAttr uint8
+
+const (
+	// IGP - Network Layer Reachability Information
+	// is interior to the originating AS
+	igp = iota
+	// EGP - Network Layer Reachability Information
+	// learned via the EGP protocol [RFC904]
+	egp
+	// INCOMPLETE - Network Layer Reachability
+	// Information learned by some other means
+	incomplete
+)
+
+var originName = map[originAttr]string{
+	igp:        "IGP",
+	egp:        "EGP",
+	incomplete: "INCOMPLETE",
+}
+
+// String implements strings.Stringer
+func (o originAttr) String() string {
+	name, ok := originName[o]
+	if !ok {
+		return fmt.Sprintf("UNKNOWN(%d)", uint8(o))
+	}
+	return name
+}
+
+// AS_PATH is a well-known mandatory attribute that is composed
+// of a sequence of AS path segments.  Each AS path segment is
+// represented by a triple <path segment type, path segment
+// length, path segment value>.
+type asPathAttr []asPathSegment
+
+type asPathSegment struct {
+	segmentType uint8
+	asns        []asn
+}
+
+const (
+	_ = iota
+	// AS_SET: unordered set of ASes a route in the
+	// UPDATE message has traversed
+	asSet
+	// AS_SEQUENCE: ordered set of ASes a route in
+	// the UPDATE message has traversed
+	asSequence
+)
+
+var asPathSegmentName = map[uint8]string{
+	asSet:      "AS_SET",
+	asSequence: "AS_SEQUENCE",
+}
+
+// pathLength is the number of ASes in the path, where an AS_SET counts
+// as 1 no matter how many ASes are in the set
+// https://tools.ietf.org/html/rfc4271#section-9.1.2.2
+func (p asPathAttr) pathLength() int {
+	l := 0
+	for _, s := range p {
+		if s.segmentType == asSet {
+			l++
+			continue
+		}
+		l += len(s.asns)
+	}
+	return l
+}
+
+// contains returns true if as is anywhere in the path
+func (p asPathAttr) contains(as asn) bool {
+	for _, s := range p {
+		if slices.Contains(s.asns, as) {
+			return true
+		}
+	}
+	return false
+}
+
+// first returns the leftmost AS in the path, or false if the path does
+// not start with an AS_SEQUENCE
+func (p asPathAttr) first() (asn, bool) {
+	if len(p) == 0 || p[0].segmentType != asSequence || len(p[0].asns) == 0 {
+		return 0, false
+	}
+	return p[0].asns[0], true
+}
+
+// prepend returns a copy of the path with as added as its leftmost AS.
+// If the first path segment of the AS_PATH is of type AS_SEQUENCE, the
+// local system prepends its own AS number as the last element of the
+// sequence (put it in the leftmost position with respect to the position
+// of octets in the protocol message). If the first path segment is of
+// type AS_SET, or the AS_PATH is empty, the local system prepends a new
+// path segment of type AS_SEQUENCE to the AS_PATH, including its own AS
+// number in that segment.
+// https://tools.ietf.org/html/rfc4271#section-5.1.2
+func (p asPathAttr) prepend(as asn) asPathAttr {
+	if len(p) > 0 && p[0].segmentType == asSequence && len(p[0].asns) < 255 {
+		first := asPathSegment{asSequence, slices.Concat([]asn{as}, p[0].asns)}
+		return slices.Concat(asPathAttr{first}, p[1:])
+	}
+	return slices.Concat(asPathAttr{{asSequence, []asn{as}}}, p)
+}
+
+// String implements strings.Stringer
+func (p asPathAttr) String() string {
+	segments := []string{}
+	for _, s := range p {
+		asns := []string{}
+		for _, a := range s.asns {
+			asns = append(asns, fmt.Sprintf("%d", a))
+		}
+		if s.segmentType == asSet {
+			segments = append(segments, "{"+strings.Join(asns, ",")+"}")
+			continue
+		}
+		segments = append(segments, strings.Join(asns, " "))
+	}
+	return strings.Join(segments, " ")
+}
+
+// readASPath decodes an AS path whose AS numbers are asnLength octets long
+func readASPath(b []byte, asnLength int) (asPathAttr, error) {
+	path := asPathAttr{}
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, newUpdateError(treatAsWithdraw, malformedASPath, "truncated segment")
+		}
+		s := asPathSegment{segmentType: b[0]}
+		if _, ok := asPathSegmentName[s.segmentType]; !ok {
+			return nil, newUpdateError(treatAsWithdraw, malformedASPath, "unknown segment type")
+		}
+		// The path segment length is a 1-octet length field,
+		// containing the number of ASes (not the number of octets) in
+		// the path segment value field.
+		count := int(b[1])
+		if count == 0 || len(b) < 2+count*asnLength {
+			return nil, newUpdateError(treatAsWithdraw, malformedASPath, "bad segment length")
+		}
+		for i := 0; i < count; i++ {
+			s.asns = append(s.asns, readASN(b[2+i*asnLength:], asnLength))
+		}
+		path = append(path, s)
+		b = b[2+count*asnLength:]
+	}
+	return path, nil
+}
+
+// readASN decodes a 2 or 4 octet AS number
+func readASN(b []byte, asnLength int) asn {
+	if asnLength == 2 {
+		return asn(binary.BigEndian.Uint16(b))
+	}
+	return asn(binary.BigEndian.Uint32(b))
+}
+
+// asnLength is how many octets AS numbers take in AS_PATH and AGGREGATOR
+func asnLength(fourOctet bool) int {
+	if fourOctet {
+		return 4
+	}
+	return 2
+}
+
+// bytes implements byter
+func (p asPathAttr) bytes() []byte {
+	return p.encode(true)
+}
+
+// encode writes the path with 4-octet AS numbers, or with 2-octet AS
+// numbers and AS_TRANS in place of any that do not fit
+func (p asPathAttr) encode(fourOctet bool) []byte {
+	buf := bytes.NewBuffer([]byte{})
+	for _, s := range p {
+		buf.WriteByte(s.segmentType)
+		buf.WriteByte(byte(len(s.asns)))
+		for _, a := range s.asns {
+			if fourOctet {
+				buf.Write(a.bytes())
+			} else {
+				buf.Write(a.twoOctetBytes())
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// length implements byter
+func (p asPathAttr) length() int { return len(p.bytes()) }
+
+// AGGREGATOR is an optional transitive attribute of length 6.
+// The attribute contains the last AS number that formed the
+// aggregate route (encoded as 2 octets), followed by the IP
+// address of the BGP speaker that formed the aggregate route
+// (encoded as 4 octets).  Between speakers that support 4-octet
+// AS numbers the AS number is encoded as 4 octets instead.
+type aggregatorAttr struct {
+	as asn
+	ip netip.Addr
+}
+
+// String implements strings.Stringer
+func (a aggregatorAttr) String() string {
+	return fmt.Sprintf("AS%d/%s", a.as, a.ip)
+}
+
+func readAggregator(b []byte, asnLength int) *aggregatorAttr {
+	return &aggregatorAttr{
+		as: readASN(b, asnLength),
+		ip: netip.AddrFrom4([4]byte(b[asnLength:])),
+	}
+}
+
+// bytes implements byter
+func (a aggregatorAttr) bytes() []byte {
+	return a.encode(true)
+}
+
+func (a aggregatorAttr) encode(fourOctet bool) []byte {
+	if fourOctet {
+		return append(a.as.bytes(), a.ip.AsSlice()...)
+	}
+	return append(a.as.twoOctetBytes(), a.ip.AsSlice()...)
+}
+
+// length implements byter
+func (a aggregatorAttr) length() int { return len(a.bytes()) }
+
+// attributeRule describes how a recognized attribute must be flagged, how
+// long its value must be, and how an UPDATE message carrying a malformed
+// copy of it is handled. A length of -1 means variable length.
+type attributeRule struct {
+	flags     uint8
+	length    int
+	malformed errorAction
+}
+
+// https://tools.ietf.org/html/rfc7606#section-7
+var attributeRules = map[uint8]attributeRule{
+	origin:          {transitive, 1, treatAsWithdraw},
+	asPath:          {transitive, -1, treatAsWithdraw},
+	nextHop:         {transitive, 4, treatAsWithdraw},
+	multiExitDisc:   {optional, 4, treatAsWithdraw},
+	localPref:       {transitive, 4, treatAsWithdraw},
+	atomicAggregate: {transitive, 0, attributeDiscard},
+	aggregator:      {optional | transitive, -1, attributeDiscard},
+	// https://tools.ietf.org/html/rfc7606#section-7.11
+	mpReachNLRI:   {optional, -1, sessionReset},
+	mpUnreachNLRI: {optional, -1, sessionReset},
+	// https://tools.ietf.org/html/rfc6793#section-6
+	as4Path:       {optional | transitive, -1, attributeDiscard},
+	as4Aggregator: {optional | transitive, 8, attributeDiscard},
+}
+
+// newPathAttributes decodes and validates the raw attributes of an UPDATE
+// message. Errors carry the UPDATE Message Error subcode to send. Errors
+// that RFC 7606 allows to be handled without a session reset do not stop
+// decoding, and all of them are returned joined together. fourOctet is
+// whether the session carries 4-octet AS numbers.
+// https://tools.ietf.org/html/rfc4271#section-6.3
+func newPathAttributes(raw []pathAttribute, fourOctet bool) (pathAttributes, error) {
+	attrs := pathAttributes{present: map[uint8]bool{}}
+	var errs []error
+	for _, a := range raw {
+		err := attrs.read(a, fourOctet)
+		if err == nil {
+			continue
+		}
+		if updateErrorAction(err) == sessionReset {
+			return pathAttributes{}, err
+		}
+		errs = append(errs, err)
+	}
+	if err := attrs.mergeAS4(fourOctet); err != nil {
+		errs = append(errs, err)
+	}
+	return attrs, errors.Join(errs...)
+}
+
+// mergeAS4 folds AS4_PATH and AS4_AGGREGATOR into AS_PATH and AGGREGATOR
+// https://tools.ietf.org/html/rfc6793#section-4.2.3
+func (attrs *pathAttributes) mergeAS4(fourOctet bool) error {
+	path4, aggregator4 := attrs.as4Path, attrs.as4Aggregator
+	attrs.as4Path, attrs.as4Aggregator = nil, nil
+	if !attrs.present[as4Path] && !attrs.present[as4Aggregator] {
+		return nil
+	}
+	delete(attrs.present, as4Path)
+	delete(attrs.present, as4Aggregator)
+	// A NEW BGP speaker MUST NOT send these to another NEW speaker, and
+	// if received they are discarded.
+	if fourOctet {
+		return newUpdateError(attributeDiscard, malformedAttributeList,
+			"AS4_PATH or AS4_AGGREGATOR from a 4-octet AS speaker")
+	}
+	// If the AGGREGATOR attribute does not contain AS_TRANS, then the
+	// AS4_AGGREGATOR and AS4_PATH attributes SHALL be ignored.
+	if attrs.aggregator != nil && attrs.aggregator.as != asTrans {
+		return nil
+	}
+	if attrs.aggregator != nil && aggregator4 != nil {
+		attrs.aggregator = aggregator4
+	}
+	if path4 != nil {
+		attrs.asPath = mergeAS4Path(attrs.asPath, path4)
+	}
+	return nil
+}
+
+// read decodes a single raw attribute into the typed set
+func (attrs *pathAttributes) read(a pathAttribute, fourOctet bool) error {
+	t := a.attributeType
+	rule, ok := attributeRules[t.code]
+	if !ok {
+		return attrs.readUnknown(a)
+	}
+	// If any recognized attribute has Attribute Flags that conflict
+	// with the Attribute Type Code, then the Error Subcode MUST be set
+	// to Attribute Flags Error.  The Data field MUST contain the
+	// erroneous attribute (type, length, and value).
+	if t.flags&(optional|transitive) != rule.flags {
+		return newUpdateError(rule.malformed, attributeFlagsError, string(a.bytes()))
+	}
+	// If any recognized attribute has an Attribute Length that
+	// conflicts with the expected length (based on the attribute type
+	// code), then the Error Subcode MUST be set to Attribute Length
+	// Error.
+	if rule.length >= 0 && len(a.value) != rule.length {
+		return newUpdateError(rule.malformed, attributeLengthError, string(a.bytes()))
+	}
+	switch t.code {
+	case origin:
+		// If the ORIGIN attribute has an undefined value, then the Error
+		// Subcode MUST be set to Invalid Origin Attribute.
+		attrs.origin = originAttr(a.value[0])
+		if _, ok := originName[attrs.origin]; !ok {
+			return newUpdateError(rule.malformed, invalidOriginAttribute, string(a.bytes()))
+		}
+	case asPath:
+		path, err := readASPath(a.value, asnLength(fourOctet))
+		if err != nil {
+			return err
+		}
+		attrs.asPath = path
+	case as4Path:
+		path, err := readASPath(a.value, 4)
+		if err != nil {
+			return newUpdateError(rule.malformed, malformedASPath, string(a.bytes()))
+		}
+		attrs.as4Path = path
+	case nextHop:
+		// If the NEXT_HOP attribute field is syntactically incorrect, then
+		// the Error Subcode MUST be set to Invalid NEXT_HOP Attribute.
+		ip := netip.AddrFrom4([4]byte(a.value))
+		if !ip.IsGlobalUnicast() {
+			return newUpdateError(rule.malformed, invalidNextHopAttribute, string(a.bytes()))
+		}
+		attrs.nextHop = ip
+	case multiExitDisc:
+		med := binary.BigEndian.Uint32(a.value)
+		attrs.multiExitDisc = &med
+	case localPref:
+		pref := binary.BigEndian.Uint32(a.value)
+		attrs.localPref = &pref
+	case atomicAggregate:
+		attrs.atomicAggregate = true
+	case aggregator:
+		if len(a.value) != asnLength(fourOctet)+4 {
+			return newUpdateError(rule.malformed, attributeLengthError, string(a.bytes()))
+		}
+		attrs.aggregator = readAggregator(a.value, asnLength(fourOctet))
+	case as4Aggregator:
+		attrs.as4Aggregator = readAggregator(a.value, 4)
+	case mpReachNLRI:
+		m, err := readMPReachNLRI(a.value)
+		if err != nil {
+			return err
+		}
+		// Keep the routes so they can be treated as withdrawn
+		attrs.mpReach = m
+		if m.family.supported() && !m.validNextHop() {
+			return newUpdateError(treatAsWithdraw, invalidNextHopAttribute, string(a.bytes()))
+		}
+	case mpUnreachNLRI:
+		m, err := readMPUnreachNLRI(a.value)
+		if err != nil {
+			return err
+		}
+		attrs.mpUnreach = m
+	}
+	attrs.present[t.code] = true
+	return nil
+}
+
+// readUnknown handles attributes this speaker does not recognize
+// https://tools.ietf.org/html/rfc4271#section-5
+func (attrs *pathAttributes) readUnknown(a pathAttribute) error {
+	t := a.attributeType
+	// If any of the well-known mandatory attributes are not
+	// recognized, then the Error Subcode MUST be set to Unrecognized
+	// Well-known Attribute.
+	if t.wellKnown() {
+		return newBGPError(updateMessageError, unrecognizedWellKnownAttribute, string(a.bytes()))
+	}
+	// Unrecognized non-transitive optional attributes MUST be quietly
+	// ignored and not passed along to other BGP peers.
+	if t.nonTransitive() {
+		return nil
+	}
+	// If an optional transitive attribute is unrecognized, the Partial
+	// bit in the attribute flags octet is set to 1, and the attribute
+	// is retained for propagation to other BGP speakers.
+	t.setPartial()
+	attrs.unknown = append(attrs.unknown, pathAttribute{attributeType: t, value: a.value})
+	attrs.present[t.code] = true
+	return nil
+}
+
+// validate checks that the well-known mandatory attributes are present
+// when the UPDATE message advertises routes. NEXT_HOP is only required
+// when routes are carried in the NLRI field, since MP_REACH_NLRI has a
+// next hop of its own.
+// https://tools.ietf.org/html/rfc4760#section-3
+func (attrs pathAttributes) validate(nlri bool) error {
+	required := []uint8{}
+	if nlri || attrs.mpReach != nil && len(attrs.mpReach.nlri) > 0 {
+		required = append(required, origin, asPath)
+	}
+	if nlri {
+		required = append(required, nextHop)
+	}
+	// If any of the well-known mandatory attributes are not present,
+	// then the Error Subcode MUST be set to Missing Well-known
+	// Attribute.  The Data field MUST contain the Attribute Type Code
+	// of the missing, well-known attribute.
+	for _, code := range required {
+		if !attrs.present[code] {
+			return newUpdateError(treatAsWithdraw, missingWellKnownAttribute, string([]byte{code}))
+		}
+	}
+	return nil
+}
+
+// raw encodes the typed attributes back into the form they are carried
+// in an UPDATE message, ordered by type code. When the session does not
+// carry 4-octet AS numbers, AS4_PATH and AS4_AGGREGATOR are added for any
+// that do not fit in 2 octets.
+func (attrs pathAttributes) raw(fourOctet bool) []pathAttribute {
+	var raw []pathAttribute
+	add := func(code uint8, value []byte) {
+		raw = append(raw, pathAttribute{
+			attributeType: attributeType{flags: attributeRules[code].flags, code: code},
+			value:         value,
+		})
+	}
+	if attrs.present[origin] {
+		add(origin, []byte{byte(attrs.origin)})
+	}
+	if attrs.present[asPath] {
+		add(asPath, attrs.asPath.encode(fourOctet))
+	}
+	if attrs.nextHop.IsValid() {
+		add(nextHop, attrs.nextHop.AsSlice())
+	}
+	if attrs.multiExitDisc != nil {
+		add(multiExitDisc, uint32ToBytes(*attrs.multiExitDisc))
+	}
+	if attrs.localPref != nil {
+		add(localPref, uint32ToBytes(*attrs.localPref))
+	}
+	if attrs.atomicAggregate {
+		add(atomicAggregate, []byte{})
+	}
+	if attrs.aggregator != nil {
+		add(aggregator, attrs.aggregator.encode(fourOctet))
+	}
+	if attrs.mpReach != nil {
+		add(mpReachNLRI, attrs.mpReach.bytes())
+	}
+	if attrs.mpUnreach != nil {
+		add(mpUnreachNLRI, attrs.mpUnreach.bytes())
+	}
+	if !fourOctet && attrs.asPath.needsAS4() {
+		add(as4Path, attrs.asPath.bytes())
+	}
+	if !fourOctet && attrs.aggregator != nil && attrs.aggregator.as.mappable() != attrs.aggregator.as {
+		add(as4Aggregator, attrs.aggregator.bytes())
+	}
+	return append(raw, attrs.unknown...)
+}
+
+// String implements strings.Stringer
+func (attrs pathAttributes) String() string {
+	s := fmt.Sprintf("ORIGIN:%s AS_PATH:[%s] NEXT_HOP:%s", attrs.origin, attrs.asPath, attrs.nextHop)
+	if attrs.multiExitDisc != nil {
+		s += fmt.Sprintf(" MULTI_EXIT_DISC:%d", *attrs.multiExitDisc)
+	}
+	if attrs.localPref != nil {
+		s += fmt.Sprintf(" LOCAL_PREF:%d", *attrs.localPref)
+	}
+	if attrs.atomicAggregate {
+		s += " ATOMIC_AGGREGATE"
+	}
+	if attrs.aggregator != nil {
+		s += fmt.Sprintf(" AGGREGATOR:%s", attrs.aggregator)
+	}
+	if attrs.mpReach != nil {
+		s += fmt.Sprintf(" MP_REACH_NLRI:[%s]", attrs.mpReach)
+	}
+	if attrs.mpUnreach != nil {
+		s += fmt.Sprintf(" MP_UNREACH_NLRI:[%s]", attrs.mpUnreach)
+	}
+	for _, u := range attrs.unknown {
+		s += " " + u.String()
+	}
+	return s
+}
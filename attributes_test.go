@@ -0,0 +1,141 @@
+package kbgp
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func rawAttribute(flags uint8, code uint8, value ...byte) pathAttribute {
+	return pathAttribute{attributeType{flags: flags, code: code}, value}
+}
+
+func TestNewPathAttributes(t *testing.T) {
+	raw := []pathAttribute{
+		rawAttribute(transitive, origin, egp),
+		rawAttribute(transitive, asPath, asSequence, 2, 0xfd, 0xe8, 0xfd, 0xe9, asSet, 2, 0, 1, 0, 2),
+		rawAttribute(transitive, nextHop, 192, 0, 2, 1),
+		rawAttribute(optional, multiExitDisc, 0, 0, 0, 10),
+		rawAttribute(transitive, localPref, 0, 0, 0, 100),
+		rawAttribute(transitive, atomicAggregate),
+		rawAttribute(optional|transitive, aggregator, 0xfd, 0xe8, 10, 0, 0, 1),
+	}
+	attrs, err := newPathAttributes(raw, false)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if attrs.origin != egp {
+		t.Errorf("Expected origin EGP got %s", attrs.origin)
+	}
+	if attrs.asPath.pathLength() != 3 {
+		t.Errorf("Expected a path length of 3 got %d", attrs.asPath.pathLength())
+	}
+	if first, _ := attrs.asPath.first(); first != 65000 {
+		t.Errorf("Expected leftmost AS 65000 got %d", first)
+	}
+	if attrs.nextHop != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("Unexpected next hop %s", attrs.nextHop)
+	}
+	if attrs.multiExitDisc == nil || *attrs.multiExitDisc != 10 {
+		t.Error("Expected a MED of 10")
+	}
+	if attrs.localPref == nil || *attrs.localPref != 100 {
+		t.Error("Expected a local pref of 100")
+	}
+	if !attrs.atomicAggregate {
+		t.Error("Expected atomic aggregate to be set")
+	}
+	if attrs.aggregator == nil || attrs.aggregator.as != 65000 ||
+		attrs.aggregator.ip != netip.MustParseAddr("10.0.0.1") {
+		t.Errorf("Unexpected aggregator %v", attrs.aggregator)
+	}
+	encoded := attrs.raw(false)
+	if len(encoded) != len(raw) {
+		t.Fatalf("Expected %d attributes got %d", len(raw), len(encoded))
+	}
+	for i := range raw {
+		if !bytes.Equal(encoded[i].bytes(), raw[i].bytes()) {
+			t.Errorf("Expected %v got %v", raw[i].bytes(), encoded[i].bytes())
+		}
+	}
+}
+
+func TestPathAttributeErrors(t *testing.T) {
+	cases := map[string]struct {
+		raw     pathAttribute
+		subcode int
+		action  errorAction
+	}{
+		"origin flags":       {rawAttribute(optional|transitive, origin, igp), attributeFlagsError, treatAsWithdraw},
+		"med flags":          {rawAttribute(transitive, multiExitDisc, 0, 0, 0, 0), attributeFlagsError, treatAsWithdraw},
+		"origin length":      {rawAttribute(transitive, origin, igp, igp), attributeLengthError, treatAsWithdraw},
+		"next hop length":    {rawAttribute(transitive, nextHop, 10, 0, 0), attributeLengthError, treatAsWithdraw},
+		"invalid origin":     {rawAttribute(transitive, origin, 3), invalidOriginAttribute, treatAsWithdraw},
+		"bad segment type":   {rawAttribute(transitive, asPath, 3, 1, 0, 1), malformedASPath, treatAsWithdraw},
+		"short segment":      {rawAttribute(transitive, asPath, asSequence, 2, 0, 1), malformedASPath, treatAsWithdraw},
+		"empty segment":      {rawAttribute(transitive, asPath, asSequence, 0), malformedASPath, treatAsWithdraw},
+		"multicast next hop": {rawAttribute(transitive, nextHop, 224, 0, 0, 1), invalidNextHopAttribute, treatAsWithdraw},
+		"atomic aggregate":   {rawAttribute(transitive, atomicAggregate, 1), attributeLengthError, attributeDiscard},
+		"aggregator length":  {rawAttribute(optional|transitive, aggregator, 1), attributeLengthError, attributeDiscard},
+		"unknown well-known": {rawAttribute(transitive, 99), unrecognizedWellKnownAttribute, sessionReset},
+	}
+	for name, c := range cases {
+		attrs, err := newPathAttributes([]pathAttribute{c.raw}, false)
+		var e bgpError
+		if !errors.As(err, &e) {
+			t.Errorf("%s: expected a bgpError got %v", name, err)
+			continue
+		}
+		if e.code != updateMessageError || e.subcode != c.subcode {
+			t.Errorf("%s: expected subcode %d got %d/%d", name, c.subcode, e.code, e.subcode)
+		}
+		if updateErrorAction(err) != c.action {
+			t.Errorf("%s: expected %s got %s", name, c.action, updateErrorAction(err))
+		}
+		if c.action == attributeDiscard && attrs.present[c.raw.attributeType.code] {
+			t.Errorf("%s: expected the attribute to be discarded", name)
+		}
+	}
+}
+
+func TestUnknownOptionalAttributes(t *testing.T) {
+	attrs, err := newPathAttributes([]pathAttribute{
+		rawAttribute(optional|transitive, 99, 1, 2, 3),
+		rawAttribute(optional, 100, 4, 5, 6),
+	}, false)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(attrs.unknown) != 1 {
+		t.Fatalf("Expected 1 retained attribute got %d", len(attrs.unknown))
+	}
+	u := attrs.unknown[0]
+	if u.attributeType.code != 99 || !u.attributeType.partial() || !u.attributeType.transitive() {
+		t.Errorf("Expected attribute 99 to be retained with the partial bit set, got %v", u)
+	}
+	if len(attrs.raw(false)) != 1 {
+		t.Errorf("Expected only the transitive attribute to be passed on, got %v", attrs.raw(false))
+	}
+}
+
+func TestMissingWellKnownAttribute(t *testing.T) {
+	attrs, err := newPathAttributes([]pathAttribute{
+		rawAttribute(transitive, origin, igp),
+		rawAttribute(transitive, asPath),
+	}, false)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := attrs.validate(false); err != nil {
+		t.Error("Did not expect an error for a withdraw-only update", err)
+	}
+	err = attrs.validate(true)
+	var e bgpError
+	if !errors.As(err, &e) || e.subcode != missingWellKnownAttribute || e.message != string([]byte{nextHop}) {
+		t.Errorf("Expected missing NEXT_HOP got %v", err)
+	}
+	if updateErrorAction(err) != treatAsWithdraw {
+		t.Errorf("Expected treat-as-withdraw got %s", updateErrorAction(err))
+	}
+}
@@ -0,0 +1,199 @@
+package kbgp
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+)
+
+// Capabilities Advertisement with BGP-4
+// https://tools.ietf.org/html/rfc5492
+//
+// Capabilities are carried in an OPEN message as an Optional Parameter.
+// Each one is a triple <Capability Code, Capability Length, Capability
+// Value>, and more than one can be carried in a single parameter.
+type capability interface {
+	byter
+	// code is the IANA assigned Capability Code
+	code() uint8
+	// matches returns true if the capability received from the peer means
+	// both sides support this capability
+	matches(remote capability) bool
+}
+
+// capabilityDecoder turns the value of a received capability into its
+// typed form
+type capabilityDecoder func(value []byte) (capability, error)
+
+// Capabilities this speaker understands, keyed by Capability Code
+var capabilityDecoders = map[uint8]capabilityDecoder{}
+
+// registerCapability plugs a capability into the speaker. Capabilities that
+// are not registered are ignored when received.
+func registerCapability(code uint8, decode capabilityDecoder) {
+	capabilityDecoders[code] = decode
+}
+
+// https://www.iana.org/assignments/capability-codes
+var capabilityName = map[uint8]string{
+	1:  "Multiprotocol Extensions for BGP-4",
+	2:  "Route Refresh Capability for BGP-4",
+	64: "Graceful Restart Capability",
+	65: "Support for 4-octet AS number capability",
+	69: "ADD-PATH Capability",
+	70: "Enhanced Route Refresh Capability",
+}
+
+// unknownCapability is a capability the peer advertised that we do not
+// support. It never matches anything we advertise.
+type unknownCapability struct {
+	capabilityCode uint8
+	value          []byte
+}
+
+// code implements capability
+func (u unknownCapability) code() uint8 { return u.capabilityCode }
+
+// matches implements capability
+func (u unknownCapability) matches(remote capability) bool { return false }
+
+// bytes implements byter
+func (u unknownCapability) bytes() []byte { return u.value }
+
+// length implements byter
+func (u unknownCapability) length() int { return len(u.value) }
+
+// String implements strings.Stringer
+func (u unknownCapability) String() string {
+	return capabilityString(u)
+}
+
+func capabilityString(c capability) string {
+	name, ok := capabilityName[c.code()]
+	if !ok {
+		name = "Unknown"
+	}
+	return fmt.Sprintf("%s (%d)", name, c.code())
+}
+
+// capabilityBytes encodes a capability as a <code, length, value> triple
+func capabilityBytes(c capability) []byte {
+	return append([]byte{c.code(), byte(c.length())}, c.bytes()...)
+}
+
+// readCapabilities decodes the value of a Capabilities Optional Parameter
+func readCapabilities(b []byte) ([]capability, error) {
+	var caps []capability
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, newBGPError(openMessageError, 0, "malformed capability")
+		}
+		code, value := b[0], b[2:2+int(b[1])]
+		b = b[2+int(b[1]):]
+		decode, ok := capabilityDecoders[code]
+		if !ok {
+			// If a BGP speaker receives from its peer a capability that it
+			// does not itself support or recognize, it MUST ignore that
+			// capability.
+			log.Println("Ignoring unsupported capability", code)
+			caps = append(caps, unknownCapability{code, value})
+			continue
+		}
+		c, err := decode(value)
+		if err != nil {
+			return nil, err
+		}
+		caps = append(caps, c)
+	}
+	return caps, nil
+}
+
+// newCapabilitiesParameter wraps capabilities in a single Optional Parameter
+func newCapabilitiesParameter(caps []capability) parameter {
+	buf := bytes.NewBuffer([]byte{})
+	for _, c := range caps {
+		buf.Write(capabilityBytes(c))
+	}
+	return parameter{parameterType: capabilitiesParameter, value: buf.Bytes()}
+}
+
+// localCapabilities returns every capability we advertise to this peer
+func (p *Peer) localCapabilities() []capability {
+	caps := []capability{}
+	for _, f := range p.families {
+		caps = append(caps, multiprotocolCapability{f})
+	}
+	caps = append(caps, fourOctetASCapability{p.myAS})
+	return append(caps, p.capabilities...)
+}
+
+// negotiate records the capabilities the peer advertised, and which of
+// them both sides support
+func (p *Peer) negotiate(remote []capability) {
+	p.remoteCapabilities = remote
+	p.negotiated = []capability{}
+	for _, local := range p.localCapabilities() {
+		for _, r := range remote {
+			if local.matches(r) {
+				p.negotiated = append(p.negotiated, r)
+				break
+			}
+		}
+	}
+	log.Println("Negotiated capabilities with", p, p.negotiated)
+}
+
+// negotiatedCapabilities returns the capabilities with the given code that
+// are in effect for this session
+func (p *Peer) negotiatedCapabilities(code uint8) []capability {
+	var caps []capability
+	for _, c := range p.negotiated {
+		if c.code() == code {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
+
+// RequireCapability makes the session fail with an Unsupported Capability
+// NOTIFICATION if the peer does not advertise the given capability
+func (p *Peer) RequireCapability(code uint8) {
+	p.configure(func() {
+		p.settings.requiredCapabilities = append(p.settings.requiredCapabilities, code)
+	})
+}
+
+// validateCapabilities checks that the peer advertised every capability
+// this peer requires
+// https://tools.ietf.org/html/rfc5492#section-5
+func (p *Peer) validateCapabilities(remote []capability) error {
+	missing := []byte{}
+	for _, code := range p.requiredCapabilities {
+		found := false
+		for _, r := range remote {
+			if r.code() == code {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		// The message MUST contain the capability or capabilities that
+		// cause the speaker to send the message.
+		advertised := false
+		for _, local := range p.localCapabilities() {
+			if local.code() == code {
+				missing = append(missing, capabilityBytes(local)...)
+				advertised = true
+			}
+		}
+		if !advertised {
+			missing = append(missing, code, 0)
+		}
+	}
+	if len(missing) > 0 {
+		return newBGPError(openMessageError, unsupportedCapability, string(missing))
+	}
+	return nil
+}
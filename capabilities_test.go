@@ -0,0 +1,133 @@
+package kbgp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+// testCapability is a capability with a fixed one octet value
+type testCapability struct {
+	value byte
+}
+
+func (t testCapability) code() uint8                    { return 200 }
+func (t testCapability) bytes() []byte                  { return []byte{t.value} }
+func (t testCapability) length() int                    { return 1 }
+func (t testCapability) matches(remote capability) bool { return remote.code() == t.code() }
+
+func registerTestCapability(t *testing.T) {
+	registerCapability(200, func(value []byte) (capability, error) {
+		if len(value) != 1 {
+			return nil, newBGPError(openMessageError, 0, "bad test capability")
+		}
+		return testCapability{value[0]}, nil
+	})
+	t.Cleanup(func() { delete(capabilityDecoders, 200) })
+}
+
+func TestOpenRoundTripWithCapabilities(t *testing.T) {
+	registerTestCapability(t)
+	p := NewPeer(65001, net.ParseIP("192.0.2.1"))
+	p.capabilities = []capability{testCapability{7}}
+	o := newOpen(p)
+	raw := o.bytes()
+	if len(raw) != minOpenBodyLength+17 {
+		t.Fatalf("Expected %d octets got %d", minOpenBodyLength+17, len(raw))
+	}
+	read, err := readOpen(raw)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !bytes.Equal(read.bytes(), raw) {
+		t.Errorf("Expected %v got %v", raw, read.bytes())
+	}
+	caps, err := read.capabilities()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(caps) != 3 || caps[2] != (testCapability{7}) {
+		t.Errorf("Expected the test capability got %v", caps)
+	}
+}
+
+func TestUnknownCapabilitiesIgnored(t *testing.T) {
+	caps, err := readCapabilities([]byte{201, 2, 1, 2, 202, 0})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(caps) != 2 || caps[0].code() != 201 || caps[1].code() != 202 {
+		t.Errorf("Expected two unknown capabilities got %v", caps)
+	}
+	if caps[0].matches(caps[1]) {
+		t.Error("Did not expect an unknown capability to match anything")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	p := NewPeer(65001, net.ParseIP("192.0.2.1"))
+	p.capabilities = []capability{testCapability{1}}
+	p.negotiate([]capability{unknownCapability{201, nil}, testCapability{2}})
+	caps := p.negotiatedCapabilities(200)
+	if len(caps) != 1 || caps[0] != (testCapability{2}) {
+		t.Errorf("Expected the peer's test capability to be negotiated, got %v", caps)
+	}
+	if len(p.negotiatedCapabilities(201)) != 0 {
+		t.Error("Did not expect an unknown capability to be negotiated")
+	}
+}
+
+func TestValidateOpenParameters(t *testing.T) {
+	registerTestCapability(t)
+	p := NewPeer(65001, net.ParseIP("192.0.2.1"))
+	p.fsm.state = connect
+	base := openMsg{version: version, as: 65001, holdTime: 90, bgpIdentifier: 0x0a000001}
+
+	cases := map[string]struct {
+		params   []parameter
+		required []uint8
+		subcode  int
+	}{
+		"unsupported parameter": {[]parameter{{1, []byte{0}}}, nil, unsupportedOptionalParameter},
+		"malformed capability":  {[]parameter{{capabilitiesParameter, []byte{200, 2, 0, 0}}}, nil, 0},
+		"truncated capability":  {[]parameter{{capabilitiesParameter, []byte{200, 2, 0}}}, nil, 0},
+		"missing capability":    {[]parameter{{capabilitiesParameter, []byte{201, 0}}}, []uint8{200}, unsupportedCapability},
+	}
+	for name, c := range cases {
+		p.requiredCapabilities = c.required
+		o := base
+		o.optParamaters = c.params
+		err := p.validateOpen(o)
+		var e bgpError
+		if !errors.As(err, &e) || e.code != openMessageError || e.subcode != c.subcode {
+			t.Errorf("%s: expected subcode %d got %v", name, c.subcode, err)
+		}
+	}
+
+	p.requiredCapabilities = []uint8{200}
+	p.capabilities = []capability{testCapability{3}}
+	o := base
+	o.optParamaters = []parameter{}
+	err := p.validateOpen(o)
+	var e bgpError
+	if !errors.As(err, &e) || e.message != string([]byte{200, 1, 3}) {
+		t.Errorf("Expected the missing capability in the data, got %v", err)
+	}
+	o.optParamaters = []parameter{{capabilitiesParameter, []byte{200, 1, 4}}}
+	if err := p.validateOpen(o); err != nil {
+		t.Error("Unexpected error", err)
+	}
+}
+
+func TestReadOpenErrors(t *testing.T) {
+	if _, err := readOpen([]byte{4, 0, 1}); err == nil {
+		t.Error("Expected a short OPEN message to fail")
+	}
+	if _, err := readOpen([]byte{4, 0, 1, 0, 90, 10, 0, 0, 1, 4, 2, 2}); err == nil {
+		t.Error("Expected a bad optional parameters length to fail")
+	}
+	if _, err := readOpen([]byte{4, 0, 1, 0, 90, 10, 0, 0, 1, 3, 2, 4, 0}); err == nil {
+		t.Error("Expected a truncated optional parameter to fail")
+	}
+}
@@ -1,23 +1,33 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 
 	"github.com/transitorykris/kbgp"
 )
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	log.Println("Creating a new speaker")
 	speaker := kbgp.NewSpeaker(1234, ":179")
 
 	log.Println("Adding a peer")
 	myPeer := kbgp.NewPeer(1234, net.ParseIP("192.168.86.30"))
-	speaker.Peer(myPeer)
+	if err := speaker.AddPeer(myPeer); err != nil {
+		log.Fatal(err)
+	}
 	myPeer.Up()
 
 	log.Println("Starting the speaker")
-	speaker.Start()
+	if err := speaker.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
 
 	log.Println("Exiting  kbgp")
 }
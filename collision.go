@@ -0,0 +1,78 @@
+package kbgp
+
+import (
+	"log"
+	"net"
+)
+
+// If a pair of BGP speakers try to establish a BGP connection with each
+// other simultaneously, then two parallel connections will be formed.
+// If the source IP address used by one of these connections is the same
+// as the destination IP address used by the other, and the destination
+// IP address used by the first connection is the same as the source IP
+// address used by the other, connection collision has occurred.  In the
+// event of connection collision, one of the connections MUST be closed.
+// https://tools.ietf.org/html/rfc4271#section-6.8
+
+// resolveCollision decides between the connection we already have with
+// the peer and a new one the peer opened to us. It returns true if the
+// new connection is to be used, in which case the existing one has been
+// closed. Otherwise the new connection has been closed.
+func (p *Peer) resolveCollision(conn net.Conn, open openMsg) bool {
+	log.Println("connection collision detected with", p)
+	switch p.fsm.state {
+	case openSent, openConfirm:
+	case established:
+		// Unless allowed via configuration, a connection collision with an
+		// existing BGP connection that is in the Established state causes
+		// closing of the newly created connection.
+		if !p.fsm.collisionDetectEstablishedState {
+			p.dumpConnection(conn)
+			return false
+		}
+	default:
+		// The existing connection never got as far as an OPEN message
+		p.close()
+		return true
+	}
+	// The BGP Identifier of the local system is compared to the BGP
+	// Identifier of the remote system (as specified in the OPEN message).
+	// Comparing BGP Identifiers is done by converting them to host byte
+	// order and treating them as 4-octet unsigned integers.
+	//
+	// If the value of the local BGP Identifier is less than the remote
+	// one, the local system closes the BGP connection that already exists
+	// (the one that is already in the OpenConfirm state), and accepts the
+	// BGP connection initiated by the remote system.
+	if p.myID < open.bgpIdentifier {
+		log.Println("dropping the existing connection to", p)
+		p.collided = true
+		p.fsm.event(OpenCollisionDump)
+		p.collided = false
+		// Start over listening so the FSM picks up the new connection
+		p.fsm.event(AutomaticStartWithPassiveTCPEstablishment)
+		return true
+	}
+	// Otherwise, the local system closes the newly created BGP connection
+	// (the one associated with the newly received OPEN message), and
+	// continues to use the existing one (the one that is already in the
+	// OpenConfirm state).
+	p.dumpConnection(conn)
+	return false
+}
+
+// dumpConnection closes a connection that lost a collision, sending a
+// NOTIFICATION message with the Error Code Cease
+func (p *Peer) dumpConnection(conn net.Conn) {
+	log.Println("dropping the new connection from", p)
+	writeMessage(conn, notification, newNotification(
+		newBGPError(cease, connectionCollisionResolution, "")))
+	conn.Close()
+}
+
+// SetCollisionDetectEstablishedState makes a connection collision with a
+// session that is already Established be resolved by comparing BGP
+// Identifiers, rather than always keeping the Established session
+func (p *Peer) SetCollisionDetectEstablishedState(enabled bool) {
+	p.configure(func() { p.settings.collisionDetectEstablishedState = &enabled })
+}
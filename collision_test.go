@@ -0,0 +1,165 @@
+package kbgp
+
+import (
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer ln.Close()
+	remote, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	local, err := ln.Accept()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return local, remote
+}
+
+// expectCollisionNotification reads a Cease NOTIFICATION for a connection
+// collision off the connection
+func expectCollisionNotification(t *testing.T, conn net.Conn) {
+	t.Helper()
+	for {
+		h, body, err := readHeader(conn)
+		if err != nil {
+			t.Fatal("Expected a NOTIFICATION message got", err)
+		}
+		if h.msgType != notification {
+			continue
+		}
+		n, _ := readNotification(body)
+		if n.code != cease || n.subcode != connectionCollisionResolution {
+			t.Errorf("Unexpected NOTIFICATION %s", n)
+		}
+		return
+	}
+}
+
+func TestCollision(t *testing.T) {
+	low := newIdentifier(net.ParseIP("10.0.0.1"))
+	high := newIdentifier(net.ParseIP("10.0.0.2"))
+	cases := map[string]struct {
+		localID           bgpIdentifier
+		established       bool
+		detectEstablished bool
+		keepNew           bool
+	}{
+		"local identifier is higher":                {high, false, false, false},
+		"local identifier is lower":                 {low, false, false, true},
+		"established":                               {low, true, false, false},
+		"established with collision detection":      {low, true, true, true},
+		"established with collision detection kept": {high, true, true, false},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			ln, p := listen(t)
+			p.myID = c.localID
+			p.SetCollisionDetectEstablishedState(c.detectEstablished)
+			remote := NewPeer(65000, net.ParseIP("127.0.0.1"))
+			remote.myAS = 65001
+			remote.myID = low
+			if c.localID == low {
+				remote.myID = high
+			}
+
+			// Our connection to the peer
+			p.Up()
+			existing, err := ln.Accept()
+			if err != nil {
+				t.Fatal("Unexpected error", err)
+			}
+			defer existing.Close()
+			if _, err := readOpenMessage(existing); err != nil {
+				t.Fatal("Unexpected error", err)
+			}
+			waitForState(t, p.fsm, openSent)
+			if c.established {
+				writeMessage(existing, open, newOpen(remote))
+				writeMessage(existing, keepalive, newKeepalive())
+				waitForState(t, p.fsm, established)
+			}
+
+			// The peer's connection to us
+			local, incoming := tcpPair(t)
+			o, err := readOpen(newOpen(remote).bytes())
+			if err != nil {
+				t.Fatal("Unexpected error", err)
+			}
+			p.handleConnection(local, o)
+
+			if !c.keepNew {
+				expectCollisionNotification(t, incoming)
+				if !c.established {
+					waitForState(t, p.fsm, openSent)
+				}
+				return
+			}
+			expectCollisionNotification(t, existing)
+			if _, err := readOpenMessage(incoming); err != nil {
+				t.Fatal("Expected an OPEN message on the new connection got", err)
+			}
+			waitForState(t, p.fsm, openConfirm)
+			var current bool
+			p.do(func() { current = p.current(local) })
+			if !current {
+				t.Error("Expected the new connection to be used")
+			}
+		})
+	}
+}
+
+func TestDynamicPeerCollision(t *testing.T) {
+	s := NewSpeaker(65000, "", WithRouterID(net.ParseIP("192.0.2.1")))
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	if err := s.AddListenRange(loopback, 65001, 65100, nil); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	addr := serveSpeaker(t, s)
+	remote := NewPeer(65000, net.ParseIP("127.0.0.1"))
+	remote.myAS = 65050
+	remote.myID = newIdentifier(net.ParseIP("192.0.2.2"))
+
+	// dial opens a connection to the speaker and sends our OPEN message
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		writeMessage(conn, open, newOpen(remote))
+		if _, err := readOpenMessage(conn); err != nil {
+			t.Fatal("Expected an OPEN message got", err)
+		}
+		return conn
+	}
+	existing := dial()
+	p := waitForPeers(t, s, 1)[0]
+	waitForState(t, p.fsm, openConfirm)
+
+	// Our identifier is lower, so the new connection wins and the dynamic
+	// peer carries on with it
+	incoming := dial()
+	expectCollisionNotification(t, existing)
+	writeMessage(incoming, keepalive, newKeepalive())
+	waitForState(t, p.fsm, established)
+	if peers := s.Peers(); len(peers) != 1 || peers[0] != p {
+		t.Errorf("Expected the dynamic peer to be kept got %d peers", len(peers))
+	}
+	select {
+	case <-p.done:
+		t.Error("Expected the dynamic peer not to be shut down")
+	default:
+	}
+}
@@ -0,0 +1,115 @@
+package kbgp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"slices"
+)
+
+// Rather than configuring every neighbor, a speaker can accept connections
+// from any neighbor in a range of addresses and AS numbers, such as the
+// members of an IXP peering LAN. A Peer is created in a peer group for each
+// neighbor when it connects, and removed again when its session ends.
+
+// listenRange is where dynamic peers are accepted from
+type listenRange struct {
+	prefix       *net.IPNet
+	minAS, maxAS asn
+	group        *PeerGroup
+}
+
+// contains returns true if a neighbor at ip with AS number as is in the
+// range
+func (r listenRange) contains(as asn, ip net.IP) bool {
+	return r.prefix.Contains(ip) && as >= r.minAS && as <= r.maxAS
+}
+
+// AddListenRange accepts connections from any neighbor in prefix with an AS
+// number from minAS to maxAS that is not already a peer. Each is made a
+// passive peer in group, which may be nil.
+func (s *Speaker) AddListenRange(prefix *net.IPNet, minAS, maxAS asn, group *PeerGroup) error {
+	if minAS > maxAS {
+		return fmt.Errorf("AS range %d-%d is empty", minAS, maxAS)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.findRange(prefix) >= 0 {
+		return fmt.Errorf("there is already a listen range for %s", prefix)
+	}
+	log.Println("listening for peers from", prefix, "with AS", minAS, "to", maxAS)
+	s.ranges = append(s.ranges, listenRange{prefix, minAS, maxAS, group})
+	return nil
+}
+
+// RemoveListenRange stops accepting new neighbors from prefix. Peers
+// already created from it are kept until their sessions end.
+func (s *Speaker) RemoveListenRange(prefix *net.IPNet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.findRange(prefix)
+	if i < 0 {
+		return fmt.Errorf("no listen range for %s", prefix)
+	}
+	s.ranges = slices.Delete(s.ranges, i, i+1)
+	return nil
+}
+
+// findRange returns the index of the listen range for prefix, or -1 if
+// there is none
+func (s *Speaker) findRange(prefix *net.IPNet) int {
+	for i, r := range s.ranges {
+		if r.prefix.IP.Equal(prefix.IP) && slices.Equal(r.prefix.Mask, prefix.Mask) {
+			return i
+		}
+	}
+	return -1
+}
+
+// dynamicPeer creates a peer for a connection from addr by a neighbor with
+// AS number as, if it is in a listen range. The peer is started passive,
+// ready for the connection to be handed to it.
+func (s *Speaker) dynamicPeer(as asn, addr net.Addr) *Peer {
+	ip, zone := splitAddr(addr)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		return nil
+	}
+	i := slices.IndexFunc(s.ranges, func(r listenRange) bool {
+		return r.contains(as, ip)
+	})
+	if i < 0 || s.findAddr(ip, zone) >= 0 {
+		// Out of range, or already a peer with a different AS number
+		return nil
+	}
+	p := NewPeer(as, ip)
+	p.SetZone(zone)
+	p.SetPassive(true)
+	p.SetGroup(s.ranges[i].group)
+	p.dynamic = true
+	log.Println("created dynamic peer", p)
+	s.adopt(p)
+	s.peers = append(s.peers, p)
+	p.enqueue(fsmEvent{event: ManualStartWithPassiveTCPEstablishment})
+	return p
+}
+
+// release removes a dynamic peer whose session has ended. It is called from
+// the peer's event loop, so the peer is shut down in the background.
+func (s *Speaker) release(p *Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.Index(s.peers, p)
+	if i < 0 {
+		// Already removed, or the speaker is shutting down
+		return
+	}
+	log.Println("releasing dynamic peer", p)
+	s.peers = slices.Delete(s.peers, i, i+1)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		p.shutdown(peerDeconfigured)
+	}()
+}
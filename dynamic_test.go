@@ -0,0 +1,116 @@
+package kbgp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// waitForPeers waits a while for the speaker to have n peers
+func waitForPeers(t *testing.T, s *Speaker, n int) []*Peer {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		peers := s.Peers()
+		if len(peers) == n {
+			return peers
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d peers got %d", n, len(peers))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDynamicPeers(t *testing.T) {
+	s := NewSpeaker(65000, "", WithRouterID(net.ParseIP("192.0.2.1")))
+	group := NewPeerGroup("ixp")
+	group.SetHoldTime(30 * time.Second)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	if err := s.AddListenRange(loopback, 65001, 65100, group); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := s.AddListenRange(loopback, 65001, 65100, group); err == nil {
+		t.Error("Expected an error adding the same range twice")
+	}
+	addr := serveSpeaker(t, s)
+
+	// A neighbor in the range gets a peer for as long as its session lasts
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer conn.Close()
+	remote := NewPeer(65000, net.ParseIP("127.0.0.1"))
+	remote.myAS = 65050
+	remote.myID = newIdentifier(net.ParseIP("192.0.2.2"))
+	writeMessage(conn, open, newOpen(remote))
+	o, err := readOpenMessage(conn)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if o.holdTime != 30 {
+		t.Errorf("Expected the group's hold time of 30 got %d", o.holdTime)
+	}
+	writeMessage(conn, keepalive, newKeepalive())
+	p := waitForPeers(t, s, 1)[0]
+	waitForState(t, p.fsm, established)
+	if p.remoteAS != 65050 {
+		t.Errorf("Expected AS65050 got %s", p)
+	}
+	conn.Close()
+	waitForPeers(t, s, 0)
+	select {
+	case <-p.done:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the peer to be shut down")
+	}
+
+	// A neighbor outside the AS range is turned away
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer conn.Close()
+	remote.myAS = 65200
+	writeMessage(conn, open, newOpen(remote))
+	h, body, err := readHeader(conn)
+	if err != nil || h.msgType != notification {
+		t.Fatal("Expected a NOTIFICATION message got", h, err)
+	}
+	if n, _ := readNotification(body); n.code != openMessageError || n.subcode != badPeerAS {
+		t.Errorf("Expected Bad Peer AS got %s", n)
+	}
+	if len(s.Peers()) != 0 {
+		t.Error("Expected no peer to be created")
+	}
+
+	if err := s.RemoveListenRange(loopback); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if err := s.RemoveListenRange(loopback); err == nil {
+		t.Error("Expected an error removing a range that is gone")
+	}
+}
+
+func TestListenRangeContains(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("10.0.0.0/16")
+	r := listenRange{prefix: prefix, minAS: 65000, maxAS: 65100}
+	cases := []struct {
+		as       asn
+		ip       string
+		contains bool
+	}{
+		{65000, "10.0.0.1", true},
+		{65100, "10.0.255.255", true},
+		{64999, "10.0.0.1", false},
+		{65101, "10.0.0.1", false},
+		{65050, "10.1.0.1", false},
+		{65050, "2001:db8::1", false},
+	}
+	for _, c := range cases {
+		if got := r.contains(c.as, net.ParseIP(c.ip)); got != c.contains {
+			t.Errorf("AS%d %s: expected %t got %t", c.as, c.ip, c.contains, got)
+		}
+	}
+}
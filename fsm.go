@@ -1,6 +1,7 @@
 package kbgp
 
 import (
+	"context"
 	"log"
 	"time"
 
@@ -50,17 +51,29 @@ type fsm struct {
 	// acceptConnectionsUnconfiguredPeers bool
 	// allowAutomaticStart                bool
 	// allowAutomaticStop                 bool
-	// collisionDetectEstablishedState    bool
-	// dampPeerOscillations               bool
-	delayOpen bool
-	// delayOpenTime                      time.Duration
-	// delayOpenTimer                     timer.Timer
-	// idleHoldTime                       time.Duration
-	// idleHoldTimer                      timer.Timer
-	// passiveTcpEstablishment            bool
-	sendNOTIFICATIONwithoutOPEN bool
+	collisionDetectEstablishedState bool
+	dampPeerOscillations            bool
+	delayOpen                       bool
+	delayOpenTime                   time.Duration
+	delayOpenTimer                  *timer.Timer
+	idleHoldTime                    time.Duration
+	idleHoldTimer                   *timer.Timer
+	passiveTCPEstablishment         bool
+	sendNOTIFICATIONwithoutOPEN     bool
 	// trackTcpState                      bool
 
+	// Whether the peer was started with passive TCP establishment, which
+	// is how it is started again after the IdleHoldTimer
+	passive bool
+	// When the session last became Established
+	establishedAt time.Time
+	// The Cease NOTIFICATION message subcode sent for a ManualStop
+	stopReason int
+
+	// Starts a connection attempt, and cancels the one in progress
+	connectPeer   func(ctx context.Context)
+	cancelConnect context.CancelFunc
+
 	// reference back to our owner
 	peer *Peer
 }
@@ -71,21 +84,109 @@ const defaultHoldTime = 90 * time.Second
 const largeHoldTime = 4 * time.Minute
 const defaultKeepaliveTime = defaultHoldTime / 3
 
+// sessionTimers are the configured times for a BGP session. Those that are
+// nil are inherited, and in the end default to the values suggested by the
+// RFC. Without a KeepaliveTime, KEEPALIVEs are sent at a third of the hold
+// time.
+type sessionTimers struct {
+	holdTime         *time.Duration
+	keepaliveTime    *time.Duration
+	connectRetryTime *time.Duration
+}
+
+// inherit fills in the timers that are not set from parent
+func (t sessionTimers) inherit(parent sessionTimers) sessionTimers {
+	if t.holdTime == nil {
+		t.holdTime = parent.holdTime
+	}
+	if t.keepaliveTime == nil {
+		t.keepaliveTime = parent.keepaliveTime
+	}
+	if t.connectRetryTime == nil {
+		t.connectRetryTime = parent.connectRetryTime
+	}
+	return t
+}
+
+// hold returns the configured hold time
+func (t sessionTimers) hold() time.Duration {
+	if t.holdTime == nil {
+		return defaultHoldTime
+	}
+	return *t.holdTime
+}
+
+// keepalive returns the KeepaliveTime for a session with the given hold
+// time
+func (t sessionTimers) keepalive(holdTime time.Duration) time.Duration {
+	// A reasonable maximum time between KEEPALIVE messages would be one
+	// third of the Hold Time interval.
+	// https://tools.ietf.org/html/rfc4271#section-4.4
+	keepalive := holdTime / 3
+	if k := t.keepaliveTime; k != nil && *k > 0 && *k < keepalive {
+		keepalive = *k
+	}
+	return keepalive
+}
+
+// connectRetry returns the configured ConnectRetryTime
+func (t sessionTimers) connectRetry() time.Duration {
+	if t.connectRetryTime == nil {
+		return defaultConnectRetryTime
+	}
+	return *t.connectRetryTime
+}
+
+// Peer oscillation damping starts by holding a failed peer in Idle for
+// minIdleHoldTime, doubling that for every failure up to maxIdleHoldTime.
+// The IdleHoldTime is halved for every idleHoldDecay the session stays up.
+const minIdleHoldTime = 5 * time.Second
+const maxIdleHoldTime = 10 * time.Minute
+const idleHoldDecay = 2 * time.Minute
+
 func newFSM(p *Peer) *fsm {
 	f := &fsm{
-		peer:          p,
-		holdTime:      defaultHoldTime,
-		keepaliveTime: defaultKeepaliveTime,
+		peer:             p,
+		connectRetryTime: defaultConnectRetryTime,
+		holdTime:         defaultHoldTime,
+		keepaliveTime:    defaultKeepaliveTime,
+		connectPeer:      p.connect,
+		stopReason:       administrativeShutdown,
 	}
+	// Timers are only running when the FSM sets them
+	f.connectRetryTimer = timer.NewStopped(f.eventWrapper(ConnectRetryTimerExpires))
+	f.holdTimer = timer.NewStopped(f.eventWrapper(HoldTimerExpires))
+	f.keepaliveTimer = timer.NewStopped(f.eventWrapper(KeepaliveTimerExpires))
+	f.delayOpenTimer = timer.NewStopped(f.eventWrapper(DelayOpenTimerExpires))
+	f.idleHoldTimer = timer.NewStopped(f.eventWrapper(IdleHoldTimerExpires))
 	return f
 }
 
+// eventWrapper hands the event to the peer's event loop when a timer
+// expires
 func (f *fsm) eventWrapper(e event) func() {
 	return func() {
-		f.event(ConnectRetryTimerExpires)
+		f.peer.enqueue(fsmEvent{event: e})
 	}
 }
 
+// timer returns the timer whose expiry is the event e, if any
+func (f *fsm) timer(e event) *timer.Timer {
+	switch e {
+	case ConnectRetryTimerExpires:
+		return f.connectRetryTimer
+	case HoldTimerExpires:
+		return f.holdTimer
+	case KeepaliveTimerExpires:
+		return f.keepaliveTimer
+	case DelayOpenTimerExpires:
+		return f.delayOpenTimer
+	case IdleHoldTimerExpires:
+		return f.idleHoldTimer
+	}
+	return nil
+}
+
 type event int
 
 // Administrative Events
@@ -123,23 +224,23 @@ const (
 )
 
 var eventLookup = map[event]string{
-	ManualStart:                                                      "ManualStart",
-	ManualStop:                                                       "ManualStop",
-	ManualStartWithPassiveTCPEstablishment:                           "ManualStart_with_PassiveTcpEstablishment",
+	ManualStart:                            "ManualStart",
+	ManualStop:                             "ManualStop",
+	ManualStartWithPassiveTCPEstablishment: "ManualStart_with_PassiveTcpEstablishment",
 	AutomaticStartWithPassiveTCPEstablishment:                        "AutomaticStart_with_PassiveTcpEstablishment",
 	AutomaticStartWithDampPeerOscillations:                           "AutomaticStart_with_DampPeerOscillations",
 	AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment: "AutomaticStart_with_DampPeerOscillations_and_PassiveTcpEstablishment",
-	AutomaticStop:            "AutomaticStop",
-	ConnectRetryTimerExpires: "ConnectRetryTimer_Expires",
-	HoldTimerExpires:         "HoldTimer_Expires",
-	KeepaliveTimerExpires:    "KeepaliveTimer_Expires",
-	DelayOpenTimerExpires:    "DelayOpenTimer_Expires",
-	IdleHoldTimerExpires:     "IdleHoldTimer_Expires",
-	TCPConnectionValid:       "TcpConnection_Valid",
-	TCPCRAcked:               "Tcp_CR_Acked",
-	TCPConnectionConfirmed:   "TcpConnectionConfirmed",
-	TCPConnectionFails:       "TcpConnectionFails",
-	BGPOpen:                  "BGPOpen",
+	AutomaticStop:                    "AutomaticStop",
+	ConnectRetryTimerExpires:         "ConnectRetryTimer_Expires",
+	HoldTimerExpires:                 "HoldTimer_Expires",
+	KeepaliveTimerExpires:            "KeepaliveTimer_Expires",
+	DelayOpenTimerExpires:            "DelayOpenTimer_Expires",
+	IdleHoldTimerExpires:             "IdleHoldTimer_Expires",
+	TCPConnectionValid:               "TcpConnection_Valid",
+	TCPCRAcked:                       "Tcp_CR_Acked",
+	TCPConnectionConfirmed:           "TcpConnectionConfirmed",
+	TCPConnectionFails:               "TcpConnectionFails",
+	BGPOpen:                          "BGPOpen",
 	BGPOpenWithDelayOpenTimerRunning: "BGPOpen with DelayOpenTimer running",
 	BGPHeaderErr:                     "BGPHeaderErr",
 	BGPOpenMsgErr:                    "BGPOpenMsgErr",
@@ -176,69 +277,313 @@ func (f *fsm) event(e event) {
 
 func (f *fsm) transition(s state) {
 	log.Println("Transitioning from", f.state, "to", s)
+	if s == idle {
+		// Nothing connects to the peer from Idle
+		f.stopConnecting()
+		if f.state != idle {
+			f.peer.sessionEnded()
+		}
+	}
+	if f.state == established && s != established {
+		f.idleHoldTime = f.decayedIdleHoldTime()
+	}
+	if s == established {
+		f.establishedAt = time.Now()
+	}
+	established := f.state != established && s == established
 	f.state = s
+	if established {
+		f.peer.sessionEstablished()
+	}
 }
 
 // Handle ManualStart and AutomaticStart in the idle state
 func (f *fsm) start() {
-	f.peer.initializeResources()
-	f.connectRetryTimer = timer.New(defaultConnectRetryTime, f.eventWrapper(ConnectRetryTimerExpires))
+	f.passive = false
+	f.idleHoldTimer.Stop()
+	f.connectRetryTime = f.peer.sessionTimers().connectRetry()
 	f.connectRetryCounter.Reset()
-	// TODO: initiates a TCP connection to the other BGP peer,
+	f.restartConnectRetryTimer()
 	f.transition(connect)
+	f.initiateConnection()
 }
 
-func (f *fsm) stop() {
-	writeMessage(f.peer.conn, notification, newNotification(newBGPError(cease, 0, "manual stop")))
-	f.connectRetryTimer.Stop()
-	f.peer.releaseResources()
-	f.peer.conn.Close()
+// Handle ManualStart_with_PassiveTcpEstablishment and
+// AutomaticStart_with_PassiveTcpEstablishment in the idle state
+func (f *fsm) startPassive() {
+	f.passive = true
+	f.idleHoldTimer.Stop()
+	f.connectRetryTime = f.peer.sessionTimers().connectRetry()
 	f.connectRetryCounter.Reset()
-	f.transition(idle)
+	f.restartConnectRetryTimer()
+	// listens for a connection that may be initiated by the remote peer
+	f.transition(active)
+}
+
+// restartConnectRetryTimer starts the ConnectRetryTimer again with jitter
+// https://tools.ietf.org/html/rfc4271#section-10
+func (f *fsm) restartConnectRetryTimer() {
+	f.connectRetryTimer.Reset(timer.Jitter(f.connectRetryTime))
+}
+
+// initiateConnection starts a TCP connection to the peer, abandoning any
+// attempt that is still in progress. The result comes back as a
+// TCPCRAcked or TCPConnectionFails event.
+func (f *fsm) initiateConnection() {
+	f.stopConnecting()
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancelConnect = cancel
+	f.connectPeer(ctx)
 }
 
+// stopConnecting abandons the connection attempt in progress, if any
+func (f *fsm) stopConnecting() {
+	if f.cancelConnect != nil {
+		f.cancelConnect()
+		f.cancelConnect = nil
+	}
+}
+
+// tcpConnect handles the TCP connection being established in the Connect
+// and Active states
 func (f *fsm) tcpConnect() {
-	// TODO: Implement when adding the delayOpen option
+	// Only one connection attempt is needed
+	f.stopConnecting()
+	f.connectRetryTimer.Stop()
 	if f.delayOpen {
-		f.connectRetryTimer.Stop()
-		//   - sets the DelayOpenTimer to the initial value, and
+		// Wait a while for the peer to send its OPEN message first
+		f.delayOpenTimer.Reset(f.delayOpenTime)
 		return
 	}
-	f.connectRetryTimer.Stop()
-	f.peer.initializeResources()
+	f.sendOpen()
+}
+
+// sendOpen completes BGP initialization, sends an OPEN message and waits
+// in OpenSent for one from the peer
+func (f *fsm) sendOpen() {
 	log.Println("Sending OPEN message")
-	writeMessage(f.peer.conn, open, newOpen(f.peer))
-	// 	TODO: sets the HoldTimer to a large value (4 min recommended)
+	f.peer.send(open, newOpen(f.peer))
+	f.holdTimer.Reset(largeHoldTime)
 	f.transition(openSent)
 }
 
+// openConfirmed moves to OpenConfirm once the peer's OPEN message has been
+// accepted
+func (f *fsm) openConfirmed() {
+	f.connectRetryTimer.Stop()
+	f.delayOpenTimer.Stop()
+	f.peer.send(keepalive, newKeepalive())
+	f.startSessionTimers()
+	f.transition(openConfirm)
+}
+
+// openDelayed handles the peer's OPEN message arriving while we were
+// delaying our own
+func (f *fsm) openDelayed() {
+	f.connectRetryTimer.Stop()
+	f.delayOpenTimer.Stop()
+	f.peer.send(open, newOpen(f.peer))
+	f.peer.send(keepalive, newKeepalive())
+	f.startSessionTimers()
+	f.transition(openConfirm)
+}
+
+// startSessionTimers starts the KeepaliveTimer and sets the HoldTimer to
+// the negotiated hold time. A hold time of zero means neither is used.
+func (f *fsm) startSessionTimers() {
+	if f.holdTime == 0 {
+		f.keepaliveTimer.Stop()
+		f.holdTimer.Stop()
+		return
+	}
+	f.restartKeepaliveTimer()
+	f.holdTimer.Reset(f.holdTime)
+}
+
+// negotiateHoldTime settles on the smaller of our hold time and the one
+// offered by the peer, and sends KEEPALIVEs at a third of it.
+//
+// The calculated value indicates the maximum number of seconds that may
+// elapse between the receipt of successive KEEPALIVE and/or UPDATE
+// messages from the sender.
+// https://tools.ietf.org/html/rfc4271#section-4.2
+func (f *fsm) negotiateHoldTime(offered time.Duration) {
+	timers := f.peer.sessionTimers()
+	f.holdTime = timers.hold()
+	if offered < f.holdTime {
+		f.holdTime = offered
+	}
+	f.keepaliveTime = timers.keepalive(f.holdTime)
+}
+
+// restartKeepaliveTimer schedules the next KEEPALIVE message, with jitter,
+// unless the negotiated hold time is zero
+func (f *fsm) restartKeepaliveTimer() {
+	if f.holdTime == 0 {
+		return
+	}
+	f.keepaliveTimer.Reset(timer.Jitter(f.keepaliveTime))
+}
+
+// restartHoldTimer restarts the HoldTimer unless the negotiated hold time
+// is zero
+func (f *fsm) restartHoldTimer() {
+	if f.holdTime != 0 {
+		f.holdTimer.Reset(f.holdTime)
+	}
+}
+
+// stop sends a ManualStop event, giving subcode as the reason in the Cease
+// NOTIFICATION message sent to the peer
+func (f *fsm) stop(subcode int) {
+	f.stopReason = subcode
+	f.event(ManualStop)
+	f.stopReason = administrativeShutdown
+}
+
+// retime picks up changes to the peer's timers
+func (f *fsm) retime() {
+	timers := f.peer.sessionTimers()
+	f.connectRetryTime = timers.connectRetry()
+	switch f.state {
+	case openConfirm, established:
+		// Takes effect the next time a KEEPALIVE is sent
+		f.keepaliveTime = timers.keepalive(f.holdTime)
+	}
+}
+
 func (f *fsm) ignore(e event) {
-	log.Println("%s state ignoring %s event", f.state, e)
+	log.Printf("%s state ignoring %s event", f.state, e)
 }
 
-func (f *fsm) fsmErrorToIdle() {
-	writeMessage(f.peer.conn, notification, newNotification(newBGPError(fsmError, 0, "invalid mesage")))
+// toIdle is how every state gives up on the session. It stops the
+// timers, releases all BGP resources and drops the TCP connection.
+func (f *fsm) toIdle() {
 	f.connectRetryTimer.Stop()
+	f.delayOpenTimer.Stop()
+	f.holdTimer.Stop()
+	f.keepaliveTimer.Stop()
 	f.peer.releaseResources()
-	f.peer.conn.Close()
-	f.connectRetryCounter.Increment()
-	// - (optionally) performs peer oscillation damping if the
-	// DampPeerOscillations attribute is set to TRUE, and
+	f.peer.close()
 	f.transition(idle)
 }
 
+// stopToIdle handles an operator stopping the session, which starts the
+// ConnectRetryCounter over
+func (f *fsm) stopToIdle() {
+	f.connectRetryCounter.Reset()
+	f.toIdle()
+}
+
+// errorToIdle handles the session failing, which counts against the
+// peer, and starts it again
+func (f *fsm) errorToIdle() {
+	f.connectRetryCounter.Increment()
+	f.toIdle()
+	f.restart()
+}
+
+// notifyToIdle sends a NOTIFICATION message and then handles the session
+// failing
+func (f *fsm) notifyToIdle(code int, subcode int, message string) {
+	f.peer.send(notification, newNotification(newBGPError(code, subcode, message)))
+	f.errorToIdle()
+}
+
+// fsmErrorToIdle handles an event that is not expected in the current
+// state
+func (f *fsm) fsmErrorToIdle() {
+	f.notifyToIdle(fsmError, 0, "unexpected event in "+f.state.String())
+}
+
+// restart starts a peer that has failed again. A peer damping its
+// oscillations waits out the IdleHoldTimer. Otherwise a passive peer goes
+// straight back to listening, and any other connects again after the
+// ConnectRetryTime.
+func (f *fsm) restart() {
+	switch {
+	case f.dampPeerOscillations:
+		f.damp()
+	case f.passive:
+		f.startPassive()
+	default:
+		f.idleHoldTimer.Reset(timer.Jitter(f.connectRetryTime))
+	}
+}
+
+// damp performs peer oscillation damping if the DampPeerOscillations
+// attribute is set to TRUE. The method of preventing persistent peer
+// oscillation is outside the scope of RFC 4271.
+func (f *fsm) damp() {
+	if !f.dampPeerOscillations {
+		return
+	}
+	// Back off exponentially on repeated failures
+	f.idleHoldTime *= 2
+	if f.idleHoldTime < minIdleHoldTime {
+		f.idleHoldTime = minIdleHoldTime
+	}
+	if f.idleHoldTime > maxIdleHoldTime {
+		f.idleHoldTime = maxIdleHoldTime
+	}
+	log.Println("holding", f.peer, "in Idle for", f.idleHoldTime)
+	if f.passive {
+		f.event(AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment)
+		return
+	}
+	f.event(AutomaticStartWithDampPeerOscillations)
+}
+
+// decayedIdleHoldTime is the IdleHoldTime, halved for every idleHoldDecay
+// the session has been Established
+func (f *fsm) decayedIdleHoldTime() time.Duration {
+	d := f.idleHoldTime
+	if f.state != established {
+		return d
+	}
+	for stable := time.Since(f.establishedAt); stable >= idleHoldDecay && d > 0; stable -= idleHoldDecay {
+		d /= 2
+	}
+	if d < minIdleHoldTime {
+		// The peer has been forgiven
+		return 0
+	}
+	return d
+}
+
 // In this state, BGP FSM refuses all incoming BGP connections for
 // this peer.  No resources are allocated to the peer.
 func (f *fsm) idle(e event) {
 	switch e {
 	case ManualStart, AutomaticStart:
 		f.start()
-	//TODO: case ManualStartWithPassiveTCPEstablishment, AutomaticStartWithPassiveTCPEstablishment:
-	//TODO: case AutomaticStartWithDampPeerOscillations,
-	//          AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment,
-	//          IdleHoldTimerExpires:
+	case ManualStartWithPassiveTCPEstablishment, AutomaticStartWithPassiveTCPEstablishment:
+		f.startPassive()
+	case AutomaticStartWithDampPeerOscillations,
+		AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment:
+		// Wait out the IdleHoldTimer before starting
+		f.passive = e == AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment
+		if f.idleHoldTime == 0 {
+			f.idle(IdleHoldTimerExpires)
+			return
+		}
+		if !f.idleHoldTimer.Running() {
+			f.idleHoldTimer.Reset(f.idleHoldTime)
+		}
+	case ManualStop, AutomaticStop:
+		// Nothing is running in Idle but the IdleHoldTimer, which would
+		// start the peer again
+		f.idleHoldTimer.Stop()
+	case IdleHoldTimerExpires:
+		if f.passive {
+			f.startPassive()
+			return
+		}
+		f.start()
 	default:
-		log.Println("Ignoring event")
+		// Any other event received in the Idle state does not cause
+		// change in the state of the local system.
+		f.ignore(e)
 	}
 }
 
@@ -250,58 +595,46 @@ func (f *fsm) connect(e event) {
 		AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment:
 		f.ignore(e)
 	case ManualStop:
-		f.peer.conn.Close()
-		f.peer.releaseResources()
-		f.connectRetryCounter.Reset()
-		f.connectRetryTimer.Stop()
-		f.transition(idle)
+		f.stopToIdle()
 	case ConnectRetryTimerExpires:
-		f.peer.conn.Close()
-		f.connectRetryTimer.Reset(defaultConnectRetryTime)
-		// TODO: stops the DelayOpenTimer and resets the timer to zero,
-		// TODO: initiates a TCP connection to the other BGP peer,
-	//TODO: case DelayOpenTimerExpires:
-	//TODO: case TCPConnectionValid:
-	//TODO: case TCPCRInvalid:
+		f.peer.close()
+		f.restartConnectRetryTimer()
+		f.delayOpenTimer.Stop()
+		f.initiateConnection()
+	case DelayOpenTimerExpires:
+		f.sendOpen()
+	case TCPConnectionValid, TCPCRInvalid:
+		// The Peer accepts or rejects the connection
 	case TCPCRAcked, TCPConnectionConfirmed:
 		f.tcpConnect()
 	case TCPConnectionFails:
-		//TODO: Handle the case where the delay open timer is running
-		// otherwise:
-		f.connectRetryTimer.Stop()
-		f.peer.conn.Close()
-		f.peer.releaseResources()
-		f.transition(idle)
-	//TODO: case BGPOpenWithDelayOpenTimerRunning:
-	case BGPHeaderErr, BGPOpenMsgErr:
-		if f.sendNOTIFICATIONwithoutOPEN {
-			// TODO: How do we get the actual error here? Doesn't get passed in with the event
-			writeMessage(f.peer.conn, notification, newNotification(newBGPError(messageHeaderError, 0, "")))
+		if f.delayOpenTimer.Running() {
+			f.restartConnectRetryTimer()
+			f.delayOpenTimer.Stop()
+			f.peer.close()
+			f.transition(active)
+			return
 		}
 		f.connectRetryTimer.Stop()
+		f.peer.close()
 		f.peer.releaseResources()
-		f.peer.conn.Close()
-		f.connectRetryCounter.Increment()
-		// TODO: (optionally) performs peer oscillation damping if the
-		// DampPeerOscillations attribute is set to TRUE, and
 		f.transition(idle)
+		f.restart()
+	case BGPOpenWithDelayOpenTimerRunning:
+		f.openDelayed()
+	case BGPHeaderErr, BGPOpenMsgErr:
+		// The NOTIFICATION message, if any, has already been sent by
+		// whatever found the error
+		f.errorToIdle()
 	case NotifMsgVerErr:
-		f.connectRetryTimer.Stop()
-		// TODO: stops and resets the DelayOpenTimer (sets to zero),
-		f.peer.releaseResources()
-		f.peer.conn.Close()
-		f.transition(idle)
+		if f.delayOpenTimer.Running() {
+			f.toIdle()
+			f.restart()
+			return
+		}
+		f.errorToIdle()
 	default:
-		log.Println("Default handling of event")
-		f.connectRetryTimer.Stop()
-		// TODO: if the DelayOpenTimer is running, stops and resets the
-		// DelayOpenTimer (sets to zero),
-		f.peer.releaseResources()
-		f.peer.conn.Close()
-		f.connectRetryCounter.Increment()
-		// TODO: performs peer oscillation damping if the DampPeerOscillations
-		// attribute is set to True, and
-		f.transition(idle)
+		f.errorToIdle()
 	}
 }
 
@@ -314,54 +647,45 @@ func (f *fsm) active(e event) {
 		AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment:
 		f.ignore(e)
 	case ManualStop:
-		//TODO: handle the case where delay open timer is running
-		f.peer.releaseResources()
-		f.peer.conn.Close()
-		f.connectRetryCounter.Reset()
-		f.connectRetryTimer.Stop()
-		f.transition(idle)
+		if f.delayOpenTimer.Running() && f.sendNOTIFICATIONwithoutOPEN {
+			f.peer.send(notification, newNotification(
+				newBGPError(cease, f.stopReason, "")))
+		}
+		f.stopToIdle()
 	case ConnectRetryTimerExpires:
-		f.connectRetryTimer.Reset(f.connectRetryTime)
-		//TODO: initiates a TCP connection to the other BGP peer
+		f.restartConnectRetryTimer()
+		if f.passiveTCPEstablishment {
+			// A passive peer never connects out, it only waits for the
+			// peer to connect to us
+			return
+		}
 		f.transition(connect)
-	//TODO: case DelayOpenTimerExpires:
-	//TODO: case TCPConnectionValid:
-	//TODO: case TCPCRInvalid:
-	case TCPCRAcked, TCPConnectionConfirmed:
-		//TODO: Handle case of DelayOpen
-		// Else
+		f.initiateConnection()
+	case DelayOpenTimerExpires:
 		f.connectRetryTimer.Stop()
-		//TODO: Complete BGP initialization(?)
-		writeMessage(f.peer.conn, open, newOpen(f.peer))
-		f.holdTimer.Reset(largeHoldTime)
-		f.transition(openSent)
+		f.delayOpenTimer.Stop()
+		f.sendOpen()
+	case TCPConnectionValid, TCPCRInvalid:
+		// The Peer accepts or rejects the connection
+	case TCPCRAcked, TCPConnectionConfirmed:
+		f.tcpConnect()
 	case TCPConnectionFails:
-		f.connectRetryCounter.Reset()
-		//TODO: stops and clears the DelayOpenTimer (sets the value to zero)
-		f.peer.releaseResources()
-		f.connectRetryCounter.Increment()
-		//TODO: optionally performs peer oscillation damping if the
-		// DampPeerOscillations attribute is set to TRUE
-		f.transition(idle)
-	//TODO: case BGPOpenWithDelayOpenTimerRunning:
+		f.errorToIdle()
+	case BGPOpenWithDelayOpenTimerRunning:
+		f.openDelayed()
 	case BGPHeaderErr, BGPOpenMsgErr:
-		if f.sendNOTIFICATIONwithoutOPEN {
-			//TODO: Send an approrpriate notification
-		}
-		f.connectRetryTimer.Stop()
-		f.peer.releaseResources()
-		f.peer.conn.Close()
-		f.connectRetryCounter.Increment()
-		//TODO: performs peer oscillation damping if the
-		// DampPeerOscillations attribute is set to TRUE
-		f.transition(idle)
+		// The NOTIFICATION message, if any, has already been sent by
+		// whatever found the error
+		f.errorToIdle()
 	case NotifMsgVerErr:
-	case NotifMsg:
-	case KeepAliveMsg:
-	case UpdateMsg:
-	case UpdateMsgErr:
+		if f.delayOpenTimer.Running() {
+			f.toIdle()
+			f.restart()
+			return
+		}
+		f.errorToIdle()
 	default:
-		log.Println("Default handling of event")
+		f.errorToIdle()
 	}
 }
 
@@ -373,31 +697,31 @@ func (f *fsm) openSent(e event) {
 		AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment, TCPCRInvalid:
 		f.ignore(e)
 	case ManualStop:
-		f.stop()
+		f.peer.send(notification, newNotification(newBGPError(cease, f.stopReason, "")))
+		f.stopToIdle()
 	case AutomaticStop:
+		f.notifyToIdle(cease, 0, "")
 	case HoldTimerExpires:
-		writeMessage(f.peer.conn, notification, newNotification(newBGPError(holdTimerExpiredError, 0, "hold timer expired")))
-		f.connectRetryTimer.Stop()
-		f.peer.releaseResources()
-		f.peer.conn.Close()
-		f.connectRetryCounter.Increment()
-		// TODO: (optionally) performs peer oscillation damping if the
-		//   DampPeerOscillations attribute is set to TRUE, and
-		f.transition(idle)
+		f.notifyToIdle(holdTimerExpiredError, 0, "")
 	case TCPConnectionValid, TCPCRAcked, TCPConnectionConfirmed:
-		// TODO: Collision handling!
+		// The second connection is tracked by the Peer until its OPEN
+		// message arrives and the collision can be resolved
 	case TCPConnectionFails:
+		f.holdTimer.Stop()
+		f.peer.close()
+		f.restartConnectRetryTimer()
+		f.transition(active)
 	case BGPOpen:
-		f.connectRetryTimer.Stop()
-		writeMessage(f.peer.conn, keepalive, newKeepalive())
-		if f.holdTime != 0 {
-			f.keepaliveTimer = timer.New(f.holdTime/3, f.eventWrapper(KeepaliveTimerExpires))
-			f.holdTimer = timer.New(f.holdTime, f.eventWrapper(HoldTimerExpires))
-		}
-		f.transition(openConfirm)
+		f.openConfirmed()
 	case BGPHeaderErr, BGPOpenMsgErr:
-	//TODO: case OpenCollisionDump:
+		// The NOTIFICATION message has already been sent by whatever
+		// found the error
+		f.errorToIdle()
+	case OpenCollisionDump:
+		f.notifyToIdle(cease, connectionCollisionResolution, "")
 	case NotifMsgVerErr:
+		f.toIdle()
+		f.restart()
 	default:
 		f.fsmErrorToIdle()
 	}
@@ -408,25 +732,37 @@ func (f *fsm) openConfirm(e event) {
 	switch e {
 	case ManualStart, AutomaticStart, ManualStartWithPassiveTCPEstablishment,
 		AutomaticStartWithPassiveTCPEstablishment, AutomaticStartWithDampPeerOscillations,
-		AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment:
+		AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment, TCPCRInvalid:
 		f.ignore(e)
 	case ManualStop:
-		f.stop()
+		f.peer.send(notification, newNotification(newBGPError(cease, f.stopReason, "")))
+		f.stopToIdle()
 	case AutomaticStop:
+		f.notifyToIdle(cease, 0, "")
 	case HoldTimerExpires:
+		f.notifyToIdle(holdTimerExpiredError, 0, "")
 	case KeepaliveTimerExpires:
-	//TODO: case TCPCRInvalid:
+		f.peer.send(keepalive, newKeepalive())
+		f.restartKeepaliveTimer()
 	case TCPConnectionValid, TCPCRAcked, TCPConnectionConfirmed:
+		// The second connection is tracked by the Peer until its OPEN
+		// message arrives and the collision can be resolved
+	case TCPConnectionFails, NotifMsg:
+		f.errorToIdle()
+	case BGPOpen:
+		// Collisions are resolved by the Peer, which raises
+		// OpenCollisionDump if this connection loses
 	case BGPHeaderErr, BGPOpenMsgErr:
-	//TODO: case OpenCollisionDump:
+		// The NOTIFICATION message has already been sent by whatever
+		// found the error
+		f.errorToIdle()
+	case OpenCollisionDump:
+		f.notifyToIdle(cease, connectionCollisionResolution, "")
 	case NotifMsgVerErr:
-	case TCPConnectionFails, NotifMsg:
-		f.connectRetryTimer.Stop()
-		f.peer.releaseResources()
-		f.peer.conn.Close()
-		f.transition(idle)
+		f.toIdle()
+		f.restart()
 	case KeepAliveMsg:
-		f.holdTimer.Reset(f.holdTime)
+		f.restartHoldTimer()
 		f.transition(established)
 	default:
 		f.fsmErrorToIdle()
@@ -442,22 +778,50 @@ func (f *fsm) established(e event) {
 		AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment, TCPCRInvalid:
 		f.ignore(e)
 	case ManualStop:
-	//TODO: case AutomaticStop:
+		f.peer.send(notification, newNotification(newBGPError(cease, f.stopReason, "")))
+		f.peer.deleteRoutes()
+		f.stopToIdle()
+	case AutomaticStop:
+		f.peer.send(notification, newNotification(newBGPError(cease, 0, "")))
+		f.peer.deleteRoutes()
+		f.errorToIdle()
 	case HoldTimerExpires:
+		f.peer.send(notification, newNotification(newBGPError(holdTimerExpiredError, 0, "")))
+		f.peer.deleteRoutes()
+		f.errorToIdle()
 	case KeepaliveTimerExpires:
-	//TODO: case TCPConnectionValid:
-	case TCPCRAcked, TCPConnectionConfirmed:
+		f.peer.send(keepalive, newKeepalive())
+		f.restartKeepaliveTimer()
+	case TCPConnectionValid, TCPCRAcked, TCPConnectionConfirmed:
+		// The second connection is tracked by the Peer until its OPEN
+		// message arrives and the collision can be resolved
 	case BGPOpen:
-	//TODO: case OpenCollisionDump:
-	case NotifMsgVerErr:
-	case NotifMsg, TCPConnectionFails:
-	case KeepAliveMsg:
-	case UpdateMsg:
-	case UpdateMsgErr:
+		// Collisions are resolved by the Peer, which raises
+		// OpenCollisionDump if this connection loses
+	case OpenCollisionDump:
+		if !f.collisionDetectEstablishedState {
+			f.ignore(e)
+			return
+		}
+		f.peer.send(notification, newNotification(
+			newBGPError(cease, connectionCollisionResolution, "")))
+		f.peer.deleteRoutes()
+		f.errorToIdle()
+	case NotifMsgVerErr, NotifMsg, TCPConnectionFails:
+		f.peer.deleteRoutes()
+		f.errorToIdle()
+	case KeepAliveMsg, UpdateMsg:
+		f.restartHoldTimer()
+	case UpdateMsgErr, BGPHeaderErr, BGPOpenMsgErr:
+		// The NOTIFICATION message has already been sent by whatever
+		// found the error, so unlike the RFC we do not follow it with a
+		// Finite State Machine Error for a bad header or OPEN message
+		f.peer.deleteRoutes()
+		f.errorToIdle()
 	default:
-		// TODO: deletes all routes associated with this connection,
-		// can this just be done as part of releasing resources? RFC says
-		// to do this after writing notification and before the rest.
-		f.fsmErrorToIdle()
+		f.peer.send(notification, newNotification(
+			newBGPError(fsmError, 0, "unexpected event in "+f.state.String())))
+		f.peer.deleteRoutes()
+		f.errorToIdle()
 	}
 }
@@ -0,0 +1,444 @@
+package kbgp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingConn is a connection that keeps everything written to it
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+	closed  bool
+}
+
+func (r *recordingConn) Write(b []byte) (int, error) { return r.written.Write(b) }
+func (r *recordingConn) Close() error                { r.closed = true; return nil }
+
+// sent lists the messages written to the connection, with the error code
+// and subcode of any NOTIFICATION message
+func (r *recordingConn) sent() string {
+	msgs := []string{}
+	for r.written.Len() > 0 {
+		h, body, err := readHeader(&r.written)
+		if err != nil {
+			return "bad message " + err.Error()
+		}
+		if h.msgType == notification {
+			n, _ := readNotification(body)
+			msgs = append(msgs, fmt.Sprintf("NOTIFICATION(%d/%d)", n.code, n.subcode))
+			continue
+		}
+		msgs = append(msgs, h.msgType.String())
+	}
+	return strings.Join(msgs, " ")
+}
+
+// runningTimers lists the FSM's timers that are running
+func runningTimers(f *fsm) string {
+	running := []string{}
+	if f.connectRetryTimer.Running() {
+		running = append(running, "connectRetry")
+	}
+	if f.delayOpenTimer.Running() {
+		running = append(running, "delayOpen")
+	}
+	if f.holdTimer.Running() {
+		running = append(running, "hold")
+	}
+	if f.idleHoldTimer.Running() {
+		running = append(running, "idleHold")
+	}
+	if f.keepaliveTimer.Running() {
+		running = append(running, "keepalive")
+	}
+	return strings.Join(running, ",")
+}
+
+// Options that put the FSM in a particular situation before the event
+func delayOpenRunning(f *fsm) {
+	f.connectRetryTimer.Stop()
+	f.delayOpenTimer.Reset(time.Hour)
+}
+
+func withDelayOpen(f *fsm) {
+	f.delayOpen = true
+	f.delayOpenTime = time.Hour
+}
+
+func withIdleHoldTime(f *fsm) {
+	f.idleHoldTime = time.Hour
+}
+
+func startedPassive(f *fsm) {
+	f.passive = true
+}
+
+func passiveTCPEstablishment(f *fsm) {
+	f.passiveTCPEstablishment = true
+}
+
+func withDamping(f *fsm) {
+	f.dampPeerOscillations = true
+}
+
+func zeroHoldTime(f *fsm) {
+	f.holdTime = 0
+	if f.state == established {
+		f.holdTimer.Stop()
+		f.keepaliveTimer.Stop()
+	}
+}
+
+func collisionDetectEstablished(f *fsm) {
+	f.collisionDetectEstablishedState = true
+}
+
+func sendNotificationWithoutOpen(f *fsm) {
+	f.sendNOTIFICATIONwithoutOPEN = true
+	delayOpenRunning(f)
+}
+
+// expire stops the timer behind a timer event, as it would have stopped
+// by firing
+func expire(f *fsm, e event) {
+	switch e {
+	case ConnectRetryTimerExpires:
+		f.connectRetryTimer.Stop()
+	case HoldTimerExpires:
+		f.holdTimer.Stop()
+	case KeepaliveTimerExpires:
+		f.keepaliveTimer.Stop()
+	case DelayOpenTimerExpires:
+		f.delayOpenTimer.Stop()
+	case IdleHoldTimerExpires:
+		f.idleHoldTimer.Stop()
+	}
+}
+
+// newFSMIn returns an FSM in the state s with the timers running that
+// would be in that state, and a ConnectRetryCounter of 1
+func newFSMIn(t *testing.T, s state) (*fsm, *recordingConn, *int) {
+	p := NewPeer(65001, net.ParseIP("192.0.2.1"))
+	p.myAS = 65000
+	f := p.fsm
+	t.Cleanup(func() {
+		for _, timer := range []interface{ Stop() }{f.connectRetryTimer, f.delayOpenTimer,
+			f.holdTimer, f.idleHoldTimer, f.keepaliveTimer} {
+			timer.Stop()
+		}
+	})
+	dialed := 0
+	f.connectPeer = func(ctx context.Context) { dialed++ }
+	f.connectRetryCounter.Increment()
+	f.holdTime = time.Hour
+	f.keepaliveTime = time.Hour
+	f.state = s
+	conn := &recordingConn{}
+	switch s {
+	case connect, active:
+		p.conn = conn
+		f.connectRetryTimer.Reset(time.Hour)
+	case openSent:
+		p.conn = conn
+		f.holdTimer.Reset(time.Hour)
+	case openConfirm, established:
+		p.conn = conn
+		f.holdTimer.Reset(time.Hour)
+		f.keepaliveTimer.Reset(time.Hour)
+	}
+	return f, conn, &dialed
+}
+
+func TestFSMTransitions(t *testing.T) {
+	cases := []struct {
+		from    state
+		e       event
+		options []func(*fsm)
+		to      state
+		timers  string
+		sent    string
+		counter uint64
+		dialed  bool
+	}{
+		// Idle
+		{idle, ManualStart, nil, connect, "connectRetry", "", 0, true},
+		{idle, AutomaticStart, nil, connect, "connectRetry", "", 0, true},
+		{idle, ManualStartWithPassiveTCPEstablishment, nil, active, "connectRetry", "", 0, false},
+		{idle, AutomaticStartWithPassiveTCPEstablishment, nil, active, "connectRetry", "", 0, false},
+		{idle, AutomaticStartWithDampPeerOscillations, []func(*fsm){withIdleHoldTime}, idle, "idleHold", "", 1, false},
+		{idle, AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment, []func(*fsm){withIdleHoldTime}, idle, "idleHold", "", 1, false},
+		{idle, AutomaticStartWithDampPeerOscillations, nil, connect, "connectRetry", "", 0, true},
+		{idle, IdleHoldTimerExpires, nil, connect, "connectRetry", "", 0, true},
+		{idle, IdleHoldTimerExpires, []func(*fsm){startedPassive}, active, "connectRetry", "", 0, false},
+		{idle, ManualStop, nil, idle, "", "", 1, false},
+		{idle, ManualStop, []func(*fsm){withIdleHoldTime, withDamping, func(f *fsm) { f.idleHoldTimer.Reset(time.Hour) }}, idle, "", "", 1, false},
+		{idle, AutomaticStop, nil, idle, "", "", 1, false},
+		{idle, TCPConnectionConfirmed, nil, idle, "", "", 1, false},
+		{idle, BGPOpen, nil, idle, "", "", 1, false},
+
+		// Connect
+		{connect, ManualStart, nil, connect, "connectRetry", "", 1, false},
+		{connect, ManualStop, nil, idle, "", "", 0, false},
+		{connect, ConnectRetryTimerExpires, nil, connect, "connectRetry", "", 1, true},
+		{connect, DelayOpenTimerExpires, []func(*fsm){delayOpenRunning}, openSent, "hold", "OPEN", 1, false},
+		{connect, TCPConnectionValid, nil, connect, "connectRetry", "", 1, false},
+		{connect, TCPCRInvalid, nil, connect, "connectRetry", "", 1, false},
+		{connect, TCPCRAcked, nil, openSent, "hold", "OPEN", 1, false},
+		{connect, TCPConnectionConfirmed, nil, openSent, "hold", "OPEN", 1, false},
+		{connect, TCPConnectionConfirmed, []func(*fsm){withDelayOpen}, connect, "delayOpen", "", 1, false},
+		{connect, TCPConnectionFails, nil, idle, "idleHold", "", 1, false},
+		{connect, TCPConnectionFails, []func(*fsm){withDamping}, idle, "idleHold", "", 1, false},
+		{connect, TCPConnectionFails, []func(*fsm){delayOpenRunning}, active, "connectRetry", "", 1, false},
+		{connect, BGPOpenWithDelayOpenTimerRunning, []func(*fsm){delayOpenRunning}, openConfirm, "hold,keepalive", "OPEN KEEPALIVE", 1, false},
+		{connect, BGPHeaderErr, nil, idle, "idleHold", "", 2, false},
+		{connect, BGPOpenMsgErr, nil, idle, "idleHold", "", 2, false},
+		{connect, NotifMsgVerErr, nil, idle, "idleHold", "", 2, false},
+		{connect, NotifMsgVerErr, []func(*fsm){delayOpenRunning}, idle, "idleHold", "", 1, false},
+		{connect, AutomaticStop, nil, idle, "idleHold", "", 2, false},
+		{connect, HoldTimerExpires, nil, idle, "idleHold", "", 2, false},
+		{connect, BGPOpen, nil, idle, "idleHold", "", 2, false},
+		{connect, KeepAliveMsg, nil, idle, "idleHold", "", 2, false},
+
+		// Active
+		{active, ManualStartWithPassiveTCPEstablishment, nil, active, "connectRetry", "", 1, false},
+		{active, ManualStop, nil, idle, "", "", 0, false},
+		{active, ManualStop, []func(*fsm){sendNotificationWithoutOpen}, idle, "", "NOTIFICATION(6/2)", 0, false},
+		{active, ConnectRetryTimerExpires, nil, connect, "connectRetry", "", 1, true},
+		{active, ConnectRetryTimerExpires, []func(*fsm){passiveTCPEstablishment}, active, "connectRetry", "", 1, false},
+		{active, DelayOpenTimerExpires, []func(*fsm){delayOpenRunning}, openSent, "hold", "OPEN", 1, false},
+		{active, TCPConnectionValid, nil, active, "connectRetry", "", 1, false},
+		{active, TCPCRInvalid, nil, active, "connectRetry", "", 1, false},
+		{active, TCPConnectionConfirmed, nil, openSent, "hold", "OPEN", 1, false},
+		{active, TCPConnectionConfirmed, []func(*fsm){withDelayOpen}, active, "delayOpen", "", 1, false},
+		{active, TCPConnectionFails, nil, idle, "idleHold", "", 2, false},
+		{active, TCPConnectionFails, []func(*fsm){withDamping}, idle, "idleHold", "", 2, false},
+		{active, BGPOpenWithDelayOpenTimerRunning, []func(*fsm){delayOpenRunning}, openConfirm, "hold,keepalive", "OPEN KEEPALIVE", 1, false},
+		{active, BGPHeaderErr, nil, idle, "idleHold", "", 2, false},
+		{active, NotifMsgVerErr, nil, idle, "idleHold", "", 2, false},
+		{active, NotifMsgVerErr, []func(*fsm){delayOpenRunning}, idle, "idleHold", "", 1, false},
+		{active, NotifMsg, nil, idle, "idleHold", "", 2, false},
+		{active, UpdateMsg, nil, idle, "idleHold", "", 2, false},
+
+		// OpenSent
+		{openSent, AutomaticStart, nil, openSent, "hold", "", 1, false},
+		{openSent, ManualStop, nil, idle, "", "NOTIFICATION(6/2)", 0, false},
+		{openSent, AutomaticStop, nil, idle, "idleHold", "NOTIFICATION(6/0)", 2, false},
+		{openSent, HoldTimerExpires, nil, idle, "idleHold", "NOTIFICATION(4/0)", 2, false},
+		{openSent, TCPConnectionValid, nil, openSent, "hold", "", 1, false},
+		{openSent, TCPCRInvalid, nil, openSent, "hold", "", 1, false},
+		{openSent, TCPConnectionConfirmed, nil, openSent, "hold", "", 1, false},
+		{openSent, TCPConnectionFails, nil, active, "connectRetry", "", 1, false},
+		{openSent, BGPOpen, nil, openConfirm, "hold,keepalive", "KEEPALIVE", 1, false},
+		{openSent, BGPOpen, []func(*fsm){zeroHoldTime}, openConfirm, "", "KEEPALIVE", 1, false},
+		{openSent, BGPHeaderErr, nil, idle, "idleHold", "", 2, false},
+		{openSent, BGPOpenMsgErr, nil, idle, "idleHold", "", 2, false},
+		{openSent, OpenCollisionDump, nil, idle, "idleHold", "NOTIFICATION(6/7)", 2, false},
+		{openSent, NotifMsgVerErr, nil, idle, "idleHold", "", 1, false},
+		{openSent, ConnectRetryTimerExpires, nil, idle, "idleHold", "NOTIFICATION(5/0)", 2, false},
+		{openSent, KeepaliveTimerExpires, nil, idle, "idleHold", "NOTIFICATION(5/0)", 2, false},
+		{openSent, NotifMsg, nil, idle, "idleHold", "NOTIFICATION(5/0)", 2, false},
+		{openSent, KeepAliveMsg, nil, idle, "idleHold", "NOTIFICATION(5/0)", 2, false},
+		{openSent, UpdateMsg, nil, idle, "idleHold", "NOTIFICATION(5/0)", 2, false},
+
+		// OpenConfirm
+		{openConfirm, ManualStart, nil, openConfirm, "hold,keepalive", "", 1, false},
+		{openConfirm, ManualStop, nil, idle, "", "NOTIFICATION(6/2)", 0, false},
+		{openConfirm, AutomaticStop, nil, idle, "idleHold", "NOTIFICATION(6/0)", 2, false},
+		{openConfirm, HoldTimerExpires, nil, idle, "idleHold", "NOTIFICATION(4/0)", 2, false},
+		{openConfirm, KeepaliveTimerExpires, nil, openConfirm, "hold,keepalive", "KEEPALIVE", 1, false},
+		{openConfirm, TCPConnectionValid, nil, openConfirm, "hold,keepalive", "", 1, false},
+		{openConfirm, TCPCRInvalid, nil, openConfirm, "hold,keepalive", "", 1, false},
+		{openConfirm, TCPCRAcked, nil, openConfirm, "hold,keepalive", "", 1, false},
+		{openConfirm, TCPConnectionFails, nil, idle, "idleHold", "", 2, false},
+		{openConfirm, NotifMsg, nil, idle, "idleHold", "", 2, false},
+		{openConfirm, NotifMsgVerErr, nil, idle, "idleHold", "", 1, false},
+		{openConfirm, BGPOpen, nil, openConfirm, "hold,keepalive", "", 1, false},
+		{openConfirm, BGPHeaderErr, nil, idle, "idleHold", "", 2, false},
+		{openConfirm, BGPOpenMsgErr, nil, idle, "idleHold", "", 2, false},
+		{openConfirm, OpenCollisionDump, nil, idle, "idleHold", "NOTIFICATION(6/7)", 2, false},
+		{openConfirm, KeepAliveMsg, nil, established, "hold,keepalive", "", 1, false},
+		{openConfirm, ConnectRetryTimerExpires, nil, idle, "idleHold", "NOTIFICATION(5/0)", 2, false},
+		{openConfirm, DelayOpenTimerExpires, nil, idle, "idleHold", "NOTIFICATION(5/0)", 2, false},
+		{openConfirm, UpdateMsg, nil, idle, "idleHold", "NOTIFICATION(5/0)", 2, false},
+		{openConfirm, UpdateMsgErr, nil, idle, "idleHold", "NOTIFICATION(5/0)", 2, false},
+
+		// Established
+		{established, ManualStart, nil, established, "hold,keepalive", "", 1, false},
+		{established, ManualStop, nil, idle, "", "NOTIFICATION(6/2)", 0, false},
+		{established, AutomaticStop, nil, idle, "idleHold", "NOTIFICATION(6/0)", 2, false},
+		{established, HoldTimerExpires, nil, idle, "idleHold", "NOTIFICATION(4/0)", 2, false},
+		{established, HoldTimerExpires, []func(*fsm){withDamping}, idle, "idleHold", "NOTIFICATION(4/0)", 2, false},
+		{established, KeepaliveTimerExpires, nil, established, "hold,keepalive", "KEEPALIVE", 1, false},
+		{established, KeepaliveTimerExpires, []func(*fsm){zeroHoldTime}, established, "", "KEEPALIVE", 1, false},
+		{established, TCPConnectionValid, nil, established, "hold,keepalive", "", 1, false},
+		{established, TCPCRInvalid, nil, established, "hold,keepalive", "", 1, false},
+		{established, TCPConnectionConfirmed, nil, established, "hold,keepalive", "", 1, false},
+		{established, BGPOpen, nil, established, "hold,keepalive", "", 1, false},
+		{established, OpenCollisionDump, nil, established, "hold,keepalive", "", 1, false},
+		{established, OpenCollisionDump, []func(*fsm){collisionDetectEstablished}, idle, "idleHold", "NOTIFICATION(6/7)", 2, false},
+		{established, NotifMsgVerErr, nil, idle, "idleHold", "", 2, false},
+		{established, NotifMsg, nil, idle, "idleHold", "", 2, false},
+		{established, NotifMsg, []func(*fsm){startedPassive}, active, "connectRetry", "", 0, false},
+		{established, TCPConnectionFails, nil, idle, "idleHold", "", 2, false},
+		{established, KeepAliveMsg, nil, established, "hold,keepalive", "", 1, false},
+		{established, UpdateMsg, nil, established, "hold,keepalive", "", 1, false},
+		{established, UpdateMsgErr, nil, idle, "idleHold", "", 2, false},
+		{established, BGPHeaderErr, nil, idle, "idleHold", "", 2, false},
+		{established, ConnectRetryTimerExpires, nil, idle, "idleHold", "NOTIFICATION(5/0)", 2, false},
+		{established, DelayOpenTimerExpires, nil, idle, "idleHold", "NOTIFICATION(5/0)", 2, false},
+		{established, IdleHoldTimerExpires, nil, idle, "idleHold", "NOTIFICATION(5/0)", 2, false},
+		{established, BGPOpenWithDelayOpenTimerRunning, nil, idle, "idleHold", "NOTIFICATION(5/0)", 2, false},
+	}
+	for _, c := range cases {
+		name := fmt.Sprintf("%s %s", c.from, c.e)
+		f, conn, dialed := newFSMIn(t, c.from)
+		for _, option := range c.options {
+			option(f)
+		}
+		expire(f, c.e)
+		f.event(c.e)
+		if f.state != c.to {
+			t.Errorf("%s: expected state %s got %s", name, c.to, f.state)
+		}
+		if timers := runningTimers(f); timers != c.timers {
+			t.Errorf("%s: expected timers [%s] got [%s]", name, c.timers, timers)
+		}
+		if sent := conn.sent(); sent != c.sent {
+			t.Errorf("%s: expected messages [%s] got [%s]", name, c.sent, sent)
+		}
+		if f.connectRetryCounter.Value() != c.counter {
+			t.Errorf("%s: expected ConnectRetryCounter %d got %d", name, c.counter, f.connectRetryCounter.Value())
+		}
+		if (*dialed > 0) != c.dialed {
+			t.Errorf("%s: expected connection attempt %t got %d", name, c.dialed, *dialed)
+		}
+		if c.to == idle && c.from != idle && (!conn.closed || f.peer.conn != nil) {
+			t.Errorf("%s: expected the connection to be dropped", name)
+		}
+	}
+}
+
+func TestNegotiateHoldTime(t *testing.T) {
+	cases := []struct {
+		offered   time.Duration
+		holdTime  time.Duration
+		keepalive time.Duration
+	}{
+		{0, 0, 0},
+		{3 * time.Second, 3 * time.Second, time.Second},
+		{30 * time.Second, 30 * time.Second, 10 * time.Second},
+		{defaultHoldTime, defaultHoldTime, defaultKeepaliveTime},
+		{time.Hour, defaultHoldTime, defaultKeepaliveTime},
+	}
+	f := newFSM(NewPeer(65001, net.ParseIP("192.0.2.1")))
+	for _, c := range cases {
+		f.negotiateHoldTime(c.offered)
+		if f.holdTime != c.holdTime || f.keepaliveTime != c.keepalive {
+			t.Errorf("Offered %s expected hold time %s and keepalive time %s got %s and %s",
+				c.offered, c.holdTime, c.keepalive, f.holdTime, f.keepaliveTime)
+		}
+	}
+}
+
+// establishedPeer returns a peer with an Established session over a
+// loopback connection, and the peer's end of that connection
+func establishedPeer(t *testing.T, holdTime, keepaliveTime time.Duration) (*Peer, net.Conn) {
+	local, remote := tcpPair(t)
+	p := NewPeer(65001, net.ParseIP("127.0.0.1"))
+	startPeer(t, p)
+	p.do(func() {
+		p.conn = local
+		p.fsm.state = established
+		p.fsm.holdTime = holdTime
+		p.fsm.keepaliveTime = keepaliveTime
+		p.fsm.startSessionTimers()
+	})
+	go p.read(local)
+	return p, remote
+}
+
+func TestKeepalivesAndHoldTimer(t *testing.T) {
+	p, remote := establishedPeer(t, 300*time.Millisecond, 20*time.Millisecond)
+
+	// KEEPALIVEs keep coming until the peer has been quiet for the hold
+	// time, then the session is torn down
+	keepalives := 0
+	for {
+		h, body, err := readHeader(remote)
+		if err != nil {
+			t.Fatal("Expected a message got", err)
+		}
+		if h.msgType == keepalive {
+			keepalives++
+			continue
+		}
+		if h.msgType != notification {
+			t.Fatalf("Unexpected %s message", h.msgType)
+		}
+		n, _ := readNotification(body)
+		if n.code != holdTimerExpiredError {
+			t.Errorf("Expected a Hold Timer Expired NOTIFICATION got %s", n)
+		}
+		break
+	}
+	if keepalives < 5 {
+		t.Errorf("Expected KEEPALIVEs every 20ms got %d", keepalives)
+	}
+	waitForState(t, p.fsm, idle)
+}
+
+func TestHoldTimerRestarted(t *testing.T) {
+	p, remote := establishedPeer(t, 100*time.Millisecond, time.Hour)
+	defer p.Down()
+	for i := 0; i < 10; i++ {
+		time.Sleep(30 * time.Millisecond)
+		if i%2 == 0 {
+			writeMessage(remote, keepalive, newKeepalive())
+		} else {
+			writeMessage(remote, update, newUpdate(nil, nil, nil))
+		}
+	}
+	if s := fsmState(p.fsm); s != established {
+		t.Errorf("Expected the session to stay Established got %s", s)
+	}
+}
+
+func TestIdleHoldBackoff(t *testing.T) {
+	f, _, _ := newFSMIn(t, idle)
+	f.dampPeerOscillations = true
+	expected := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second,
+		40 * time.Second, 80 * time.Second, 160 * time.Second, 320 * time.Second,
+		maxIdleHoldTime, maxIdleHoldTime}
+	for _, d := range expected {
+		f.state = openSent
+		f.event(BGPHeaderErr)
+		if f.state != idle || !f.idleHoldTimer.Running() {
+			t.Fatalf("Expected to be held in Idle got %s", f.state)
+		}
+		if f.idleHoldTime != d {
+			t.Errorf("Expected an IdleHoldTime of %s got %s", d, f.idleHoldTime)
+		}
+	}
+
+	// A stable session is forgiven
+	f.state = established
+	f.establishedAt = time.Now().Add(-3 * idleHoldDecay)
+	if d := f.decayedIdleHoldTime(); d != maxIdleHoldTime/8 {
+		t.Errorf("Expected the IdleHoldTime to decay to %s got %s", maxIdleHoldTime/8, d)
+	}
+	f.event(HoldTimerExpires)
+	if f.idleHoldTime != maxIdleHoldTime/4 {
+		t.Errorf("Expected an IdleHoldTime of %s got %s", maxIdleHoldTime/4, f.idleHoldTime)
+	}
+	f.state = established
+	f.establishedAt = time.Now().Add(-10 * idleHoldDecay)
+	if d := f.decayedIdleHoldTime(); d != 0 {
+		t.Errorf("Expected no IdleHoldTime after a long stable session got %s", d)
+	}
+}
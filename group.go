@@ -0,0 +1,278 @@
+package kbgp
+
+import (
+	"log"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Peers that share most of their settings, such as the clients of a route
+// reflector or the members of an IXP, can be put in a PeerGroup and
+// configured once. A peer takes on any of its group's settings that it does
+// not set itself, and picks up changes to the group while it runs.
+
+// peerSettings are the settings a peer can take from its group. Each is
+// nil until set, so that a peer only overrides what it sets itself.
+type peerSettings struct {
+	timers   sessionTimers
+	families []addressFamily
+	// Added to those of the group rather than replacing them
+	capabilities         []capability
+	requiredCapabilities []uint8
+
+	passive                         *bool
+	delayOpen                       *time.Duration
+	dampPeerOscillations            *bool
+	collisionDetectEstablishedState *bool
+
+	importPolicy Policy
+	exportPolicy Policy
+}
+
+// inherit fills in the settings that are not set from parent
+func (s peerSettings) inherit(parent peerSettings) peerSettings {
+	s.timers = s.timers.inherit(parent.timers)
+	if s.families == nil {
+		s.families = parent.families
+	}
+	s.capabilities = slices.Concat(parent.capabilities, s.capabilities)
+	s.requiredCapabilities = slices.Concat(parent.requiredCapabilities, s.requiredCapabilities)
+	if s.passive == nil {
+		s.passive = parent.passive
+	}
+	if s.delayOpen == nil {
+		s.delayOpen = parent.delayOpen
+	}
+	if s.dampPeerOscillations == nil {
+		s.dampPeerOscillations = parent.dampPeerOscillations
+	}
+	if s.collisionDetectEstablishedState == nil {
+		s.collisionDetectEstablishedState = parent.collisionDetectEstablishedState
+	}
+	if s.importPolicy == nil {
+		s.importPolicy = parent.importPolicy
+	}
+	if s.exportPolicy == nil {
+		s.exportPolicy = parent.exportPolicy
+	}
+	return s
+}
+
+// enabled returns true if an optional session attribute is set and true
+func enabled(b *bool) bool {
+	return b != nil && *b
+}
+
+// PeerGroup carries settings shared by its peers
+type PeerGroup struct {
+	name string
+
+	mu       sync.Mutex
+	settings peerSettings
+	// The peers of a speaker that are in the group
+	members []*Peer
+}
+
+// NewPeerGroup creates an empty peer group
+func NewPeerGroup(name string) *PeerGroup {
+	return &PeerGroup{name: name}
+}
+
+// String implements strings.Stringer
+func (g *PeerGroup) String() string {
+	return g.name
+}
+
+// Peers returns the peers in the group
+func (g *PeerGroup) Peers() []*Peer {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return slices.Clone(g.members)
+}
+
+// get returns the group's settings
+func (g *PeerGroup) get() peerSettings {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.settings
+}
+
+// set changes the group's settings and has its peers pick up the change
+func (g *PeerGroup) set(change func(s *peerSettings)) {
+	g.mu.Lock()
+	change(&g.settings)
+	members := slices.Clone(g.members)
+	g.mu.Unlock()
+	log.Println("updating peers in group", g)
+	for _, p := range members {
+		p.do(func() {
+			p.reconfigure(func() {})
+		})
+	}
+}
+
+// join adds p to the group's peers
+func (g *PeerGroup) join(p *Peer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members = append(g.members, p)
+}
+
+// leave removes p from the group's peers
+func (g *PeerGroup) leave(p *Peer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if i := slices.Index(g.members, p); i >= 0 {
+		g.members = slices.Delete(g.members, i, i+1)
+	}
+}
+
+// SetHoldTime sets the hold time the group's peers offer
+func (g *PeerGroup) SetHoldTime(d time.Duration) {
+	g.set(func(s *peerSettings) { s.timers.holdTime = &d })
+}
+
+// SetKeepaliveTime sets how often the group's peers send KEEPALIVEs
+func (g *PeerGroup) SetKeepaliveTime(d time.Duration) {
+	g.set(func(s *peerSettings) { s.timers.keepaliveTime = &d })
+}
+
+// SetConnectRetryTime sets how long the group's peers wait between attempts
+// to connect
+func (g *PeerGroup) SetConnectRetryTime(d time.Duration) {
+	g.set(func(s *peerSettings) { s.timers.connectRetryTime = &d })
+}
+
+// EnableFamilies sets the address families the group's peers exchange
+// routes for
+func (g *PeerGroup) EnableFamilies(families ...addressFamily) {
+	g.set(func(s *peerSettings) { s.families = families })
+}
+
+// RequireCapability makes the sessions of the group's peers fail if the
+// neighbor does not advertise the given capability
+func (g *PeerGroup) RequireCapability(code uint8) {
+	g.set(func(s *peerSettings) {
+		s.requiredCapabilities = append(slices.Clip(s.requiredCapabilities), code)
+	})
+}
+
+// SetPassive makes the group's peers only wait for neighbors to connect
+func (g *PeerGroup) SetPassive(enabled bool) {
+	g.set(func(s *peerSettings) { s.passive = &enabled })
+}
+
+// SetDelayOpen makes the group's peers wait up to d for the neighbor's OPEN
+// message before sending their own
+func (g *PeerGroup) SetDelayOpen(d time.Duration) {
+	g.set(func(s *peerSettings) { s.delayOpen = &d })
+}
+
+// SetDampPeerOscillations makes the group's peers back off before starting
+// again after a failure
+func (g *PeerGroup) SetDampPeerOscillations(enabled bool) {
+	g.set(func(s *peerSettings) { s.dampPeerOscillations = &enabled })
+}
+
+// SetCollisionDetectEstablishedState makes the group's peers resolve
+// connection collisions with Established sessions by BGP Identifier
+func (g *PeerGroup) SetCollisionDetectEstablishedState(enabled bool) {
+	g.set(func(s *peerSettings) { s.collisionDetectEstablishedState = &enabled })
+}
+
+// SetGroup puts the peer in a peer group. A peer that has been added to a
+// speaker is moved to another group with Speaker.UpdatePeer.
+func (p *Peer) SetGroup(g *PeerGroup) {
+	p.do(func() { p.group = g })
+}
+
+// resolved returns the peer's settings, with any it does not set taken from
+// its group
+func (p *Peer) resolved() peerSettings {
+	return p.settings.inherit(p.groupSettings)
+}
+
+// apply takes on the latest settings of the peer's group and puts the
+// peer's settings into effect
+func (p *Peer) apply() {
+	p.groupSettings = peerSettings{}
+	if p.group != nil {
+		p.groupSettings = p.group.get()
+	}
+	s := p.resolved()
+	p.families = s.families
+	if p.families == nil {
+		p.families = []addressFamily{IPv4Unicast}
+	}
+	p.capabilities = s.capabilities
+	p.requiredCapabilities = s.requiredCapabilities
+	f := p.fsm
+	f.passiveTCPEstablishment = enabled(s.passive)
+	f.delayOpen, f.delayOpenTime = false, 0
+	if s.delayOpen != nil {
+		f.delayOpen, f.delayOpenTime = *s.delayOpen > 0, *s.delayOpen
+	}
+	f.dampPeerOscillations = enabled(s.dampPeerOscillations)
+	f.collisionDetectEstablishedState = enabled(s.collisionDetectEstablishedState)
+}
+
+// negotiatedWith are the settings a session is negotiated with, which only
+// take effect with a new session because they are part of the OPEN message
+// or the TCP connection
+type negotiatedWith struct {
+	remoteAS             asn
+	localIP              string
+	localPort            int
+	holdTime             time.Duration
+	families             []addressFamily
+	capabilities         []capability
+	requiredCapabilities []uint8
+}
+
+// negotiatedWith returns what the peer's next session is negotiated with
+func (p *Peer) negotiatedWith() negotiatedWith {
+	return negotiatedWith{
+		remoteAS:             p.remoteAS,
+		localIP:              p.localIP.String(),
+		localPort:            p.localPort,
+		holdTime:             p.sessionTimers().hold(),
+		families:             p.families,
+		capabilities:         p.capabilities,
+		requiredCapabilities: p.requiredCapabilities,
+	}
+}
+
+// configure makes a change to the peer's settings from outside the event
+// loop. Settings changed while the peer runs take effect as they do through
+// Speaker.UpdatePeer. It must not be called from the event loop itself.
+func (p *Peer) configure(change func()) {
+	p.do(func() {
+		p.reconfigure(change)
+	})
+}
+
+// reconfigure makes a change to the peer's settings in the event loop and
+// puts them into effect. A session that was negotiated with settings that
+// change is reset with an Other Configuration Change Cease NOTIFICATION
+// message. Anything else applies straight away.
+func (p *Peer) reconfigure(change func()) {
+	before := p.negotiatedWith()
+	change()
+	p.apply()
+	f := p.fsm
+	if reflect.DeepEqual(before, p.negotiatedWith()) {
+		f.retime()
+		// The policies may have changed
+		p.adjRIBIn.reapply(p.resolved().importPolicy)
+		p.advertiseAll()
+		return
+	}
+	log.Println("resetting peer", p, "to reconfigure it")
+	started := f.state != idle || f.idleHoldTimer.Running()
+	f.stop(otherConfigurationChange)
+	if started {
+		f.event(p.manualStart())
+	}
+}
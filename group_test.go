@@ -0,0 +1,118 @@
+package kbgp
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPeerGroupInheritance(t *testing.T) {
+	s := NewSpeaker(65000, "", WithRouterID(net.ParseIP("192.0.2.1")),
+		WithConnectRetryTime(7*time.Second))
+	g := NewPeerGroup("clients")
+	g.SetHoldTime(30 * time.Second)
+	g.SetKeepaliveTime(5 * time.Second)
+	g.EnableFamilies(IPv4Unicast, IPv6Unicast)
+	g.RequireCapability(64)
+	g.SetPassive(true)
+
+	inherits := NewPeer(65001, net.ParseIP("192.0.2.2"))
+	inherits.SetGroup(g)
+	overrides := NewPeer(65002, net.ParseIP("192.0.2.3"))
+	overrides.SetGroup(g)
+	overrides.SetHoldTime(9 * time.Second)
+	overrides.EnableFamilies(IPv6Unicast)
+	overrides.RequireCapability(65)
+	overrides.SetPassive(false)
+	addPeer(t, s, inherits)
+	addPeer(t, s, overrides)
+
+	cases := []struct {
+		p            *Peer
+		holdTime     time.Duration
+		connectRetry time.Duration
+		families     []addressFamily
+		required     []uint8
+		passive      bool
+	}{
+		{inherits, 30 * time.Second, 7 * time.Second, []addressFamily{IPv4Unicast, IPv6Unicast}, []uint8{64}, true},
+		{overrides, 9 * time.Second, 7 * time.Second, []addressFamily{IPv6Unicast}, []uint8{64, 65}, false},
+	}
+	for _, c := range cases {
+		timers := c.p.sessionTimers()
+		if timers.hold() != c.holdTime || timers.connectRetry() != c.connectRetry {
+			t.Errorf("%s: expected hold time %s and ConnectRetryTime %s got %s and %s", c.p,
+				c.holdTime, c.connectRetry, timers.hold(), timers.connectRetry())
+		}
+		if *timers.keepaliveTime != 5*time.Second {
+			t.Errorf("%s: expected keepalive time 5s got %s", c.p, *timers.keepaliveTime)
+		}
+		if !slices.Equal(c.p.families, c.families) {
+			t.Errorf("%s: expected families %v got %v", c.p, c.families, c.p.families)
+		}
+		if !slices.Equal(c.p.requiredCapabilities, c.required) {
+			t.Errorf("%s: expected required capabilities %v got %v", c.p, c.required, c.p.requiredCapabilities)
+		}
+		if c.p.fsm.passiveTCPEstablishment != c.passive {
+			t.Errorf("%s: expected passive %t", c.p, c.passive)
+		}
+	}
+	if peers := g.Peers(); len(peers) != 2 {
+		t.Errorf("Expected 2 peers in the group got %d", len(peers))
+	}
+	s.RemovePeer(inherits)
+	if peers := g.Peers(); len(peers) != 1 || peers[0] != overrides {
+		t.Errorf("Expected only %s in the group got %v", overrides, peers)
+	}
+}
+
+func TestPeerGroupChanges(t *testing.T) {
+	s := NewSpeaker(65000, "", WithRouterID(net.ParseIP("192.0.2.1")))
+	startSpeaker(t, s)
+	g := NewPeerGroup("upstreams")
+	ln, p := listen(t)
+	p.SetGroup(g)
+	addPeer(t, s, p)
+	p.Up()
+	conn := establish(t, ln, p)
+
+	// Changing the keepalive time keeps the session
+	g.SetKeepaliveTime(time.Second)
+	var keepaliveTime time.Duration
+	p.do(func() { keepaliveTime = p.fsm.keepaliveTime })
+	if keepaliveTime != time.Second {
+		t.Errorf("Expected a keepalive time of 1s got %s", keepaliveTime)
+	}
+	if current := fsmState(p.fsm); current != established {
+		t.Errorf("Expected the session to stay established got %s", current)
+	}
+
+	// Changing the hold time resets the session
+	g.SetHoldTime(30 * time.Second)
+	expectCease(t, conn, otherConfigurationChange)
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal("Expected the peer to reconnect got", err)
+	}
+	defer conn.Close()
+	o, err := readOpenMessage(conn)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if o.holdTime != 30 {
+		t.Errorf("Expected a hold time of 30 got %d", o.holdTime)
+	}
+
+	// Moving the peer to another group
+	other := NewPeerGroup("customers")
+	q := NewPeer(65001, net.ParseIP("127.0.0.1"))
+	q.SetRemotePort(p.remotePort)
+	q.SetGroup(other)
+	if err := s.UpdatePeer(q); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(g.Peers()) != 0 || len(other.Peers()) != 1 {
+		t.Error("Expected the peer to move to the other group")
+	}
+}
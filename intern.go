@@ -0,0 +1,132 @@
+package kbgp
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// A full table has around a million routes but far fewer distinct sets of
+// path attributes, and each peer sends its own copy of every set. Routes
+// held in the RIBs share a single copy of each set instead, which is never
+// changed once it is shared, and which is forgotten once no route uses it.
+
+// attrCache holds one shared copy of each set of path attributes in use.
+// A nil cache shares nothing.
+type attrCache struct {
+	mu sync.Mutex
+	// Sets by their encoding, which Go hashes for us
+	byKey map[string]*internedAttrs
+	// Sets by the shared copy, so that routes already using it are
+	// counted without encoding it again
+	byCopy map[*pathAttributes]*internedAttrs
+}
+
+// internedAttrs is a shared set of path attributes and the number of
+// routes using it
+type internedAttrs struct {
+	attrs *pathAttributes
+	key   string
+	refs  int
+}
+
+func newAttrCache() *attrCache {
+	return &attrCache{
+		byKey:  map[string]*internedAttrs{},
+		byCopy: map[*pathAttributes]*internedAttrs{},
+	}
+}
+
+// attrKey returns the encoding of attrs. Sets that are encoded the same
+// are advertised the same, so they can be shared.
+func attrKey(attrs *pathAttributes) string {
+	var b []byte
+	for _, a := range attrs.raw(true) {
+		b = append(b, a.bytes()...)
+	}
+	return string(b)
+}
+
+// intern returns the shared copy of attrs, which is attrs itself if there
+// was none, and counts another route as using it
+func (c *attrCache) intern(attrs *pathAttributes) *pathAttributes {
+	if c == nil {
+		return attrs
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i, ok := c.byCopy[attrs]; ok {
+		i.refs++
+		return i.attrs
+	}
+	key := attrKey(attrs)
+	i, ok := c.byKey[key]
+	if !ok {
+		i = &internedAttrs{attrs: attrs, key: key}
+		c.byKey[key] = i
+		c.byCopy[attrs] = i
+	}
+	i.refs++
+	return i.attrs
+}
+
+// release counts one less route as using the shared copy attrs, and
+// forgets it once there are none
+func (c *attrCache) release(attrs *pathAttributes) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, ok := c.byCopy[attrs]
+	if !ok {
+		return
+	}
+	if i.refs--; i.refs == 0 {
+		delete(c.byKey, i.key)
+		delete(c.byCopy, attrs)
+	}
+}
+
+// len returns the number of distinct sets in use
+func (c *attrCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.byKey)
+}
+
+// interned returns r using the shared copy of its attributes
+func (c *attrCache) interned(r Route) Route {
+	r.attrs = c.intern(r.attrs)
+	return r
+}
+
+// store puts r in t with shared attributes, releasing the attributes of
+// the route it replaces
+func (c *attrCache) store(t table, r Route) Route {
+	r = c.interned(r)
+	if old, ok := t.lookup(r.prefix); ok {
+		c.release(old.attrs)
+	}
+	t.insert(r)
+	return r
+}
+
+// drop removes the route for prefix from t and releases its attributes
+func (c *attrCache) drop(t table, prefix netip.Prefix) {
+	if r, ok := t.lookup(prefix); ok {
+		c.release(r.attrs)
+		t.remove(prefix)
+	}
+}
+
+// releaseAll releases the attributes of every route in t
+func (c *attrCache) releaseAll(t table) {
+	for _, routes := range t {
+		for _, r := range routes {
+			c.release(r.attrs)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package kbgp
+
+import (
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"runtime"
+	"testing"
+)
+
+// decoded returns a fresh copy of attrs, as if it had just been read from
+// an UPDATE message
+func decoded(t testing.TB, attrs pathAttributes) *pathAttributes {
+	copied, err := newPathAttributes(attrs.raw(true), true)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	return &copied
+}
+
+func TestAttrCache(t *testing.T) {
+	attrs := testRoutes("10.0.0.0/8")[0].attrs
+	c := newAttrCache()
+	first := c.intern(decoded(t, *attrs))
+	second := c.intern(decoded(t, *attrs))
+	if first != second {
+		t.Error("Expected the same attributes to be shared")
+	}
+	other := c.intern(decoded(t, *testRoutes("10.0.0.0/8")[0].WithMED(5).attrs))
+	if other == first || c.len() != 2 {
+		t.Errorf("Expected 2 distinct sets got %d", c.len())
+	}
+	// Each use is counted
+	if c.intern(first) != first {
+		t.Error("Expected the shared copy to be its own")
+	}
+	for range 3 {
+		c.release(first)
+	}
+	c.release(other)
+	if c.len() != 0 {
+		t.Errorf("Expected unused sets to be forgotten got %d", c.len())
+	}
+	// Nothing is shared without a cache
+	var none *attrCache
+	if none.intern(attrs) != attrs {
+		t.Error("Expected a nil cache to leave attributes alone")
+	}
+	none.release(attrs)
+}
+
+func TestRIBsShareAttributes(t *testing.T) {
+	s := NewSpeaker(65000, "")
+	a := NewPeer(65001, netip.MustParseAddr("192.0.2.2").AsSlice())
+	b := NewPeer(65002, netip.MustParseAddr("192.0.2.3").AsSlice())
+	addPeer(t, s, a)
+	addPeer(t, s, b)
+	attrs := *testRoutes("10.0.0.0/8")[0].attrs
+	prefixes := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16"), netip.MustParsePrefix("10.1.0.0/16")}
+	for _, p := range []*Peer{a, b} {
+		p.do(func() {
+			// Separate UPDATE messages with the same attributes
+			for _, prefix := range prefixes {
+				p.adjRIBIn.update(newRoutes([]netip.Prefix{prefix}, *decoded(t, attrs)), nil, nil)
+			}
+		})
+	}
+	ra, _ := a.LookupRoute(PostPolicy, prefixes[0])
+	rb, _ := b.LookupRoute(PostPolicy, prefixes[1])
+	if ra.attrs != rb.attrs || s.attrs.len() != 1 {
+		t.Errorf("Expected the routes of both peers to share attributes, got %d sets", s.attrs.len())
+	}
+
+	// Routes changed by policy share the changed attributes
+	a.do(func() {
+		a.adjRIBIn.reapply(PolicyFunc(func(r Route) (Route, bool) {
+			return r.WithLocalPref(200), true
+		}))
+	})
+	r0, _ := a.LookupRoute(PostPolicy, prefixes[0])
+	r1, _ := a.LookupRoute(PostPolicy, prefixes[1])
+	if r0.attrs != r1.attrs || r0.attrs == ra.attrs || s.attrs.len() != 2 {
+		t.Errorf("Expected the changed routes to share attributes, got %d sets", s.attrs.len())
+	}
+
+	for _, p := range []*Peer{a, b} {
+		p.do(func() {
+			p.adjRIBIn.update(nil, prefixes[:1], nil)
+			p.adjRIBIn.flush()
+		})
+	}
+	if n := s.attrs.len(); n != 0 {
+		t.Errorf("Expected no attributes to be left got %d sets", n)
+	}
+}
+
+// Sizes of a full table, with about 1 distinct set of attributes for every
+// 10 prefixes, as peers send them
+const (
+	fullTablePrefixes   = 1_000_000
+	fullTableAttrSets   = 100_000
+	fullTablePerUpdate  = 2
+	fullTableBenchPeers = 4
+)
+
+// fullTableUpdate is an UPDATE message of a full table
+type fullTableUpdate struct {
+	prefixes []netip.Prefix
+	attrs    []pathAttribute
+}
+
+// fullTableUpdates returns the UPDATE messages a peer sends a full table in
+func fullTableUpdates() []fullTableUpdate {
+	r := rand.New(rand.NewSource(1))
+	sets := make([][]pathAttribute, fullTableAttrSets)
+	for i := range sets {
+		path := make([]asn, 2+r.Intn(5))
+		for j := range path {
+			path[j] = asn(64512 + r.Intn(1000))
+		}
+		med := uint32(r.Intn(10))
+		sets[i] = pathAttributes{
+			present:       map[uint8]bool{origin: true, asPath: true},
+			asPath:        asPathAttr{sequence(path...)},
+			nextHop:       netip.MustParseAddr("192.0.2.2"),
+			multiExitDisc: &med,
+		}.raw(true)
+	}
+	updates := make([]fullTableUpdate, 0, fullTablePrefixes/fullTablePerUpdate)
+	for i := 0; i < fullTablePrefixes; i += fullTablePerUpdate {
+		u := fullTableUpdate{attrs: sets[r.Intn(len(sets))]}
+		for j := i; j < i+fullTablePerUpdate; j++ {
+			addr := netip.AddrFrom4([4]byte{byte(j >> 16), byte(j >> 8), byte(j), 0})
+			u.prefixes = append(u.prefixes, netip.PrefixFrom(addr, 24))
+		}
+		updates = append(updates, u)
+	}
+	return updates
+}
+
+// benchmarkFullTables loads a full table from several peers and reports
+// the memory they take up
+func benchmarkFullTables(b *testing.B, cache *attrCache) {
+	updates := fullTableUpdates()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		ribs := make([]*adjRIBIn, fullTableBenchPeers)
+		for i := range ribs {
+			ribs[i] = newAdjRIBIn()
+			ribs[i].cache = cache
+			for _, u := range updates {
+				attrs, err := newPathAttributes(u.attrs, true)
+				if err != nil {
+					b.Fatal("Unexpected error", err)
+				}
+				ribs[i].update(newRoutes(u.prefixes, attrs), nil, nil)
+			}
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/(1<<20), "MiB")
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/fullTablePrefixes/fullTableBenchPeers, "B/route")
+		runtime.KeepAlive(ribs)
+		for _, rib := range ribs {
+			rib.flush()
+		}
+	}
+}
+
+func BenchmarkFullTables(b *testing.B) {
+	b.Run(fmt.Sprintf("%d peers interned", fullTableBenchPeers), func(b *testing.B) {
+		benchmarkFullTables(b, newAttrCache())
+	})
+	b.Run(fmt.Sprintf("%d peers copied", fullTableBenchPeers), func(b *testing.B) {
+		benchmarkFullTables(b, nil)
+	})
+}
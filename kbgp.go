@@ -21,11 +21,29 @@ func (e bgpError) Error() string {
 	return fmt.Sprintf("error code: %d subcode: %d message: %s", e.code, e.subcode, e.message)
 }
 
-type asn uint16
+// An AS number. Since RFC 6793 these are 4 octets long, but they are still
+// carried in 2 octets when talking to a speaker that does not support them.
+type asn uint32
 
 // bytes implements byter
 func (a asn) bytes() []byte {
-	return uint16ToBytes(uint16(a))
+	return uint32ToBytes(uint32(a))
+}
+
+// twoOctetBytes encodes the AS number in 2 octets, substituting AS_TRANS
+// if it does not fit
+func (a asn) twoOctetBytes() []byte {
+	return uint16ToBytes(uint16(a.mappable()))
+}
+
+// mappable returns the AS number if it fits in 2 octets, or AS_TRANS if it
+// does not
+// https://tools.ietf.org/html/rfc6793#section-3
+func (a asn) mappable() asn {
+	if a > 0xffff {
+		return asTrans
+	}
+	return a
 }
 
 // length implements byter
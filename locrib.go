@@ -0,0 +1,379 @@
+package kbgp
+
+import (
+	"log"
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// Loc-RIB: The Loc-RIB contains the local routing information the BGP
+// speaker selected by applying its local policies to the routing
+// information contained in its Adj-RIBs-In.
+// https://tools.ietf.org/html/rfc4271#section-3.2
+//
+// The Decision Process selects routes for subsequent advertisement by
+// applying the policies in the local Policy Information Base (PIB) to the
+// routes stored in its Adj-RIBs-In.  The output of the Decision Process is
+// the set of routes that will be advertised to peers; the selected routes
+// will be stored in the local speaker's Adj-RIBs-Out, according to policy.
+// https://tools.ietf.org/html/rfc4271#section-9.1
+
+// defaultLocalPref is the degree of preference of a route without a
+// LOCAL_PREF
+const defaultLocalPref = 100
+
+// source is the peer a path was learned from, as it was when the path was
+// learned
+type source struct {
+	peer     *Peer
+	as       asn
+	id       bgpIdentifier
+	addr     netip.Addr
+	internal bool
+}
+
+// source returns where the routes the peer sends us come from
+func (p *Peer) source() source {
+	addr, _ := netip.AddrFromSlice(p.remoteIP)
+	return source{
+		peer:     p,
+		as:       p.remoteAS,
+		id:       p.remoteID,
+		addr:     addr.Unmap(),
+		internal: p.internal(),
+	}
+}
+
+// path is a route to a destination learned from one peer
+type path struct {
+	route Route
+	from  source
+}
+
+// decisionStep is a step of the decision process that a path can lose at
+type decisionStep int
+
+const (
+	// The path had nothing to compete with
+	onlyPath decisionStep = iota
+	asLoop
+	unresolvableNextHop
+	degreeOfPreference
+	asPathLength
+	lowestOrigin
+	lowestMED
+	externalOverInternal
+	lowestIGPCost
+	lowestBGPIdentifier
+	lowestPeerAddress
+)
+
+var decisionStepName = map[decisionStep]string{
+	onlyPath:             "only path",
+	asLoop:               "AS_PATH loop",
+	unresolvableNextHop:  "unresolvable NEXT_HOP",
+	degreeOfPreference:   "LOCAL_PREF",
+	asPathLength:         "AS_PATH length",
+	lowestOrigin:         "ORIGIN",
+	lowestMED:            "MULTI_EXIT_DISC",
+	externalOverInternal: "eBGP over iBGP",
+	lowestIGPCost:        "IGP cost",
+	lowestBGPIdentifier:  "BGP Identifier",
+	lowestPeerAddress:    "peer address",
+}
+
+// String implements strings.Stringer
+func (d decisionStep) String() string {
+	return decisionStepName[d]
+}
+
+// Decision is how a path to a destination fared in the decision process
+type Decision struct {
+	Route Route
+	// The peer the path was learned from
+	Peer *Peer
+	Best bool
+	// The step of the decision process the path lost at or, for the best
+	// path, the step that decided between it and the last path left
+	Reason string
+}
+
+// IGPCost returns the cost of reaching a next hop through the IGP, or false
+// if the next hop is not reachable at all
+type IGPCost func(nextHop netip.Addr) (uint32, bool)
+
+// locRIB holds the paths to each destination learned from every peer, and
+// the best of them
+type locRIB struct {
+	// Our own AS number, which no path we use may have been through
+	as      asn
+	igpCost IGPCost
+
+	mu    sync.Mutex
+	paths map[netip.Prefix][]path
+	best  map[netip.Prefix]path
+	// Told about each change to the best path to a destination, nil if
+	// there no longer is one
+	changed func(prefix netip.Prefix, best *path)
+}
+
+func newLocRIB(as asn, igpCost IGPCost) *locRIB {
+	return &locRIB{
+		as:      as,
+		igpCost: igpCost,
+		paths:   map[netip.Prefix][]path{},
+		best:    map[netip.Prefix]path{},
+	}
+}
+
+// update replaces the path to prefix learned from a peer, removing it if
+// ok is false, and selects the best path to prefix again. Only prefix is
+// considered, so each change to an Adj-RIB-In costs no more than deciding
+// between the paths to one destination.
+func (l *locRIB) update(from source, prefix netip.Prefix, r Route, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	paths := slices.DeleteFunc(l.paths[prefix], func(p path) bool {
+		return p.from.peer == from.peer
+	})
+	if ok {
+		paths = append(paths, path{r, from})
+	}
+	if len(paths) == 0 {
+		delete(l.paths, prefix)
+	} else {
+		l.paths[prefix] = paths
+	}
+	l.reselect(prefix)
+}
+
+// reselect puts the best path to prefix in the Loc-RIB
+func (l *locRIB) reselect(prefix netip.Prefix) {
+	paths := l.paths[prefix]
+	best, _ := l.decide(paths)
+	current, ok := l.best[prefix]
+	if best < 0 {
+		if ok {
+			log.Println("no path to", prefix)
+			delete(l.best, prefix)
+			l.notify(prefix, nil)
+		}
+		return
+	}
+	if ok && current == paths[best] {
+		return
+	}
+	// Paths are moved about as others are withdrawn, so whoever is told
+	// about the best path gets a copy of it
+	b := paths[best]
+	l.best[prefix] = b
+	l.notify(prefix, &b)
+}
+
+// notify passes on a change to the best path to prefix
+func (l *locRIB) notify(prefix netip.Prefix, best *path) {
+	if l.changed != nil {
+		l.changed(prefix, best)
+	}
+}
+
+// decide runs the decision process over paths to the same destination. It
+// returns the index of the best path, or -1 if none can be used, and the
+// step each path was decided at.
+func (l *locRIB) decide(paths []path) (int, []decisionStep) {
+	steps := make([]decisionStep, len(paths))
+	left := []int{}
+	// Phase 2: Route Selection
+	// https://tools.ietf.org/html/rfc4271#section-9.1.2
+	for i, p := range paths {
+		// If the AS_PATH attribute of a BGP route contains an AS loop,
+		// the BGP route should be excluded from the Phase 2 decision
+		// function.
+		if p.route.attrs.asPath.contains(l.as) {
+			steps[i] = asLoop
+			continue
+		}
+		// If the NEXT_HOP attribute of a BGP route depicts an address
+		// that is not resolvable, or if it would become unresolvable if
+		// the route was installed in the routing table, the BGP route
+		// MUST be excluded from the Phase 2 decision function.
+		if _, ok := l.cost(p); !ok {
+			steps[i] = unresolvableNextHop
+			continue
+		}
+		left = append(left, i)
+	}
+	// Any path still standing loses at the step that eliminates it
+	eliminate := func(step decisionStep, keep func(i int) bool) {
+		kept := left[:0]
+		for _, i := range left {
+			if keep(i) {
+				kept = append(kept, i)
+			} else {
+				steps[i] = step
+			}
+		}
+		if len(kept) < len(left) {
+			for _, i := range kept {
+				steps[i] = step
+			}
+		}
+		left = kept
+	}
+	// keepLowest keeps the paths with the lowest key
+	keepLowest := func(step decisionStep, key func(p path) int64) {
+		lowest := int64(0)
+		for n, i := range left {
+			if k := key(paths[i]); n == 0 || k < lowest {
+				lowest = k
+			}
+		}
+		eliminate(step, func(i int) bool { return key(paths[i]) == lowest })
+	}
+
+	// The route with the highest degree of preference is selected.
+	keepLowest(degreeOfPreference, func(p path) int64 {
+		return -int64(preference(p.route))
+	})
+	// Breaking Ties (Phase 2)
+	// https://tools.ietf.org/html/rfc4271#section-9.1.2.2
+	//
+	// a) Remove from consideration all routes that are not tied for
+	//    having the smallest number of AS numbers present in their
+	//    AS_PATH attributes.
+	keepLowest(asPathLength, func(p path) int64 {
+		return int64(p.route.ASPathLength())
+	})
+	// b) Remove from consideration all routes that are not tied for
+	//    having the lowest Origin number in their Origin attribute.
+	keepLowest(lowestOrigin, func(p path) int64 {
+		return int64(p.route.attrs.origin)
+	})
+	// c) Remove from consideration routes with less-preferred
+	//    MULTI_EXIT_DISC attributes.  MULTI_EXIT_DISC is only comparable
+	//    between routes learned from the same neighboring AS.
+	candidates := slices.Clone(left)
+	eliminate(lowestMED, func(i int) bool {
+		for _, j := range candidates {
+			if neighborAS(paths[j]) == neighborAS(paths[i]) && med(paths[j].route) < med(paths[i].route) {
+				return false
+			}
+		}
+		return true
+	})
+	// d) If at least one of the candidate routes was received via EBGP,
+	//    remove from consideration all routes that were received via
+	//    IBGP.
+	keepLowest(externalOverInternal, func(p path) int64 {
+		if p.from.internal {
+			return 1
+		}
+		return 0
+	})
+	// e) Remove from consideration any routes with less-preferred
+	//    interior cost.
+	keepLowest(lowestIGPCost, func(p path) int64 {
+		cost, _ := l.cost(p)
+		return int64(cost)
+	})
+	// f) Remove from consideration all remaining routes except for the
+	//    route that was advertised by the BGP speaker with the lowest BGP
+	//    Identifier value.
+	keepLowest(lowestBGPIdentifier, func(p path) int64 {
+		return int64(p.from.id)
+	})
+	// g) Prefer the route received from the lowest peer address.
+	slices.SortFunc(left, func(i, j int) int {
+		return paths[i].from.addr.Compare(paths[j].from.addr)
+	})
+	if len(left) > 1 {
+		eliminate(lowestPeerAddress, func(i int) bool { return i == left[0] })
+	}
+	if len(left) == 0 {
+		return -1, steps
+	}
+	return left[0], steps
+}
+
+// cost returns the IGP cost to the path's next hop
+func (l *locRIB) cost(p path) (uint32, bool) {
+	if l.igpCost == nil {
+		return 0, true
+	}
+	return l.igpCost(p.route.NextHop())
+}
+
+// preference returns the degree of preference of r
+func preference(r Route) uint32 {
+	if lp, ok := r.LocalPref(); ok {
+		return lp
+	}
+	return defaultLocalPref
+}
+
+// med returns the MULTI_EXIT_DISC of r. A route without one is treated as
+// having the lowest possible MULTI_EXIT_DISC value.
+func med(r Route) uint32 {
+	m, _ := r.MED()
+	return m
+}
+
+// neighborAS returns the neighboring AS of a path, the first AS in its
+// AS_PATH, or 0 for a path that did not come from another AS
+func neighborAS(p path) asn {
+	as, _ := p.route.attrs.asPath.first()
+	return as
+}
+
+// BestRoute returns the best route to prefix
+func (s *Speaker) BestRoute(prefix netip.Prefix) (Route, bool) {
+	s.locRIB.mu.Lock()
+	defer s.locRIB.mu.Unlock()
+	best, ok := s.locRIB.best[prefix]
+	return best.route, ok
+}
+
+// BestRoutes returns the best route to each destination in family, in
+// prefix order
+func (s *Speaker) BestRoutes(family addressFamily) []Route {
+	s.locRIB.mu.Lock()
+	defer s.locRIB.mu.Unlock()
+	routes := []Route{}
+	for prefix, best := range s.locRIB.best {
+		if familyOf(prefix) == family {
+			routes = append(routes, best.route)
+		}
+	}
+	slices.SortFunc(routes, func(a, b Route) int {
+		return comparePrefixes(a.prefix, b.prefix)
+	})
+	return routes
+}
+
+// Explain returns how each path to prefix fared in the decision process
+func (s *Speaker) Explain(prefix netip.Prefix) []Decision {
+	s.locRIB.mu.Lock()
+	defer s.locRIB.mu.Unlock()
+	paths := s.locRIB.paths[prefix]
+	best, steps := s.locRIB.decide(paths)
+	decisions := make([]Decision, len(paths))
+	for i, p := range paths {
+		decisions[i] = Decision{
+			Route:  p.route,
+			Peer:   p.from.peer,
+			Best:   i == best,
+			Reason: steps[i].String(),
+		}
+	}
+	return decisions
+}
+
+// offer hands a change to the routes accepted from the peer to the
+// speaker's decision process
+func (p *Peer) offer(prefix netip.Prefix, r Route, ok bool) {
+	if p.speaker == nil {
+		return
+	}
+	p.speaker.locRIB.update(p.source(), prefix, r, ok)
+}
@@ -0,0 +1,235 @@
+package kbgp
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// testPath returns a path to 10.0.0.0/8 learned from the peer at addr,
+// changed by options
+func testPath(addr string, options ...func(p *path)) path {
+	attrs := pathAttributes{
+		present: map[uint8]bool{origin: true, asPath: true, nextHop: true},
+		origin:  igp,
+		asPath:  asPathAttr{sequence(65001, 65100)},
+		nextHop: netip.MustParseAddr(addr),
+	}
+	p := path{
+		route: Route{netip.MustParsePrefix("10.0.0.0/8"), &attrs},
+		from: source{
+			peer: &Peer{},
+			as:   65001,
+			id:   bgpIdentifier(netip.MustParseAddr(addr).As4()[3]),
+			addr: netip.MustParseAddr(addr),
+		},
+	}
+	for _, option := range options {
+		option(&p)
+	}
+	return p
+}
+
+func withLocalPref(v uint32) func(p *path) {
+	return func(p *path) { p.route = p.route.WithLocalPref(v) }
+}
+
+func withMED(v uint32) func(p *path) {
+	return func(p *path) { p.route = p.route.WithMED(v) }
+}
+
+func withASPath(asns ...asn) func(p *path) {
+	return func(p *path) {
+		p.route = p.route.with(func(attrs *pathAttributes) {
+			attrs.asPath = asPathAttr{sequence(asns...)}
+		})
+		p.from.as = asns[0]
+	}
+}
+
+func withOrigin(o originAttr) func(p *path) {
+	return func(p *path) {
+		p.route = p.route.with(func(attrs *pathAttributes) { attrs.origin = o })
+	}
+}
+
+func internalPath(p *path) {
+	p.from.internal = true
+}
+
+func withID(id bgpIdentifier) func(p *path) {
+	return func(p *path) { p.from.id = id }
+}
+
+func TestDecisionProcess(t *testing.T) {
+	// The cost to each next hop is its last octet, and 192.0.2.99 is
+	// unreachable
+	cost := func(nextHop netip.Addr) (uint32, bool) {
+		last := nextHop.As4()[3]
+		return uint32(last), last != 99
+	}
+	cases := map[string]struct {
+		paths  []path
+		best   int
+		reason decisionStep
+	}{
+		"only path": {
+			[]path{testPath("192.0.2.1")}, 0, onlyPath,
+		},
+		"AS loop": {
+			[]path{testPath("192.0.2.1", withASPath(65001, 65000)), testPath("192.0.2.2")}, 1, onlyPath,
+		},
+		"unresolvable next hop": {
+			[]path{testPath("192.0.2.99"), testPath("192.0.2.2")}, 1, onlyPath,
+		},
+		"nothing usable": {
+			[]path{testPath("192.0.2.99")}, -1, 0,
+		},
+		"higher LOCAL_PREF": {
+			[]path{testPath("192.0.2.1", withASPath(65001)), testPath("192.0.2.2", withLocalPref(200))},
+			1, degreeOfPreference,
+		},
+		"missing LOCAL_PREF is 100": {
+			[]path{testPath("192.0.2.1", withLocalPref(99)), testPath("192.0.2.2")},
+			1, degreeOfPreference,
+		},
+		"shorter AS_PATH": {
+			[]path{testPath("192.0.2.1"), testPath("192.0.2.2", withASPath(65002))},
+			1, asPathLength,
+		},
+		"lower ORIGIN": {
+			[]path{testPath("192.0.2.1", withOrigin(incomplete)), testPath("192.0.2.2", withOrigin(egp))},
+			1, lowestOrigin,
+		},
+		"lower MED from the same AS": {
+			[]path{testPath("192.0.2.1", withMED(20)), testPath("192.0.2.2", withMED(10))},
+			1, lowestMED,
+		},
+		"missing MED is lowest": {
+			[]path{testPath("192.0.2.1", withMED(20)), testPath("192.0.2.2")},
+			1, lowestMED,
+		},
+		"MED from different ASes is not compared": {
+			[]path{testPath("192.0.2.1", withMED(10)), testPath("192.0.2.2", withASPath(65002, 65100), withMED(20))},
+			0, lowestIGPCost,
+		},
+		"eBGP over iBGP": {
+			[]path{testPath("192.0.2.1", internalPath), testPath("192.0.2.2")},
+			1, externalOverInternal,
+		},
+		"lower IGP cost": {
+			[]path{testPath("192.0.2.5"), testPath("192.0.2.3")},
+			1, lowestIGPCost,
+		},
+		"lower BGP Identifier": {
+			[]path{testPath("192.0.2.1", withID(2)), testPath("192.0.2.1", withID(1))},
+			1, lowestBGPIdentifier,
+		},
+		"lower peer address": {
+			[]path{
+				testPath("192.0.2.1", func(p *path) { p.from.addr = netip.MustParseAddr("198.51.100.2") }),
+				testPath("192.0.2.1", func(p *path) { p.from.addr = netip.MustParseAddr("198.51.100.1") }),
+			},
+			1, lowestPeerAddress,
+		},
+	}
+	for name, c := range cases {
+		l := newLocRIB(65000, cost)
+		best, steps := l.decide(c.paths)
+		if best != c.best {
+			t.Errorf("%s: expected path %d to be best got %d", name, c.best, best)
+			continue
+		}
+		if best >= 0 && steps[best] != c.reason {
+			t.Errorf("%s: expected the best path to win on %s got %s", name, c.reason, steps[best])
+		}
+	}
+}
+
+// TestMEDNotTransitive checks that MED only removes paths from the same
+// neighboring AS, which can make the outcome depend on all of the paths
+func TestMEDNotTransitive(t *testing.T) {
+	l := newLocRIB(65000, nil)
+	paths := []path{
+		testPath("192.0.2.3", withMED(10)),
+		testPath("192.0.2.2", withASPath(65002, 65100), withMED(5)),
+		testPath("192.0.2.1", withMED(20)),
+	}
+	best, steps := l.decide(paths)
+	if best != 1 {
+		t.Errorf("Expected path 1 to be best got %d", best)
+	}
+	if steps[2] != lowestMED {
+		t.Errorf("Expected path 2 to lose on MED got %s", steps[2])
+	}
+	if steps[0] != lowestBGPIdentifier {
+		t.Errorf("Expected path 0 to lose on BGP Identifier got %s", steps[0])
+	}
+}
+
+func TestLocRIBIncremental(t *testing.T) {
+	s := NewSpeaker(65000, "")
+	prefix := netip.MustParsePrefix("10.0.0.0/8")
+	a := testPath("192.0.2.1")
+	b := testPath("192.0.2.2", withLocalPref(200))
+	s.locRIB.update(a.from, prefix, a.route, true)
+	s.locRIB.update(b.from, prefix, b.route, true)
+	if r, ok := s.BestRoute(prefix); !ok || r.NextHop() != b.route.NextHop() {
+		t.Errorf("Expected the path via %s to be best got %s", b.route.NextHop(), r)
+	}
+	decisions := s.Explain(prefix)
+	if len(decisions) != 2 {
+		t.Fatalf("Expected 2 decisions got %d", len(decisions))
+	}
+	for _, d := range decisions {
+		if d.Reason != "LOCAL_PREF" || d.Best != (d.Peer == b.from.peer) {
+			t.Errorf("Unexpected decision %+v", d)
+		}
+	}
+
+	// Withdrawing the best path falls back to the other
+	s.locRIB.update(b.from, prefix, Route{}, false)
+	if r, ok := s.BestRoute(prefix); !ok || r.NextHop() != a.route.NextHop() {
+		t.Errorf("Expected the path via %s to be best got %s", a.route.NextHop(), r)
+	}
+	if routes := s.BestRoutes(IPv4Unicast); len(routes) != 1 {
+		t.Errorf("Expected 1 best route got %d", len(routes))
+	}
+	s.locRIB.update(a.from, prefix, Route{}, false)
+	if _, ok := s.BestRoute(prefix); ok {
+		t.Error("Expected no best route once every path is withdrawn")
+	}
+	if len(s.locRIB.paths) != 0 {
+		t.Error("Expected no paths to be left")
+	}
+}
+
+func TestLocRIBFedFromAdjRIBsIn(t *testing.T) {
+	s := NewSpeaker(65000, "")
+	p := NewPeer(65001, netip.MustParseAddr("192.0.2.2").AsSlice())
+	addPeer(t, s, p)
+	prefix := netip.MustParsePrefix("10.0.0.0/16")
+	p.do(func() {
+		p.adjRIBIn.update(testRoutes(prefix.String()), nil, nil)
+	})
+	if _, ok := s.BestRoute(prefix); !ok {
+		t.Error("Expected a best route once the peer advertises it")
+	}
+	if d := s.Explain(prefix); len(d) != 1 || d[0].Peer != p {
+		t.Errorf("Expected the path to be from %s got %v", p, d)
+	}
+
+	// A change of policy takes the route out again
+	p.do(func() {
+		p.adjRIBIn.reapply(PolicyFunc(func(r Route) (Route, bool) { return r, false }))
+	})
+	if _, ok := s.BestRoute(prefix); ok {
+		t.Error("Expected no best route once policy rejects it")
+	}
+	p.do(func() {
+		p.adjRIBIn.reapply(nil)
+		p.adjRIBIn.flush()
+	})
+	if _, ok := s.BestRoute(prefix); ok {
+		t.Error("Expected no best route once the session is gone")
+	}
+}
@@ -0,0 +1,174 @@
+package kbgp
+
+import (
+	"context"
+	"log"
+	"net"
+)
+
+// Each peer's FSM runs in a single goroutine that takes events off a queue.
+// Timers, connection attempts and the goroutine reading from the peer all
+// hand their events to it, along with whatever triggered them, so that
+// only the event loop touches the session.
+
+// fsmEvent is an event for a peer's FSM and what caused it
+type fsmEvent struct {
+	event event
+	// The connection the event happened on
+	conn net.Conn
+	// The connection attempt the event is the outcome of
+	dial context.Context
+	// The error behind the event
+	err error
+	// The OPEN message, or the body of any other message, received
+	open openMsg
+	body []byte
+	// Work to be done in the event loop rather than an event
+	do func()
+}
+
+// eventQueueLength is how many events may be waiting for a peer's event
+// loop before whatever produces them has to wait
+const eventQueueLength = 16
+
+// run is the peer's event loop
+func (p *Peer) run() {
+	for {
+		select {
+		case e := <-p.events:
+			p.handle(e)
+		case <-p.exports.ready:
+			p.export()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// start runs the peer's event loop, unless it is already running. Until
+// then the peer belongs to whoever created it, and only its settings can be
+// changed.
+func (p *Peer) start() {
+	if p.started.CompareAndSwap(false, true) {
+		p.goroutine(p.run)
+	}
+}
+
+// enqueue hands an event to the peer's event loop. Once the peer has been
+// shut down the event is dropped, along with any connection it brought.
+func (p *Peer) enqueue(e fsmEvent) {
+	select {
+	case p.events <- e:
+	case <-p.done:
+		if e.conn != nil {
+			e.conn.Close()
+		}
+	}
+}
+
+// do runs f in the peer's event loop and waits for it to finish, or runs
+// it straight away if the loop has not been started. It must not be called
+// from the event loop itself. Nothing is run once the peer has been shut
+// down.
+func (p *Peer) do(f func()) {
+	if !p.started.Load() {
+		select {
+		case <-p.done:
+		default:
+			f()
+		}
+		return
+	}
+	finished := make(chan struct{})
+	p.enqueue(fsmEvent{do: func() {
+		f()
+		close(finished)
+	}})
+	select {
+	case <-finished:
+	case <-p.done:
+	}
+}
+
+// goroutine runs f in a goroutine that shutdown waits for
+func (p *Peer) goroutine(f func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		f()
+	}()
+}
+
+// shutdown stops the peer, sending a Cease NOTIFICATION message with the
+// given subcode if it has a session, and waits for all of its goroutines to
+// exit
+func (p *Peer) shutdown(subcode int) {
+	p.do(func() {
+		p.fsm.stop(subcode)
+	})
+	p.stopOnce.Do(func() {
+		close(p.done)
+	})
+	p.wg.Wait()
+	if p.group != nil {
+		p.group.leave(p)
+	}
+}
+
+// handle feeds an event to the FSM, after dropping it if it is out of date
+// and doing the work that comes before it
+func (p *Peer) handle(e fsmEvent) {
+	if e.do != nil {
+		e.do()
+		return
+	}
+	if t := p.fsm.timer(e.event); t != nil {
+		if !t.Expired() {
+			// Restarted or stopped after it fired
+			return
+		}
+		// Only the latest expiry counts
+		t.Stop()
+		p.fsm.event(e.event)
+		return
+	}
+	if e.dial != nil {
+		if e.dial.Err() != nil {
+			// The FSM has given up on this connection attempt
+			if e.conn != nil {
+				e.conn.Close()
+			}
+			return
+		}
+		if e.event == TCPCRAcked {
+			p.connected(e.conn)
+			return
+		}
+		p.fsm.event(e.event)
+		return
+	}
+	if e.event == TCPConnectionConfirmed {
+		p.accept(e.conn, e.open)
+		return
+	}
+	if e.conn != nil && !p.current(e.conn) {
+		// The connection has been dropped since
+		return
+	}
+	switch e.event {
+	case BGPOpen:
+		p.receiveOpen(e.open)
+	case UpdateMsg:
+		p.receiveUpdate(e.body)
+	case NotifMsg:
+		p.receiveNotification(e.body)
+	case KeepAliveMsg:
+		p.receiveKeepalive(e.body)
+	case BGPHeaderErr, BGPOpenMsgErr:
+		log.Println("failed to read message from", p, e.err)
+		p.notify(e.err)
+		p.fsm.event(e.event)
+	default:
+		p.fsm.event(e.event)
+	}
+}
@@ -0,0 +1,138 @@
+package kbgp
+
+import (
+	"math/rand"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// flap plays a peer that brings the session up on conn and drops it again
+// a little later, sometimes with a NOTIFICATION message
+func flap(conn net.Conn, remote *Peer, dialed bool) {
+	defer conn.Close()
+	if dialed {
+		writeMessage(conn, open, newOpen(remote))
+		writeMessage(conn, keepalive, newKeepalive())
+	}
+	if _, err := readOpenMessage(conn); err != nil {
+		return
+	}
+	if !dialed {
+		writeMessage(conn, open, newOpen(remote))
+		writeMessage(conn, keepalive, newKeepalive())
+	}
+	conn.SetDeadline(time.Now().Add(time.Duration(rand.Intn(50)) * time.Millisecond))
+	for {
+		if _, _, err := readHeader(conn); err != nil {
+			break
+		}
+	}
+	if rand.Intn(2) == 0 {
+		conn.SetDeadline(time.Time{})
+		writeMessage(conn, notification, newNotification(newBGPError(cease, administrativeReset, "")))
+	}
+}
+
+// accept plays the peer for every connection made to ln
+func acceptFlapping(ln net.Listener, remote *Peer) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go flap(conn, remote, false)
+	}
+}
+
+func TestFlappingPeers(t *testing.T) {
+	s := NewSpeaker(65000, "127.0.0.1:0")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConnection(conn)
+		}
+	}()
+
+	const count = 20
+	peers := make([]*Peer, count)
+	remotes := make([]*Peer, count)
+	// Each peer has an address of its own, which is how the speaker tells
+	// them apart
+	addrs := make([]net.IP, count)
+	for i := range peers {
+		addrs[i] = net.IPv4(127, 0, 0, byte(i+1))
+		remoteLn, p := listenOn(t, addrs[i].String())
+		p.remoteAS = asn(65001 + i)
+		p.SetConnectRetryTime(10 * time.Millisecond)
+		if err := s.AddPeer(p); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		peers[i] = p
+
+		remote := NewPeer(65000, net.ParseIP("127.0.0.1"))
+		remote.myAS = asn(65001 + i)
+		remote.myID = newIdentifier(net.IPv4(10, 0, 0, byte(i+1)))
+		remotes[i] = remote
+		go acceptFlapping(remoteLn, remote)
+	}
+
+	// Start, stop and connect to peers at random while they flap
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		i := rand.Intn(count)
+		switch rand.Intn(4) {
+		case 0:
+			peers[i].Down()
+		case 1:
+			dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: addrs[i]}}
+			conn, err := dialer.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal("Unexpected error", err)
+			}
+			go flap(conn, remotes[i], true)
+		default:
+			peers[i].Up()
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, p := range peers {
+		p.Down()
+		waitForState(t, p.fsm, idle)
+	}
+}
+
+func TestPeerStartedBySpeaker(t *testing.T) {
+	before := runtime.NumGoroutine()
+	peers := make([]*Peer, 100)
+	for i := range peers {
+		peers[i] = NewPeer(65001, net.IPv4(192, 0, 2, byte(i+1)))
+		peers[i].SetHoldTime(30 * time.Second)
+	}
+	// Peers that are only created, or only carry settings, run nothing
+	if n := runtime.NumGoroutine() - before; n >= len(peers) {
+		t.Errorf("Expected no goroutines for peers not added to a speaker got %d", n)
+	}
+	if peers[0].sessionTimers().hold() != 30*time.Second {
+		t.Error("Expected the setting to be changed before the peer is added")
+	}
+
+	s := NewSpeaker(65000, "", WithRouterID(net.ParseIP("192.0.2.254")))
+	startSpeaker(t, s)
+	addPeer(t, s, peers[0])
+	var holdTime time.Duration
+	peers[0].do(func() { holdTime = peers[0].sessionTimers().hold() })
+	if holdTime != 30*time.Second {
+		t.Errorf("Expected a hold time of 30s got %s", holdTime)
+	}
+}
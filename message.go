@@ -2,10 +2,10 @@ package kbgp
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net"
 
 	"github.com/transitorykris/kbgp/stream"
 )
@@ -85,7 +85,7 @@ func (h msgHeader) length() int { return len(h.bytes()) }
 
 // String implements strings.Stringer
 func (h msgHeader) String() string {
-	return fmt.Sprintf("Message length: %d type: %s", h.length, h.msgType)
+	return fmt.Sprintf("Message length: %d type: %s", h.msgLength, h.msgType)
 }
 
 const markerLength = 16
@@ -93,9 +93,16 @@ const lengthLength = 2
 const typeLength = 1
 const messageHeaderLength = markerLength + lengthLength + typeLength
 
+// The maximum message size is 4096 octets
+// https://tools.ietf.org/html/rfc4271#section-4
+const maxMessageLength = 4096
+
 func readHeader(r io.Reader) (msgHeader, []byte, error) {
 	log.Println("Reading message header")
-	rawHeader := stream.Read(r, messageHeaderLength)
+	rawHeader, err := stream.Read(r, messageHeaderLength)
+	if err != nil {
+		return msgHeader{}, nil, err
+	}
 	log.Println("Got raw header")
 	buf := bytes.NewBuffer(rawHeader)
 
@@ -108,12 +115,33 @@ func readHeader(r io.Reader) (msgHeader, []byte, error) {
 	log.Println("Got header", header)
 
 	// Read in the message's body
-	body := stream.Read(r, int(header.msgLength)-messageHeaderLength)
+	// Make sure a bad length can't send us off reading garbage
+	if header.msgLength < messageHeaderLength || header.msgLength > maxMessageLength {
+		return header, nil, newBGPError(messageHeaderError, badMessageLength,
+			string(uint16ToBytes(header.msgLength)))
+	}
+	body, err := stream.Read(r, int(header.msgLength)-messageHeaderLength)
+	if err != nil {
+		return msgHeader{}, nil, err
+	}
 
 	log.Println("read body")
 	return header, body, nil
 }
 
+// readOpenMessage reads the first message of a session, which must be an
+// OPEN message
+func readOpenMessage(r io.Reader) (openMsg, error) {
+	header, body, err := readHeader(r)
+	if err != nil {
+		return openMsg{}, err
+	}
+	if header.msgType != open {
+		return openMsg{}, newBGPError(fsmError, 0, "expected an OPEN message")
+	}
+	return readOpen(body)
+}
+
 // https://tools.ietf.org/html/rfc4271#section-4.2
 type openMsg struct {
 	version       uint8
@@ -132,10 +160,34 @@ func (o openMsg) String() string {
 
 const minOpenMessageLength = 29
 
-type parameter struct{}
+// The OPEN message fields before the Optional Parameters
+const minOpenBodyLength = minOpenMessageLength - messageHeaderLength
+
+// Each optional parameter is represented by a <Parameter Type,
+// Parameter Length, Parameter Value> triplet.
+type parameter struct {
+	parameterType uint8
+	value         []byte
+}
+
+// Optional Parameter Types
+// https://tools.ietf.org/html/rfc5492#section-4
+const capabilitiesParameter = 2
+
+// bytes implements byter
+func (p parameter) bytes() []byte {
+	return append([]byte{p.parameterType, byte(len(p.value))}, p.value...)
+}
+
+// length implements byter
+func (p parameter) length() int { return len(p.bytes()) }
 
 func readOpen(msg []byte) (openMsg, error) {
 	log.Println("Reading OPEN message")
+	if len(msg) < minOpenBodyLength {
+		return openMsg{}, newBGPError(messageHeaderError, badMessageLength,
+			"open message is too short")
+	}
 	buf := bytes.NewBuffer(msg)
 	om := openMsg{
 		version:       stream.ReadByte(buf),
@@ -145,20 +197,62 @@ func readOpen(msg []byte) (openMsg, error) {
 		optParmLen:    stream.ReadByte(buf),
 	}
 	log.Println("Got OPEN message:", om)
-	// TODO: Implement optional parameter parsing
-	_ = stream.ReadBytes(int(om.optParmLen), buf)
+	if int(om.optParmLen) != buf.Len() {
+		return openMsg{}, newBGPError(openMessageError, 0,
+			"optional parameters length does not match the message")
+	}
+	params, err := readParameters(stream.ReadBytes(int(om.optParmLen), buf))
+	if err != nil {
+		return openMsg{}, err
+	}
+	om.optParamaters = params
 	return om, nil
 }
 
+func readParameters(b []byte) ([]parameter, error) {
+	params := []parameter{}
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, newBGPError(openMessageError, 0, "malformed optional parameter")
+		}
+		p := parameter{parameterType: b[0], value: make([]byte, b[1])}
+		copy(p.value, b[2:])
+		params = append(params, p)
+		b = b[2+int(b[1]):]
+	}
+	return params, nil
+}
+
+// capabilities returns every capability advertised in the OPEN message
+func (o openMsg) capabilities() ([]capability, error) {
+	var caps []capability
+	for _, p := range o.optParamaters {
+		if p.parameterType != capabilitiesParameter {
+			continue
+		}
+		c, err := readCapabilities(p.value)
+		if err != nil {
+			return nil, err
+		}
+		caps = append(caps, c...)
+	}
+	return caps, nil
+}
+
 func newOpen(p *Peer) openMsg {
 	o := openMsg{
 		version:       version,
-		as:            p.myAS,
-		holdTime:      uint16(defaultHoldTime.Seconds()),     //TODO: make configurable
-		bgpIdentifier: newIdentifier(net.ParseIP("1.2.3.4")), //TODO: make configurable
-		optParmLen:    0,
+		as:            p.myAS.mappable(),
+		holdTime:      uint16(p.sessionTimers().hold().Seconds()),
+		bgpIdentifier: p.myID,
 		optParamaters: []parameter{},
 	}
+	if caps := p.localCapabilities(); len(caps) > 0 {
+		o.optParamaters = append(o.optParamaters, newCapabilitiesParameter(caps))
+	}
+	for _, param := range o.optParamaters {
+		o.optParmLen += uint8(param.length())
+	}
 	log.Println("Open message:", o)
 	return o
 }
@@ -167,11 +261,15 @@ func newOpen(p *Peer) openMsg {
 func (o openMsg) bytes() []byte {
 	buf := bytes.NewBuffer([]byte{})
 	buf.WriteByte(o.version)
-	buf.Write(o.as.bytes())
+	buf.Write(o.as.twoOctetBytes())
 	buf.Write(uint16ToBytes(o.holdTime))
 	buf.Write(o.bgpIdentifier.bytes())
-	buf.WriteByte(0) // TODO: implement parameters
-	// write optParameters []parameter
+	params := []byte{}
+	for _, p := range o.optParamaters {
+		params = append(params, p.bytes()...)
+	}
+	buf.WriteByte(byte(len(params)))
+	buf.Write(params)
 	return buf.Bytes()
 }
 
@@ -236,6 +334,7 @@ const (
 	unsupportedOptionalParameter
 	_ // 5 is deprecated
 	unacceptableHoldTime
+	unsupportedCapability // https://tools.ietf.org/html/rfc5492#section-5
 )
 
 var openMessageErrorLookup = map[uint8]string{
@@ -244,6 +343,7 @@ var openMessageErrorLookup = map[uint8]string{
 	badBGPIdentifier:             "Bad BGP Identifier",
 	unsupportedOptionalParameter: "Unsupported Optional Parameter",
 	unacceptableHoldTime:         "Unacceptable Hold Time",
+	unsupportedCapability:        "Unsupported Capability",
 }
 
 const (
@@ -274,6 +374,31 @@ var updateMessageErrorLookup = map[uint8]string{
 	malformedASPath:                "Malformed AS_PATH",
 }
 
+// Cease NOTIFICATION message subcodes
+// https://tools.ietf.org/html/rfc4486#section-4
+const (
+	_ = iota
+	maximumNumberOfPrefixesReached
+	administrativeShutdown
+	peerDeconfigured
+	administrativeReset
+	connectionRejected
+	otherConfigurationChange
+	connectionCollisionResolution
+	outOfResources
+)
+
+var ceaseLookup = map[uint8]string{
+	maximumNumberOfPrefixesReached: "Maximum Number of Prefixes Reached",
+	administrativeShutdown:         "Administrative Shutdown",
+	peerDeconfigured:               "Peer De-configured",
+	administrativeReset:            "Administrative Reset",
+	connectionRejected:             "Connection Rejected",
+	otherConfigurationChange:       "Other Configuration Change",
+	connectionCollisionResolution:  "Connection Collision Resolution",
+	outOfResources:                 "Out of Resources",
+}
+
 type notificationMsg struct {
 	code    uint8
 	subcode uint8
@@ -281,7 +406,10 @@ type notificationMsg struct {
 }
 
 func newNotification(err error) notificationMsg {
-	return notificationMsg{uint8(err.(bgpError).code), uint8(err.(bgpError).subcode), []byte(err.(bgpError).message)}
+	// UPDATE message errors wrap the bgpError that describes them
+	var e bgpError
+	errors.As(err, &e)
+	return notificationMsg{uint8(e.code), uint8(e.subcode), []byte(e.message)}
 }
 
 // bytes implements byter
@@ -304,7 +432,7 @@ func newKeepalive() keepaliveMsg {
 
 func readKeepalive(msg []byte) error {
 	if len(msg) != 0 {
-		newBGPError(messageHeaderError, badMessageLength, "a keepalive should not come with data")
+		return newBGPError(messageHeaderError, badMessageLength, "a keepalive should not come with data")
 	}
 	return nil
 }
@@ -339,32 +467,11 @@ func (n notificationMsg) String() string {
 		subcode = openMessageErrorLookup[n.subcode]
 	case updateMessageError:
 		subcode = updateMessageErrorLookup[n.subcode]
+	case cease:
+		subcode = ceaseLookup[n.subcode]
 	default:
 		subcode = "unknown"
 	}
 	return fmt.Sprintf("%s (%d) %s (%d) %s",
 		errorCodeLookup[n.code], n.code, subcode, n.subcode, string(n.data))
 }
-
-type updateMsg struct{}
-
-func newUpdate() updateMsg {
-	//TODO: Implement me
-	return updateMsg{}
-}
-
-func readUpdate(msg []byte) (updateMsg, error) {
-	return updateMsg{}, nil
-}
-
-// bytes implements byter
-func (u updateMsg) bytes() []byte {
-	//TODO: Implement me
-	return nil
-}
-
-// String implements strings.Stringer
-func (u updateMsg) String() string {
-	//TODO: Implement me
-	return ""
-}
@@ -0,0 +1,335 @@
+package kbgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+)
+
+// Multiprotocol Extensions for BGP-4
+// https://tools.ietf.org/html/rfc4760
+
+// Address Family Identifier
+// https://www.iana.org/assignments/address-family-numbers
+type afi uint16
+
+const (
+	afiIPv4 afi = 1
+	afiIPv6 afi = 2
+)
+
+var afiLookup = map[afi]string{
+	afiIPv4: "IPv4",
+	afiIPv6: "IPv6",
+}
+
+// String implements strings.Stringer
+func (a afi) String() string {
+	name, ok := afiLookup[a]
+	if !ok {
+		return fmt.Sprintf("AFI(%d)", uint16(a))
+	}
+	return name
+}
+
+// addrLength is the length in octets of an address in this family
+func (a afi) addrLength() int {
+	if a == afiIPv6 {
+		return 16
+	}
+	return 4
+}
+
+// Subsequent Address Family Identifier
+// https://www.iana.org/assignments/safi-namespace
+type safi uint8
+
+const safiUnicast safi = 1
+
+var safiLookup = map[safi]string{
+	safiUnicast: "unicast",
+}
+
+// String implements strings.Stringer
+func (s safi) String() string {
+	name, ok := safiLookup[s]
+	if !ok {
+		return fmt.Sprintf("SAFI(%d)", uint8(s))
+	}
+	return name
+}
+
+// An addressFamily is the AFI/SAFI pair that identifies the kind of routes
+// being exchanged
+type addressFamily struct {
+	afi  afi
+	safi safi
+}
+
+// Address families that can be enabled on a Peer
+var (
+	IPv4Unicast = addressFamily{afiIPv4, safiUnicast}
+	IPv6Unicast = addressFamily{afiIPv6, safiUnicast}
+)
+
+// String implements strings.Stringer
+func (f addressFamily) String() string {
+	return f.afi.String() + " " + f.safi.String()
+}
+
+// supported returns true if this speaker knows how to carry routes for
+// the address family
+func (f addressFamily) supported() bool {
+	return f == IPv4Unicast || f == IPv6Unicast
+}
+
+// Capability Code for Multiprotocol Extensions
+const multiprotocolCapabilityCode = 1
+
+// A speaker advertises one Multiprotocol Extensions capability for each
+// address family it is willing to exchange routes for.
+// https://tools.ietf.org/html/rfc4760#section-8
+type multiprotocolCapability struct {
+	family addressFamily
+}
+
+func init() {
+	registerCapability(multiprotocolCapabilityCode, readMultiprotocolCapability)
+}
+
+func readMultiprotocolCapability(value []byte) (capability, error) {
+	if len(value) != 4 {
+		return nil, newBGPError(openMessageError, 0, "malformed multiprotocol capability")
+	}
+	return multiprotocolCapability{addressFamily{
+		afi:  afi(binary.BigEndian.Uint16(value)),
+		safi: safi(value[3]),
+	}}, nil
+}
+
+// code implements capability
+func (c multiprotocolCapability) code() uint8 { return multiprotocolCapabilityCode }
+
+// matches implements capability
+func (c multiprotocolCapability) matches(remote capability) bool {
+	r, ok := remote.(multiprotocolCapability)
+	return ok && r.family == c.family
+}
+
+// bytes implements byter
+func (c multiprotocolCapability) bytes() []byte {
+	return append(uint16ToBytes(uint16(c.family.afi)), 0, byte(c.family.safi))
+}
+
+// length implements byter
+func (c multiprotocolCapability) length() int { return len(c.bytes()) }
+
+// String implements strings.Stringer
+func (c multiprotocolCapability) String() string {
+	return fmt.Sprintf("%s %s", capabilityString(c), c.family)
+}
+
+// EnableFamilies sets the address families to exchange routes for with
+// this peer. IPv4 unicast is enabled by default.
+func (p *Peer) EnableFamilies(families ...addressFamily) {
+	p.configure(func() { p.settings.families = families })
+}
+
+// negotiatedFamilies returns the address families both sides of the
+// session have agreed to exchange routes for. A peer that advertises no
+// Multiprotocol Extensions capabilities only supports IPv4 unicast.
+func (p *Peer) negotiatedFamilies() []addressFamily {
+	remoteMP := false
+	for _, c := range p.remoteCapabilities {
+		if c.code() == multiprotocolCapabilityCode {
+			remoteMP = true
+		}
+	}
+	families := []addressFamily{}
+	for _, f := range p.families {
+		if !remoteMP && f == IPv4Unicast {
+			families = append(families, f)
+			continue
+		}
+		for _, c := range p.negotiatedCapabilities(multiprotocolCapabilityCode) {
+			if c.(multiprotocolCapability).family == f {
+				families = append(families, f)
+			}
+		}
+	}
+	return families
+}
+
+// familyNegotiated returns true if routes for the family can be exchanged
+// on this session
+func (p *Peer) familyNegotiated(f addressFamily) bool {
+	for _, n := range p.negotiatedFamilies() {
+		if n == f {
+			return true
+		}
+	}
+	return false
+}
+
+// MP_REACH_NLRI is an optional non-transitive attribute used to advertise
+// feasible routes for any address family, along with the next hop to use
+// for them.
+type mpReachNLRIAttr struct {
+	family  addressFamily
+	nextHop netip.Addr
+	// For IPv6 the next hop can carry a link-local address as well as
+	// the global one
+	// https://tools.ietf.org/html/rfc2545#section-3
+	linkLocal netip.Addr
+	nlri      []netip.Prefix
+}
+
+func readMPReachNLRI(b []byte) (*mpReachNLRIAttr, error) {
+	if len(b) < 5 {
+		return nil, newUpdateError(sessionReset, optionalAttributeError, "truncated MP_REACH_NLRI")
+	}
+	m := &mpReachNLRIAttr{family: addressFamily{afi(binary.BigEndian.Uint16(b)), safi(b[2])}}
+	if !m.family.supported() {
+		return m, nil
+	}
+	nextHopLength := int(b[3])
+	if len(b) < 5+nextHopLength {
+		return nil, newUpdateError(sessionReset, optionalAttributeError, "truncated MP_REACH_NLRI")
+	}
+	nextHops := b[4 : 4+nextHopLength]
+	addrLength := m.family.afi.addrLength()
+	// If the Length of Next Hop Network Address field of the MP_REACH
+	// attribute is inconsistent with that which was expected, the
+	// attribute is considered malformed.  Since the next hop precedes
+	// the NLRI field in the attribute, in this case it will not be
+	// possible to reliably locate the NLRI; thus, the "session reset"
+	// approach MUST be used.
+	// https://tools.ietf.org/html/rfc7606#section-7.11
+	switch {
+	case nextHopLength == addrLength:
+	case nextHopLength == 2*addrLength && m.family.afi == afiIPv6:
+		m.linkLocal, _ = netip.AddrFromSlice(nextHops[addrLength:])
+	default:
+		return nil, newUpdateError(sessionReset, optionalAttributeError, "bad next hop length")
+	}
+	m.nextHop, _ = netip.AddrFromSlice(nextHops[:addrLength])
+	// The octet after the next hop is reserved
+	nlri, err := readPrefixes(b[5+nextHopLength:], m.family.afi)
+	if err != nil {
+		return nil, err
+	}
+	m.nlri = nlri
+	return m, nil
+}
+
+// bytes implements byter
+func (m mpReachNLRIAttr) bytes() []byte {
+	buf := bytes.NewBuffer([]byte{})
+	buf.Write(uint16ToBytes(uint16(m.family.afi)))
+	buf.WriteByte(byte(m.family.safi))
+	nextHops := m.nextHop.AsSlice()
+	if m.linkLocal.IsValid() {
+		nextHops = append(nextHops, m.linkLocal.AsSlice()...)
+	}
+	buf.WriteByte(byte(len(nextHops)))
+	buf.Write(nextHops)
+	buf.WriteByte(0)
+	buf.Write(prefixesBytes(m.nlri))
+	return buf.Bytes()
+}
+
+// length implements byter
+func (m mpReachNLRIAttr) length() int { return len(m.bytes()) }
+
+// String implements strings.Stringer
+func (m mpReachNLRIAttr) String() string {
+	nextHop := m.nextHop.String()
+	if m.linkLocal.IsValid() {
+		nextHop += "," + m.linkLocal.String()
+	}
+	return fmt.Sprintf("%s NEXT_HOP:%s NLRI:%v", m.family, nextHop, m.nlri)
+}
+
+// validNextHop checks the next hop is something we could forward to
+func (m mpReachNLRIAttr) validNextHop() bool {
+	if m.linkLocal.IsValid() && !m.linkLocal.IsLinkLocalUnicast() {
+		return false
+	}
+	return m.nextHop.IsGlobalUnicast() || m.nextHop.IsLinkLocalUnicast()
+}
+
+// MP_UNREACH_NLRI is an optional non-transitive attribute used to withdraw
+// routes for any address family.
+type mpUnreachNLRIAttr struct {
+	family    addressFamily
+	withdrawn []netip.Prefix
+}
+
+func readMPUnreachNLRI(b []byte) (*mpUnreachNLRIAttr, error) {
+	if len(b) < 3 {
+		return nil, newUpdateError(sessionReset, optionalAttributeError, "truncated MP_UNREACH_NLRI")
+	}
+	m := &mpUnreachNLRIAttr{family: addressFamily{afi(binary.BigEndian.Uint16(b)), safi(b[2])}}
+	if !m.family.supported() {
+		return m, nil
+	}
+	withdrawn, err := readPrefixes(b[3:], m.family.afi)
+	if err != nil {
+		return nil, err
+	}
+	m.withdrawn = withdrawn
+	return m, nil
+}
+
+// bytes implements byter
+func (m mpUnreachNLRIAttr) bytes() []byte {
+	buf := bytes.NewBuffer([]byte{})
+	buf.Write(uint16ToBytes(uint16(m.family.afi)))
+	buf.WriteByte(byte(m.family.safi))
+	buf.Write(prefixesBytes(m.withdrawn))
+	return buf.Bytes()
+}
+
+// length implements byter
+func (m mpUnreachNLRIAttr) length() int { return len(m.bytes()) }
+
+// String implements strings.Stringer
+func (m mpUnreachNLRIAttr) String() string {
+	return fmt.Sprintf("%s WITHDRAWN:%v", m.family, m.withdrawn)
+}
+
+// routes returns every prefix an UPDATE message advertises and withdraws,
+// whether carried in the NLRI fields or in the multiprotocol attributes
+func (u updateMsg) routes(attrs pathAttributes) (advertised []netip.Prefix, withdrawn []netip.Prefix) {
+	advertised = append(advertised, u.nlri...)
+	withdrawn = append(withdrawn, u.withdrawnRoutes...)
+	if attrs.mpReach != nil {
+		advertised = append(advertised, attrs.mpReach.nlri...)
+	}
+	if attrs.mpUnreach != nil {
+		withdrawn = append(withdrawn, attrs.mpUnreach.withdrawn...)
+	}
+	return advertised, withdrawn
+}
+
+// validateFamilies discards multiprotocol attributes for address families
+// that were not negotiated on this session
+func (p *Peer) validateFamilies(attrs *pathAttributes) error {
+	var errs []error
+	if attrs.mpReach != nil && !p.familyNegotiated(attrs.mpReach.family) {
+		log.Println("Ignoring MP_REACH_NLRI for", attrs.mpReach.family, "from", p)
+		attrs.mpReach = nil
+		delete(attrs.present, mpReachNLRI)
+		errs = append(errs, newUpdateError(attributeDiscard, optionalAttributeError, "address family not negotiated"))
+	}
+	if attrs.mpUnreach != nil && !p.familyNegotiated(attrs.mpUnreach.family) {
+		log.Println("Ignoring MP_UNREACH_NLRI for", attrs.mpUnreach.family, "from", p)
+		attrs.mpUnreach = nil
+		delete(attrs.present, mpUnreachNLRI)
+		errs = append(errs, newUpdateError(attributeDiscard, optionalAttributeError, "address family not negotiated"))
+	}
+	return errors.Join(errs...)
+}
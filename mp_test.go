@@ -0,0 +1,263 @@
+package kbgp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestMultiprotocolCapability(t *testing.T) {
+	c := multiprotocolCapability{IPv6Unicast}
+	if !bytes.Equal(c.bytes(), []byte{0, 2, 0, 1}) {
+		t.Errorf("Unexpected encoding %v", c.bytes())
+	}
+	read, err := readMultiprotocolCapability(c.bytes())
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if read != c {
+		t.Errorf("Expected %v got %v", c, read)
+	}
+	if c.matches(multiprotocolCapability{IPv4Unicast}) {
+		t.Error("Did not expect different families to match")
+	}
+	if _, err := readMultiprotocolCapability([]byte{0, 2, 0}); err == nil {
+		t.Error("Expected a short capability to fail")
+	}
+}
+
+func TestNegotiatedFamilies(t *testing.T) {
+	cases := map[string]struct {
+		local    []addressFamily
+		remote   []capability
+		expected []addressFamily
+	}{
+		"peer without multiprotocol": {
+			[]addressFamily{IPv4Unicast, IPv6Unicast},
+			[]capability{fourOctetASCapability{65001}},
+			[]addressFamily{IPv4Unicast},
+		},
+		"both families": {
+			[]addressFamily{IPv4Unicast, IPv6Unicast},
+			[]capability{multiprotocolCapability{IPv6Unicast}, multiprotocolCapability{IPv4Unicast}},
+			[]addressFamily{IPv4Unicast, IPv6Unicast},
+		},
+		"IPv6 only peer": {
+			[]addressFamily{IPv4Unicast, IPv6Unicast},
+			[]capability{multiprotocolCapability{IPv6Unicast}},
+			[]addressFamily{IPv6Unicast},
+		},
+		"not enabled locally": {
+			[]addressFamily{IPv4Unicast},
+			[]capability{multiprotocolCapability{IPv4Unicast}, multiprotocolCapability{IPv6Unicast}},
+			[]addressFamily{IPv4Unicast},
+		},
+	}
+	for name, c := range cases {
+		p := NewPeer(65001, net.ParseIP("192.0.2.1"))
+		p.EnableFamilies(c.local...)
+		p.negotiate(c.remote)
+		families := p.negotiatedFamilies()
+		if len(families) != len(c.expected) {
+			t.Errorf("%s: expected %v got %v", name, c.expected, families)
+			continue
+		}
+		for i := range families {
+			if families[i] != c.expected[i] {
+				t.Errorf("%s: expected %v got %v", name, c.expected, families)
+			}
+		}
+	}
+}
+
+func TestMPReachNLRIRoundTrip(t *testing.T) {
+	cases := map[string]mpReachNLRIAttr{
+		"global next hop": {
+			family:  IPv6Unicast,
+			nextHop: netip.MustParseAddr("2001:db8::1"),
+			nlri:    []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/48"), netip.MustParsePrefix("2001:db8:2::/64")},
+		},
+		"link-local next hop": {
+			family:    IPv6Unicast,
+			nextHop:   netip.MustParseAddr("2001:db8::1"),
+			linkLocal: netip.MustParseAddr("fe80::1"),
+			nlri:      []netip.Prefix{netip.MustParsePrefix("::/0")},
+		},
+		"IPv4": {
+			family:  IPv4Unicast,
+			nextHop: netip.MustParseAddr("192.0.2.1"),
+			nlri:    []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		},
+	}
+	for name, c := range cases {
+		read, err := readMPReachNLRI(c.bytes())
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if read.String() != c.String() {
+			t.Errorf("%s: expected %s got %s", name, c, read)
+		}
+	}
+}
+
+func TestMPUnreachNLRIRoundTrip(t *testing.T) {
+	m := mpUnreachNLRIAttr{IPv6Unicast, []netip.Prefix{netip.MustParsePrefix("2001:db8::/32")}}
+	if !bytes.Equal(m.bytes(), []byte{0, 2, 1, 32, 0x20, 0x01, 0x0d, 0xb8}) {
+		t.Errorf("Unexpected encoding %v", m.bytes())
+	}
+	read, err := readMPUnreachNLRI(m.bytes())
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if read.String() != m.String() {
+		t.Errorf("Expected %s got %s", m, read)
+	}
+}
+
+func TestMPAttributeErrors(t *testing.T) {
+	cases := map[string]struct {
+		attribute pathAttribute
+		action    errorAction
+		subcode   int
+	}{
+		"bad next hop length": {
+			rawAttribute(optional, mpReachNLRI, 0, 2, 1, 4, 192, 0, 2, 1, 0),
+			sessionReset, optionalAttributeError,
+		},
+		"truncated": {
+			rawAttribute(optional, mpReachNLRI, 0, 2, 1, 16, 0),
+			sessionReset, optionalAttributeError,
+		},
+		"prefix too long": {
+			rawAttribute(optional, mpUnreachNLRI, 0, 2, 1, 129),
+			sessionReset, invalidNetworkField,
+		},
+		"multicast next hop": {
+			rawAttribute(optional, mpReachNLRI, append(append([]byte{0, 2, 1, 16},
+				netip.MustParseAddr("ff02::1").AsSlice()...), 0)...),
+			treatAsWithdraw, invalidNextHopAttribute,
+		},
+		"bad flags": {
+			rawAttribute(optional|transitive, mpUnreachNLRI, 0, 2, 1),
+			sessionReset, attributeFlagsError,
+		},
+	}
+	for name, c := range cases {
+		_, err := newPathAttributes([]pathAttribute{c.attribute}, true)
+		var e bgpError
+		if !errors.As(err, &e) || e.subcode != c.subcode {
+			t.Errorf("%s: expected subcode %d got %v", name, c.subcode, err)
+		}
+		if updateErrorAction(err) != c.action {
+			t.Errorf("%s: expected %s got %s", name, errorActionLookup[c.action], errorActionLookup[updateErrorAction(err)])
+		}
+	}
+}
+
+func TestDuplicateMPReachResets(t *testing.T) {
+	a := rawAttribute(optional, mpUnreachNLRI, 0, 2, 1)
+	b := append(a.bytes(), a.bytes()...)
+	_, err := readPathAttributes(b)
+	if updateErrorAction(err) != sessionReset {
+		t.Errorf("Expected a duplicate MP_UNREACH_NLRI to reset the session, got %v", err)
+	}
+}
+
+func TestValidateMPReach(t *testing.T) {
+	mp := &mpReachNLRIAttr{
+		family:  IPv6Unicast,
+		nextHop: netip.MustParseAddr("2001:db8::1"),
+		nlri:    []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/48")},
+	}
+	attrs := pathAttributes{present: map[uint8]bool{origin: true, asPath: true}, mpReach: mp}
+	if err := attrs.validate(false); err != nil {
+		t.Error("Did not expect NEXT_HOP to be required with MP_REACH_NLRI", err)
+	}
+	attrs.present[asPath] = false
+	if updateErrorAction(attrs.validate(false)) != treatAsWithdraw {
+		t.Error("Expected AS_PATH to be required with MP_REACH_NLRI")
+	}
+}
+
+func TestValidateFamilies(t *testing.T) {
+	p := NewPeer(65001, net.ParseIP("192.0.2.1"))
+	p.EnableFamilies(IPv4Unicast, IPv6Unicast)
+	p.negotiate([]capability{multiprotocolCapability{IPv4Unicast}})
+	attrs := pathAttributes{
+		present: map[uint8]bool{mpReachNLRI: true, mpUnreachNLRI: true},
+		mpReach: &mpReachNLRIAttr{
+			family:  IPv6Unicast,
+			nextHop: netip.MustParseAddr("2001:db8::1"),
+			nlri:    []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/48")},
+		},
+		mpUnreach: &mpUnreachNLRIAttr{IPv6Unicast, []netip.Prefix{netip.MustParsePrefix("2001:db8:2::/48")}},
+	}
+	err := p.validateFamilies(&attrs)
+	if attrs.mpReach != nil || attrs.mpUnreach != nil || attrs.present[mpReachNLRI] || attrs.present[mpUnreachNLRI] {
+		t.Error("Expected both attributes to be discarded")
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok || len(joined.Unwrap()) != 2 {
+		t.Errorf("Expected an error for each attribute got %v", err)
+	}
+	if updateErrorAction(err) != attributeDiscard {
+		t.Errorf("Expected the attributes to be discarded got %v", err)
+	}
+}
+
+func TestIPv6Update(t *testing.T) {
+	p := NewPeer(65001, net.ParseIP("2001:db8::2"))
+	p.myAS = 65000
+	p.EnableFamilies(IPv4Unicast, IPv6Unicast)
+	p.negotiate([]capability{multiprotocolCapability{IPv6Unicast}, fourOctetASCapability{65001}})
+
+	sent := pathAttributes{
+		present: map[uint8]bool{origin: true, asPath: true},
+		asPath:  asPathAttr{sequence(65001)},
+		mpReach: &mpReachNLRIAttr{
+			family:    IPv6Unicast,
+			nextHop:   netip.MustParseAddr("2001:db8::2"),
+			linkLocal: netip.MustParseAddr("fe80::2"),
+			nlri:      []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/48")},
+		},
+		mpUnreach: &mpUnreachNLRIAttr{IPv6Unicast, []netip.Prefix{netip.MustParsePrefix("2001:db8:2::/48")}},
+	}
+	u, err := readUpdate(newUpdate(nil, sent.raw(true), nil).bytes())
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	attrs, err := p.validateUpdate(u)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	advertised, withdrawn := u.routes(attrs)
+	if len(advertised) != 1 || advertised[0] != sent.mpReach.nlri[0] {
+		t.Errorf("Unexpected advertised routes %v", advertised)
+	}
+	if len(withdrawn) != 1 || withdrawn[0] != sent.mpUnreach.withdrawn[0] {
+		t.Errorf("Unexpected withdrawn routes %v", withdrawn)
+	}
+	if attrs.mpReach.linkLocal != sent.mpReach.linkLocal {
+		t.Errorf("Expected link-local next hop %s got %s", sent.mpReach.linkLocal, attrs.mpReach.linkLocal)
+	}
+
+	// Without IPv6 negotiated the routes are ignored
+	p.negotiate([]capability{multiprotocolCapability{IPv4Unicast}, fourOctetASCapability{65001}})
+	attrs, err = p.validateUpdate(u)
+	if updateErrorAction(err) != attributeDiscard {
+		t.Errorf("Expected attribute discard got %v", err)
+	}
+	if advertised, _ := u.routes(attrs); len(advertised) != 0 {
+		t.Errorf("Did not expect any routes got %v", advertised)
+	}
+}
+
+func TestNotificationFromUpdateError(t *testing.T) {
+	n := newNotification(errors.Join(newUpdateError(sessionReset, malformedAttributeList, "bad")))
+	if n.code != updateMessageError || n.subcode != malformedAttributeList || string(n.data) != "bad" {
+		t.Errorf("Unexpected notification %v", n)
+	}
+}
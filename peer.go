@@ -1,119 +1,489 @@
 package kbgp
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/transitorykris/kbgp/counter"
 )
 
 // Peer is a BGP neighbor
 type Peer struct {
 	myAS     asn
+	myID     bgpIdentifier
 	remoteAS asn
+	// The BGP Identifier in the peer's OPEN message
+	remoteID bgpIdentifier
 	remoteIP net.IP
 	conn     net.Conn
 	fsm      *fsm
+	// The speaker the peer belongs to, if any
+	speaker *Speaker
+	// Everything that happens to the FSM goes through here
+	events chan fsmEvent
+	// Set once the event loop has been started
+	started atomic.Bool
+	// Closed once the peer has been shut down
+	done     chan struct{}
+	stopOnce sync.Once
+	// The peer's goroutines
+	wg sync.WaitGroup
+
+	// Created by the speaker for a neighbor in a listen range, and only
+	// kept for as long as its session
+	dynamic bool
+	// Set while a connection that lost a collision is dropped, which ends
+	// the session but not the peer, since the new connection carries on
+	collided bool
+
+	// The interface a link-local remoteIP is reached through
+	zone string
+	// The port the peer listens on
+	remotePort int
+	// Where we connect to the peer from
+	localIP   net.IP
+	localPort int
+
+	// Routes learned from the peer
+	adjRIBIn *adjRIBIn
+	// Routes advertised to the peer, and changes to the Loc-RIB it has yet
+	// to be told about
+	adjRIBOut table
+	exports   *exports
+
+	// How many UPDATE message errors were handled with each RFC 7606
+	// approach
+	updateErrors map[errorAction]*counter.Counter
+
+	// Settings configured for this peer, overriding its group's
+	settings peerSettings
+	group    *PeerGroup
+	// The group's settings as the peer last took them on
+	groupSettings peerSettings
+
+	// Address families we are willing to exchange routes for
+	families []addressFamily
+
+	// Capabilities we advertise to this peer, those it advertised to us,
+	// and those both sides support
+	capabilities         []capability
+	remoteCapabilities   []capability
+	negotiated           []capability
+	requiredCapabilities []uint8
 }
 
 // NewPeer creates a new BGP neighbor
 func NewPeer(as asn, ip net.IP) *Peer {
 	p := &Peer{
-		remoteAS: as,
-		remoteIP: ip,
+		remoteAS:   as,
+		remoteIP:   ip,
+		remotePort: port,
+		families:   []addressFamily{IPv4Unicast},
+		updateErrors: map[errorAction]*counter.Counter{
+			attributeDiscard: counter.New(),
+			treatAsWithdraw:  counter.New(),
+			sessionReset:     counter.New(),
+		},
+		adjRIBIn:  newAdjRIBIn(),
+		adjRIBOut: table{},
+		exports:   newExports(),
+		events:    make(chan fsmEvent, eventQueueLength),
+		done:      make(chan struct{}),
 	}
 	p.fsm = newFSM(p)
+	p.adjRIBIn.changed = p.offer
 	return p
 }
 
 // String implements string.Stringer
 func (p *Peer) String() string {
-	return fmt.Sprintf("AS%d/%s", p.remoteAS, p.remoteIP)
+	ip := p.remoteIP.String()
+	if p.zone != "" {
+		ip += "%" + p.zone
+	}
+	return fmt.Sprintf("AS%d/%s", p.remoteAS, ip)
 }
 
+// SetZone sets the interface to reach a link-local IPv6 neighbor through
+func (p *Peer) SetZone(zone string) {
+	p.configure(func() {
+		p.identify(func() { p.zone = zone })
+	})
+}
+
+// identify changes what the peer's speaker finds it by. The speaker looks
+// through its peers holding only its own lock, so that is held as well as
+// the change being made in the event loop.
+func (p *Peer) identify(change func()) {
+	if p.speaker != nil {
+		p.speaker.mu.Lock()
+		defer p.speaker.mu.Unlock()
+	}
+	change()
+}
+
+// addr is the peer's TCP endpoint
+func (p *Peer) addr() *net.TCPAddr {
+	return &net.TCPAddr{IP: p.remoteIP, Port: p.remotePort, Zone: p.zone}
+}
+
+// matches returns true if a connection from addr is from this peer. A peer
+// without a zone matches its address on any interface.
+func (p *Peer) matches(addr net.Addr) bool {
+	ip, zone := splitAddr(addr)
+	if !p.remoteIP.Equal(ip) {
+		return false
+	}
+	return p.zone == "" || p.zone == zone
+}
+
+// handleConnection hands a connection the peer opened to us to the event
+// loop, once the speaker has read its OPEN message
 func (p *Peer) handleConnection(conn net.Conn, open openMsg) {
 	log.Println("handling connection for", open)
-	if p.conn != nil {
-		log.Println("connection collision detected")
-		// We have a connection already! Collision detection time
+	p.enqueue(fsmEvent{event: TCPConnectionConfirmed, conn: conn, open: open})
+}
+
+// accept takes over a connection the peer opened to us
+func (p *Peer) accept(conn net.Conn, open openMsg) {
+	if p.fsm.state == idle {
+		log.Println("refusing connection from idle peer", p)
+		conn.Close()
+		return
+	}
+	if p.conn != nil && !p.resolveCollision(conn, open) {
+		return
 	}
 	p.conn = conn
 	p.fsm.event(TCPConnectionConfirmed)
-	if err := p.validateOpen(open); err != nil {
-		log.Println("failed to validate open message", err)
-		p.fsm.event(BGPOpenMsgErr)
-		writeMessage(p.conn, notification, newNotification(err))
+	p.receiveOpen(open)
+	if p.current(conn) {
+		p.goroutine(func() { p.read(conn) })
+	}
+}
+
+// connected takes over a connection we opened to the peer
+func (p *Peer) connected(conn net.Conn) {
+	if p.conn != nil {
+		// The peer's connection got in first
+		log.Println("Already connected to", p, "dropping our connection")
 		conn.Close()
 		return
 	}
-	// TODO: should have a configured hold time, but hardcoding default for now
-	offeredHoldTime := time.Duration(open.holdTime) * time.Second
-	if offeredHoldTime < defaultHoldTime {
-		p.fsm.holdTime = offeredHoldTime
+	log.Println("Connected to", p)
+	p.conn = conn
+	p.fsm.event(TCPCRAcked)
+	if p.current(conn) {
+		p.goroutine(func() { p.read(conn) })
 	}
-	p.fsm.keepaliveTime = p.fsm.holdTime / 3
-	p.fsm.event(BGPOpen)
-	// Go into our inbound message processing loop
-	p.processInbound()
 }
 
-func (p *Peer) processInbound() {
+// sessionEstablished is called from the event loop when the FSM reaches
+// Established. The peer is sent every route it should know about.
+func (p *Peer) sessionEstablished() {
+	p.advertiseAll()
+}
+
+// sessionEnded is called from the event loop when the FSM falls back to
+// Idle. A dynamic peer goes with the session, unless the session is being
+// replaced by one that won a collision.
+func (p *Peer) sessionEnded() {
+	if p.dynamic && p.speaker != nil && !p.collided {
+		p.speaker.release(p)
+	}
+}
+
+// current returns true if conn is the connection the FSM is using. Any
+// other connection has been dropped and whatever happens on it no longer
+// matters.
+func (p *Peer) current(conn net.Conn) bool {
+	return p.conn == conn
+}
+
+// read hands the messages the peer sends on conn to the event loop until
+// the connection fails
+func (p *Peer) read(conn net.Conn) {
 	for {
-		h, body, err := readHeader(p.conn)
+		h, body, err := readHeader(conn)
 		if err != nil {
-			// Message header notification
+			p.enqueue(readError(conn, err))
+			return
 		}
 		switch h.msgType {
 		case open:
-			log.Println("Received an open")
-			_, err := readOpen(body)
+			o, err := readOpen(body)
 			if err != nil {
-				// Open message notification
+				p.enqueue(fsmEvent{event: BGPOpenMsgErr, conn: conn, err: err})
+				return
 			}
-			//TODO: Implement me
-			log.Println("Sending open message")
-			writeMessage(p.conn, open, newOpen(p))
+			p.enqueue(fsmEvent{event: BGPOpen, conn: conn, open: o})
 		case update:
-			log.Println("Received an update")
-			_, err := readUpdate(body)
-			if err != nil {
-				//TODO: Implement me
-				p.fsm.event(UpdateMsgErr) //??
-			}
-			//TODO: Implement me
-			p.fsm.event(UpdateMsg)
+			p.enqueue(fsmEvent{event: UpdateMsg, conn: conn, body: body})
 		case notification:
-			log.Println("Received a notification")
-			_, err := readNotification(body)
-			if err != nil {
-				log.Println("Unexpected error", err)
-			}
-			p.fsm.event(NotifMsg)
+			p.enqueue(fsmEvent{event: NotifMsg, conn: conn, body: body})
 		case keepalive:
-			log.Println("Received a keepalive")
-			if err := readKeepalive(body); err != nil {
-				// TODO: Send the error
-				p.fsm.event(NotifMsg)
-				return
+			p.enqueue(fsmEvent{event: KeepAliveMsg, conn: conn, body: body})
+		}
+	}
+}
+
+// readError turns a failure to read a message from the peer into an event.
+// Protocol errors are sent to the peer first, anything else means the
+// connection is gone.
+func readError(conn net.Conn, err error) fsmEvent {
+	e := fsmEvent{event: TCPConnectionFails, conn: conn, err: err}
+	var bgpErr bgpError
+	if errors.As(err, &bgpErr) {
+		e.event = BGPOpenMsgErr
+		if bgpErr.code == messageHeaderError {
+			e.event = BGPHeaderErr
+		}
+	}
+	return e
+}
+
+// receiveOpen validates the peer's OPEN message and negotiates the session
+// with it
+func (p *Peer) receiveOpen(open openMsg) {
+	switch p.fsm.state {
+	case connect, active, openSent:
+	default:
+		// Only the FSM has anything to do with an OPEN message once the
+		// session has been negotiated
+		p.fsm.event(BGPOpen)
+		return
+	}
+	if err := p.validateOpen(open); err != nil {
+		log.Println("failed to validate open message", err)
+		p.notify(err)
+		p.fsm.event(BGPOpenMsgErr)
+		return
+	}
+	p.remoteID = open.bgpIdentifier
+	p.fsm.negotiateHoldTime(time.Duration(open.holdTime) * time.Second)
+	// validateOpen has already made sure these decode
+	caps, _ := open.capabilities()
+	p.negotiate(caps)
+	if p.fsm.delayOpenTimer.Running() {
+		p.fsm.event(BGPOpenWithDelayOpenTimerRunning)
+	} else {
+		p.fsm.event(BGPOpen)
+	}
+}
+
+// SetDelayOpen makes us wait up to d for the peer's OPEN message before
+// sending our own once the TCP connection is up. A d of 0 sends our OPEN
+// message straight away.
+func (p *Peer) SetDelayOpen(d time.Duration) {
+	p.configure(func() { p.settings.delayOpen = &d })
+}
+
+// SetRemotePort sets the port the peer listens on, for a peer that does
+// not use the BGP port
+func (p *Peer) SetRemotePort(port int) {
+	p.configure(func() { p.remotePort = port })
+}
+
+// SetHoldTime sets the hold time we offer the peer, overriding the
+// speaker's. A hold time of 0 means neither side sends KEEPALIVEs.
+func (p *Peer) SetHoldTime(d time.Duration) {
+	p.configure(func() { p.settings.timers.holdTime = &d })
+}
+
+// SetKeepaliveTime sets how often we send the peer KEEPALIVEs, overriding
+// the speaker's. It is never more than a third of the negotiated hold time.
+func (p *Peer) SetKeepaliveTime(d time.Duration) {
+	p.configure(func() { p.settings.timers.keepaliveTime = &d })
+}
+
+// SetConnectRetryTime sets how long we wait between attempts to connect to
+// the peer, overriding the speaker's
+func (p *Peer) SetConnectRetryTime(d time.Duration) {
+	p.configure(func() { p.settings.timers.connectRetryTime = &d })
+}
+
+// sessionTimers returns the timers configured for the peer, with any it does
+// not set inherited from its group and then the speaker
+func (p *Peer) sessionTimers() sessionTimers {
+	timers := p.resolved().timers
+	if p.speaker == nil {
+		return timers
+	}
+	return timers.inherit(p.speaker.timers)
+}
+
+// SetPassive makes the peer only wait for the neighbor to connect to us,
+// never connecting to it
+func (p *Peer) SetPassive(enabled bool) {
+	p.configure(func() { p.settings.passive = &enabled })
+}
+
+// SetDampPeerOscillations makes the peer back off before starting again
+// after a failure, so that a flapping neighbor is not reconnected to over
+// and over
+func (p *Peer) SetDampPeerOscillations(enabled bool) {
+	p.configure(func() { p.settings.dampPeerOscillations = &enabled })
+}
+
+// IdleHoldTime returns how long the peer is held in Idle after failing. It
+// grows each time the peer fails and decays while its session stays up.
+func (p *Peer) IdleHoldTime() time.Duration {
+	var d time.Duration
+	p.do(func() {
+		d = p.fsm.decayedIdleHoldTime()
+	})
+	return d
+}
+
+// SetLocalAddr sets the address and port we connect to the peer from. A nil
+// IP or 0 port lets the system choose.
+func (p *Peer) SetLocalAddr(ip net.IP, port int) {
+	p.configure(func() {
+		p.localIP = ip
+		p.localPort = port
+	})
+}
+
+// connect opens a TCP connection to the peer in the background and feeds
+// the result into the FSM. The attempt is abandoned if ctx is cancelled
+// before it completes.
+func (p *Peer) connect(ctx context.Context) {
+	d := net.Dialer{}
+	if p.localIP != nil || p.localPort != 0 {
+		d.LocalAddr = &net.TCPAddr{IP: p.localIP, Port: p.localPort, Zone: p.zone}
+	}
+	// The peer may be reconfigured while connecting
+	name, addr := p.String(), p.addr().String()
+	log.Println("Connecting to", name)
+	p.goroutine(func() {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if ctx.Err() != nil {
+			// The FSM has moved on without this connection
+			if err == nil {
+				conn.Close()
 			}
-			p.fsm.event(KeepAliveMsg)
+			return
 		}
+		if err != nil {
+			log.Println("Failed to connect to", name, err)
+			p.enqueue(fsmEvent{event: TCPConnectionFails, dial: ctx, err: err})
+			return
+		}
+		p.enqueue(fsmEvent{event: TCPCRAcked, conn: conn, dial: ctx})
+	})
+}
+
+// receiveUpdate processes an UPDATE message from the peer
+func (p *Peer) receiveUpdate(body []byte) {
+	log.Println("Received an update")
+	if p.fsm.state != established {
+		// An UPDATE message is only expected once the session is up
+		p.fsm.event(UpdateMsg)
+		return
+	}
+	u, err := readUpdate(body)
+	var attrs pathAttributes
+	if updateErrorAction(err) != sessionReset {
+		var validateErr error
+		attrs, validateErr = p.validateUpdate(u)
+		err = errors.Join(err, validateErr)
+	}
+	action, resetErr := p.handleUpdateErrors(err)
+	if action == sessionReset {
+		p.send(notification, newNotification(resetErr))
+		p.fsm.event(UpdateMsgErr)
+		return
+	}
+	advertised, withdrawn := u.routes(attrs)
+	if action == treatAsWithdraw {
+		withdrawn = append(withdrawn, advertised...)
+		advertised = nil
+	}
+	p.learn(newRoutes(advertised, attrs), withdrawn)
+	p.fsm.event(UpdateMsg)
+}
+
+// receiveNotification processes a NOTIFICATION message from the peer
+func (p *Peer) receiveNotification(body []byte) {
+	n, err := readNotification(body)
+	if err != nil {
+		log.Println("Unexpected error", err)
+	}
+	log.Println("Received a notification", n, "from", p)
+	if n.code == openMessageError && n.subcode == unsupportedVersionNumber {
+		p.fsm.event(NotifMsgVerErr)
+		return
+	}
+	p.fsm.event(NotifMsg)
+}
+
+// receiveKeepalive processes a KEEPALIVE message from the peer
+func (p *Peer) receiveKeepalive(body []byte) {
+	log.Println("Received a keepalive")
+	if err := readKeepalive(body); err != nil {
+		p.notify(err)
+		p.fsm.event(BGPHeaderErr)
+		return
 	}
+	p.fsm.event(KeepAliveMsg)
 }
 
-// Up sends a ManualStart event to the FSM
+// Up sends a ManualStart event to the FSM, or a
+// ManualStart_with_PassiveTcpEstablishment event if the peer is passive
 func (p *Peer) Up() {
-	p.fsm.event(ManualStart)
+	p.enqueue(fsmEvent{event: p.manualStart()})
+}
+
+// manualStart returns the event that starts the peer
+func (p *Peer) manualStart() event {
+	if p.fsm.passiveTCPEstablishment {
+		return ManualStartWithPassiveTCPEstablishment
+	}
+	return ManualStart
 }
 
 // Down sends a ManualStop event to the FSM
 func (p *Peer) Down() {
-	p.fsm.event(ManualStop)
+	p.enqueue(fsmEvent{event: ManualStop})
 }
 
+// send writes a message to the peer, if it is connected
+func (p *Peer) send(t msgType, msg byter) {
+	if p.conn == nil {
+		return
+	}
+	if _, err := writeMessage(p.conn, t, msg); err != nil {
+		log.Println("failed to send", t, "to", p, err)
+	}
+}
+
+// notify sends the peer a NOTIFICATION message for err. While we are
+// delaying our OPEN message this is only done if SendNOTIFICATIONwithoutOPEN
+// is set.
+func (p *Peer) notify(err error) {
+	switch p.fsm.state {
+	case connect, active:
+		if !p.fsm.sendNOTIFICATIONwithoutOPEN {
+			return
+		}
+	}
+	p.send(notification, newNotification(err))
+}
+
+// close drops the connection to the peer, if there is one
 func (p *Peer) close() {
+	if p.conn == nil {
+		return
+	}
 	log.Println("Closing connection to", p)
 	p.conn.Close()
+	p.conn = nil
 }
 
 func (p *Peer) validateOpen(o openMsg) error {
@@ -131,6 +501,12 @@ func (p *Peer) validateOpen(o openMsg) error {
 	// version number is greater than the version the remote BGP peer bid,
 	// then the smallest, locally-supported version number.
 
+	// If the Autonomous System field of the OPEN message is unacceptable,
+	// then the Error Subcode MUST be set to Bad Peer AS.
+	// https://tools.ietf.org/html/rfc4271#section-6.2
+	if o.peerAS() != p.remoteAS {
+		return newBGPError(openMessageError, badPeerAS, "")
+	}
 	if o.holdTime == 1 || o.holdTime == 2 {
 		return newBGPError(openMessageError, unacceptableHoldTime,
 			"hold time must be 0 or greater than 2")
@@ -139,29 +515,84 @@ func (p *Peer) validateOpen(o openMsg) error {
 		return newBGPError(openMessageError, badBGPIdentifier,
 			"BGP identifier must be a unicast IP")
 	}
-	if p.fsm.state == idle {
-		return newBGPError(0, 0, "peer is idle")
-	}
-
-	// TODO:
 	// If one of the Optional Parameters in the OPEN message is not
 	// recognized, then the Error Subcode MUST be set to Unsupported
 	// Optional Parameters.
+	for _, param := range o.optParamaters {
+		if param.parameterType != capabilitiesParameter {
+			return newBGPError(openMessageError, unsupportedOptionalParameter,
+				string(param.bytes()))
+		}
+	}
 	// If one of the Optional Parameters in the OPEN message is recognized,
 	// but is malformed, then the Error Subcode MUST be set to 0
 	// (Unspecific).
-
-	return nil
+	caps, err := o.capabilities()
+	if err != nil {
+		return err
+	}
+	return p.validateCapabilities(caps)
 }
 
-// initializeResources initializes all BGP resources for this peer
-func (p *Peer) initializeResources() {
-	// TODO: implement me
+// validateUpdate checks the path attributes of an UPDATE message received
+// from this peer and returns their typed form. Errors that can be handled
+// without resetting the session are returned along with the attributes.
+func (p *Peer) validateUpdate(u updateMsg) (pathAttributes, error) {
+	raw := u.pathAttributes
+	var errs []error
+	if p.external() {
+		// If the LOCAL_PREF attribute is received from an external
+		// neighbor, it SHALL be discarded using the approach of
+		// "attribute discard".
+		// https://tools.ietf.org/html/rfc7606#section-7.5
+		raw = []pathAttribute{}
+		for _, a := range u.pathAttributes {
+			if a.attributeType.code == localPref {
+				errs = append(errs, newUpdateError(attributeDiscard, 0,
+					"LOCAL_PREF from an external peer"))
+				continue
+			}
+			raw = append(raw, a)
+		}
+	}
+	attrs, err := newPathAttributes(raw, p.fourOctet())
+	if updateErrorAction(err) == sessionReset {
+		return pathAttributes{}, err
+	}
+	errs = append(errs, err, p.validateFamilies(&attrs), attrs.validate(len(u.nlri) > 0))
+	advertised, _ := u.routes(attrs)
+	// If the UPDATE message is received from an external peer, the local
+	// system MAY check whether the leftmost (with respect to the position
+	// of octets in the protocol message) AS in the AS_PATH attribute is
+	// equal to the autonomous system number of the peer that sent the
+	// message.  If the check determines this is not the case, the Error
+	// Subcode MUST be set to Malformed AS_PATH.
+	// RFC 7606 handles this with "treat-as-withdraw".
+	if p.external() && len(advertised) > 0 && attrs.present[asPath] {
+		if first, ok := attrs.asPath.first(); !ok || first != p.remoteAS {
+			errs = append(errs, newUpdateError(treatAsWithdraw, malformedASPath,
+				"leftmost AS is not the peer's AS"))
+		}
+	}
+	return attrs, errors.Join(errs...)
 }
 
-// releaseResources releases all BGP resources held by this peer
+// releaseResources releases all BGP resources held by this peer. What was
+// advertised to the peer, or was about to be, is forgotten and sent again
+// in full by the next session.
 func (p *Peer) releaseResources() {
-	// TODO: Implement me
+	p.forgetAdvertised()
+	p.exports.take()
+}
+
+// deleteRoutes removes all routes learned from this peer.
+//
+// the BGP speaker connection can be closed, which implicitly removes
+// all routes the pair of speakers had advertised to each other from
+// service.
+// https://tools.ietf.org/html/rfc4271#section-3.1
+func (p *Peer) deleteRoutes() {
+	p.adjRIBIn.flush()
 }
 
 // Returns true if the peer is iBGP
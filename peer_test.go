@@ -0,0 +1,295 @@
+package kbgp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// listen starts a listener on the loopback for a peer to connect to
+func listen(t *testing.T) (net.Listener, *Peer) {
+	return listenOn(t, "127.0.0.1")
+}
+
+// listenOn starts a listener on a loopback address for a peer at that
+// address to connect to
+func listenOn(t *testing.T, ip string) (net.Listener, *Peer) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	p := NewPeer(65001, net.ParseIP(ip))
+	p.myAS = 65000
+	p.myID = newIdentifier(net.ParseIP("192.0.2.1"))
+	p.remotePort = ln.Addr().(*net.TCPAddr).Port
+	startPeer(t, p)
+	return ln, p
+}
+
+// startPeer runs a peer that has not been added to a speaker until the
+// test is over
+func startPeer(t *testing.T, p *Peer) {
+	p.start()
+	t.Cleanup(func() { p.shutdown(administrativeShutdown) })
+}
+
+// waitForState waits a while for the FSM to reach state s
+func waitForState(t *testing.T, f *fsm, s state) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		current := fsmState(f)
+		if current == s {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected state %s got %s", s, current)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// fsmState asks the peer's event loop what state the FSM is in
+func fsmState(f *fsm) state {
+	var s state
+	f.peer.do(func() { s = f.state })
+	return s
+}
+
+func TestConnect(t *testing.T) {
+	ln, p := listen(t)
+	p.SetLocalAddr(net.ParseIP("127.0.0.1"), 0)
+	p.Up()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer conn.Close()
+	if ip, _ := splitAddr(conn.RemoteAddr()); !ip.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("Expected a connection from the local address got %s", conn.RemoteAddr())
+	}
+	o, err := readOpenMessage(conn)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if o.peerAS() != 65000 {
+		t.Errorf("Expected AS65000 in the OPEN got %d", o.peerAS())
+	}
+	waitForState(t, p.fsm, openSent)
+
+	// Answer as the peer would
+	remote := NewPeer(65000, net.ParseIP("127.0.0.1"))
+	remote.myAS = 65001
+	remote.myID = newIdentifier(net.ParseIP("192.0.2.2"))
+	writeMessage(conn, open, newOpen(remote))
+	waitForState(t, p.fsm, openConfirm)
+	writeMessage(conn, keepalive, newKeepalive())
+	waitForState(t, p.fsm, established)
+}
+
+func TestConnectWrongAS(t *testing.T) {
+	ln, p := listen(t)
+	p.Up()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer conn.Close()
+	if _, err := readOpenMessage(conn); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	// The far end is not the AS the peer was configured with
+	remote := NewPeer(65000, net.ParseIP("127.0.0.1"))
+	remote.myAS = 65002
+	remote.myID = newIdentifier(net.ParseIP("192.0.2.2"))
+	writeMessage(conn, open, newOpen(remote))
+	h, body, err := readHeader(conn)
+	if err != nil || h.msgType != notification {
+		t.Fatal("Expected a NOTIFICATION message got", h, err)
+	}
+	if n, _ := readNotification(body); n.code != openMessageError || n.subcode != badPeerAS {
+		t.Errorf("Expected Bad Peer AS got %s", n)
+	}
+	waitForState(t, p.fsm, idle)
+}
+
+func TestConnectRetry(t *testing.T) {
+	ln, p := listen(t)
+	p.SetConnectRetryTime(20 * time.Millisecond)
+	p.Up()
+	// Hang up on every attempt, which sends the FSM back to Active to
+	// wait for the ConnectRetryTimer
+	for i := 0; i < 3; i++ {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		conn.Close()
+	}
+}
+
+func TestConnectFails(t *testing.T) {
+	ln, p := listen(t)
+	addr := ln.Addr().String()
+	// Nothing is listening once this is closed
+	ln.Close()
+	p.SetConnectRetryTime(50 * time.Millisecond)
+	p.Up()
+	// The peer gives up in Idle, and connects again once the
+	// ConnectRetryTime has passed
+	waitForIdleHold(t, p.fsm, true)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("Cannot listen again on", addr, err)
+	}
+	defer ln.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	conn.Close()
+	p.Down()
+	waitForState(t, p.fsm, idle)
+	waitForIdleHold(t, p.fsm, false)
+}
+
+func TestConnectFailsWithDamping(t *testing.T) {
+	ln, p := listen(t)
+	ln.Close()
+	p.SetDampPeerOscillations(true)
+	p.Up()
+	// The peer is held in Idle for longer than the ConnectRetryTime
+	waitForIdleHold(t, p.fsm, true)
+	var holding time.Duration
+	p.do(func() { holding = p.fsm.idleHoldTime })
+	if holding < minIdleHoldTime {
+		t.Errorf("Expected to be held in Idle for at least %s got %s", minIdleHoldTime, holding)
+	}
+	p.Down()
+	waitForIdleHold(t, p.fsm, false)
+}
+
+// waitForIdleHold waits a while for the FSM to be in Idle with the
+// IdleHoldTimer running or not
+func waitForIdleHold(t *testing.T, f *fsm, running bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var current bool
+		f.peer.do(func() { current = f.state == idle && f.idleHoldTimer.Running() })
+		if current == running {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the IdleHoldTimer running to be %t", running)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDelayOpen(t *testing.T) {
+	remote := NewPeer(65000, net.ParseIP("127.0.0.1"))
+	remote.myAS = 65001
+	remote.myID = newIdentifier(net.ParseIP("192.0.2.2"))
+
+	// accept waits for the peer to connect and makes sure it does not send
+	// its OPEN message straight away
+	accept := func(t *testing.T, ln net.Listener) net.Conn {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, _, err := readHeader(conn); err == nil {
+			t.Fatal("Expected the OPEN message to be delayed")
+		}
+		conn.SetReadDeadline(time.Time{})
+		return conn
+	}
+
+	t.Run("peer sends OPEN first", func(t *testing.T) {
+		ln, p := listen(t)
+		p.SetDelayOpen(time.Hour)
+		p.Up()
+		conn := accept(t, ln)
+		writeMessage(conn, open, newOpen(remote))
+		if _, err := readOpenMessage(conn); err != nil {
+			t.Fatal("Expected an OPEN message got", err)
+		}
+		if h, _, err := readHeader(conn); err != nil || h.msgType != keepalive {
+			t.Fatal("Expected a KEEPALIVE message got", h.msgType, err)
+		}
+		waitForState(t, p.fsm, openConfirm)
+	})
+
+	t.Run("DelayOpenTimer expires", func(t *testing.T) {
+		ln, p := listen(t)
+		p.SetDelayOpen(100 * time.Millisecond)
+		p.Up()
+		conn := accept(t, ln)
+		if _, err := readOpenMessage(conn); err != nil {
+			t.Fatal("Expected an OPEN message got", err)
+		}
+		waitForState(t, p.fsm, openSent)
+	})
+
+	t.Run("no NOTIFICATION without OPEN", func(t *testing.T) {
+		ln, p := listen(t)
+		p.SetDelayOpen(time.Hour)
+		p.Up()
+		conn := accept(t, ln)
+		// A message with a bad marker
+		conn.Write(make([]byte, messageHeaderLength))
+		if h, _, err := readHeader(conn); err == nil {
+			t.Errorf("Expected the connection to be dropped got a %s message", h.msgType)
+		}
+		waitForState(t, p.fsm, idle)
+	})
+}
+
+func TestPassive(t *testing.T) {
+	ln, p := listen(t)
+	p.SetPassive(true)
+	p.SetConnectRetryTime(10 * time.Millisecond)
+	p.Up()
+	waitForState(t, p.fsm, active)
+
+	// Several ConnectRetryTimers go by without a connection
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if conn, err := ln.Accept(); err == nil {
+		conn.Close()
+		t.Fatal("Did not expect a passive peer to connect")
+	}
+	if s := fsmState(p.fsm); s != active {
+		t.Errorf("Expected state Active got %s", s)
+	}
+
+	// The peer connects to us instead
+	remote := NewPeer(65000, net.ParseIP("127.0.0.1"))
+	remote.myAS = 65001
+	remote.myID = newIdentifier(net.ParseIP("192.0.2.2"))
+	local, incoming := tcpPair(t)
+	o, err := readOpen(newOpen(remote).bytes())
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	p.handleConnection(local, o)
+	if _, err := readOpenMessage(incoming); err != nil {
+		t.Fatal("Expected an OPEN message got", err)
+	}
+	waitForState(t, p.fsm, openConfirm)
+
+	// Once the session fails the peer listens again, and takes the
+	// peer's next connection
+	incoming.Close()
+	waitForState(t, p.fsm, active)
+	local, incoming = tcpPair(t)
+	p.handleConnection(local, o)
+	if _, err := readOpenMessage(incoming); err != nil {
+		t.Fatal("Expected an OPEN message got", err)
+	}
+	waitForState(t, p.fsm, openConfirm)
+}
@@ -0,0 +1,342 @@
+// Package radix is a path-compressed binary trie of IPv4 and IPv6 prefixes,
+// for finding the routes that match an address or cover one another.
+package radix
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+)
+
+// key is a prefix as a 128 bit number, with IPv4 addresses in the top 32
+// bits, and the number of those bits that count
+type key struct {
+	hi, lo uint64
+	bits   uint8
+}
+
+// newKey returns the key for p with the host bits cleared
+func newKey(p netip.Prefix) key {
+	a := p.Addr()
+	var k key
+	if a.Is4() {
+		b := a.As4()
+		k.hi = uint64(binary.BigEndian.Uint32(b[:])) << 32
+	} else {
+		b := a.As16()
+		k.hi = binary.BigEndian.Uint64(b[:8])
+		k.lo = binary.BigEndian.Uint64(b[8:])
+	}
+	return k.masked(uint8(p.Bits()))
+}
+
+// addrKey returns the key for a host address
+func addrKey(a netip.Addr) key {
+	return newKey(netip.PrefixFrom(a, a.BitLen()))
+}
+
+// masked returns the first n bits of k
+func (k key) masked(n uint8) key {
+	switch {
+	case n == 0:
+		k.hi, k.lo = 0, 0
+	case n < 64:
+		k.hi &^= ^uint64(0) >> n
+		k.lo = 0
+	case n < 128:
+		k.lo &^= ^uint64(0) >> (n - 64)
+	}
+	k.bits = n
+	return k
+}
+
+// bit returns bit i of k, counting from the most significant
+func (k key) bit(i uint8) int {
+	if i < 64 {
+		return int(k.hi>>(63-i)) & 1
+	}
+	return int(k.lo>>(127-i)) & 1
+}
+
+// common returns how many leading bits k and o share, up to the length of
+// the shorter of them
+func (k key) common(o key) uint8 {
+	n := uint8(bits.LeadingZeros64(k.hi ^ o.hi))
+	if n == 64 {
+		n += uint8(bits.LeadingZeros64(k.lo ^ o.lo))
+	}
+	return min(n, k.bits, o.bits)
+}
+
+// contains returns true if o is k or a more specific prefix within it
+func (k key) contains(o key) bool {
+	return o.bits >= k.bits && k.common(o) == k.bits
+}
+
+// prefix turns k back into a prefix of the family of the tree it is in
+func (k key) prefix(is4 bool) netip.Prefix {
+	if is4 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(k.hi>>32))
+		return netip.PrefixFrom(netip.AddrFrom4(b), int(k.bits))
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], k.hi)
+	binary.BigEndian.PutUint64(b[8:], k.lo)
+	return netip.PrefixFrom(netip.AddrFrom16(b), int(k.bits))
+}
+
+// node is a prefix in the trie, or a branch where the prefixes below it
+// part ways. Chains of nodes with only one child are left out, so a node's
+// children can be any number of bits longer than it.
+type node[V any] struct {
+	key   key
+	set   bool
+	value V
+	child [2]*node[V]
+}
+
+// Tree maps IPv4 and IPv6 prefixes to values. The zero value is an empty
+// tree. A Tree is not safe to use from multiple goroutines without locking.
+type Tree[V any] struct {
+	v4, v6 *node[V]
+	len    int
+}
+
+// New creates an empty tree
+func New[V any]() *Tree[V] {
+	return new(Tree[V])
+}
+
+// Len returns the number of prefixes in the tree
+func (t *Tree[V]) Len() int {
+	return t.len
+}
+
+// root returns where the trie for the family of addr starts
+func (t *Tree[V]) root(addr netip.Addr) **node[V] {
+	if addr.Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// Insert sets the value for prefix p, replacing any it had. Host bits of p
+// are ignored, as is a p that is not valid.
+func (t *Tree[V]) Insert(p netip.Prefix, v V) {
+	if !p.IsValid() {
+		return
+	}
+	k := newKey(p)
+	link := t.root(p.Addr())
+	for {
+		n := *link
+		if n == nil {
+			*link = &node[V]{key: k, set: true, value: v}
+			t.len++
+			return
+		}
+		common := n.key.common(k)
+		if common == n.key.bits {
+			if n.key.bits == k.bits {
+				if !n.set {
+					t.len++
+				}
+				n.set, n.value = true, v
+				return
+			}
+			link = &n.child[k.bit(n.key.bits)]
+			continue
+		}
+		// p parts ways with n before the end of n's prefix
+		leaf := &node[V]{key: k, set: true, value: v}
+		t.len++
+		if common == k.bits {
+			leaf.child[n.key.bit(common)] = n
+			*link = leaf
+			return
+		}
+		branch := &node[V]{key: k.masked(common)}
+		branch.child[k.bit(common)] = leaf
+		branch.child[n.key.bit(common)] = n
+		*link = branch
+		return
+	}
+}
+
+// find returns the node for k, if there is one
+func (t *Tree[V]) find(k key, is4 bool) *node[V] {
+	n := t.v6
+	if is4 {
+		n = t.v4
+	}
+	for n != nil && n.key.contains(k) {
+		if n.key.bits == k.bits {
+			return n
+		}
+		n = n.child[k.bit(n.key.bits)]
+	}
+	return nil
+}
+
+// Get returns the value for exactly prefix p
+func (t *Tree[V]) Get(p netip.Prefix) (V, bool) {
+	var v V
+	if !p.IsValid() {
+		return v, false
+	}
+	n := t.find(newKey(p), p.Addr().Is4())
+	if n == nil || !n.set {
+		return v, false
+	}
+	return n.value, true
+}
+
+// Delete removes prefix p, returning false if it was not in the tree
+func (t *Tree[V]) Delete(p netip.Prefix) bool {
+	if !p.IsValid() {
+		return false
+	}
+	k := newKey(p)
+	// The links followed to reach the node, so that branches left with
+	// a single child can be taken out
+	var parent **node[V]
+	link := t.root(p.Addr())
+	for *link != nil && (*link).key.contains(k) && (*link).key.bits < k.bits {
+		parent = link
+		link = &(*link).child[k.bit((*link).key.bits)]
+	}
+	n := *link
+	if n == nil || n.key != k || !n.set {
+		return false
+	}
+	t.len--
+	var zero V
+	n.set, n.value = false, zero
+	switch {
+	case n.child[0] != nil && n.child[1] != nil:
+		// Still needed as a branch
+	case n.child[0] != nil:
+		*link = n.child[0]
+	case n.child[1] != nil:
+		*link = n.child[1]
+	default:
+		*link = nil
+		// The parent may now only be a branch to one other node
+		if parent != nil && !(*parent).set {
+			up := *parent
+			*parent = up.child[0]
+			if *parent == nil {
+				*parent = up.child[1]
+			}
+		}
+	}
+	return true
+}
+
+// Lookup returns the longest prefix that contains addr, and its value
+func (t *Tree[V]) Lookup(addr netip.Addr) (netip.Prefix, V, bool) {
+	var v V
+	if !addr.IsValid() {
+		return netip.Prefix{}, v, false
+	}
+	return t.longest(addrKey(addr), addr.Is4())
+}
+
+// LookupPrefix returns the longest prefix that is p or covers it, and its
+// value
+func (t *Tree[V]) LookupPrefix(p netip.Prefix) (netip.Prefix, V, bool) {
+	var v V
+	if !p.IsValid() {
+		return netip.Prefix{}, v, false
+	}
+	return t.longest(newKey(p), p.Addr().Is4())
+}
+
+// longest returns the longest prefix in the tree that contains k
+func (t *Tree[V]) longest(k key, is4 bool) (netip.Prefix, V, bool) {
+	var best *node[V]
+	n := t.v6
+	if is4 {
+		n = t.v4
+	}
+	for n != nil && n.key.contains(k) {
+		if n.set {
+			best = n
+		}
+		if n.key.bits == k.bits {
+			break
+		}
+		n = n.child[k.bit(n.key.bits)]
+	}
+	if best == nil {
+		var v V
+		return netip.Prefix{}, v, false
+	}
+	return best.key.prefix(is4), best.value, true
+}
+
+// WalkCovering calls f for each prefix that is p or covers it, from the
+// shortest to the longest, until f returns false
+func (t *Tree[V]) WalkCovering(p netip.Prefix, f func(p netip.Prefix, v V) bool) {
+	if !p.IsValid() {
+		return
+	}
+	k, is4 := newKey(p), p.Addr().Is4()
+	n := t.v6
+	if is4 {
+		n = t.v4
+	}
+	for n != nil && n.key.contains(k) {
+		if n.set && !f(n.key.prefix(is4), n.value) {
+			return
+		}
+		if n.key.bits == k.bits {
+			return
+		}
+		n = n.child[k.bit(n.key.bits)]
+	}
+}
+
+// WalkCovered calls f for each prefix that is p or is covered by it, in
+// address order with shorter prefixes first, until f returns false
+func (t *Tree[V]) WalkCovered(p netip.Prefix, f func(p netip.Prefix, v V) bool) {
+	if !p.IsValid() {
+		return
+	}
+	k, is4 := newKey(p), p.Addr().Is4()
+	n := t.v6
+	if is4 {
+		n = t.v4
+	}
+	// Find the first node at or below p
+	for n != nil && n.key.bits < k.bits {
+		if !n.key.contains(k) {
+			return
+		}
+		n = n.child[k.bit(n.key.bits)]
+	}
+	if n != nil && k.contains(n.key) {
+		walk(n, is4, f)
+	}
+}
+
+// Walk calls f for each prefix in the tree, IPv4 before IPv6 and each in
+// address order with shorter prefixes first, until f returns false
+func (t *Tree[V]) Walk(f func(p netip.Prefix, v V) bool) {
+	if walk(t.v4, true, f) {
+		walk(t.v6, false, f)
+	}
+}
+
+// walk calls f for the prefixes at and below n, returning false if f asked
+// to stop
+func walk[V any](n *node[V], is4 bool, f func(p netip.Prefix, v V) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.set && !f(n.key.prefix(is4), n.value) {
+		return false
+	}
+	return walk(n.child[0], is4, f) && walk(n.child[1], is4, f)
+}
@@ -0,0 +1,385 @@
+package radix
+
+import (
+	"math/rand"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func mustPrefix(s string) netip.Prefix {
+	return netip.MustParsePrefix(s)
+}
+
+func TestInsertGet(t *testing.T) {
+	tree := New[string]()
+	prefixes := []string{"10.0.0.0/8", "10.0.0.0/16", "10.1.0.0/16", "0.0.0.0/0", "2001:db8::/32", "::/0", "192.0.2.1/32"}
+	for _, p := range prefixes {
+		tree.Insert(mustPrefix(p), p)
+	}
+	if tree.Len() != len(prefixes) {
+		t.Errorf("Expected %d prefixes got %d", len(prefixes), tree.Len())
+	}
+	for _, p := range prefixes {
+		if v, ok := tree.Get(mustPrefix(p)); !ok || v != p {
+			t.Errorf("Expected %s got %q %t", p, v, ok)
+		}
+	}
+	for _, p := range []string{"10.0.0.0/12", "10.2.0.0/16", "2001:db8::/48", "192.0.2.0/32"} {
+		if v, ok := tree.Get(mustPrefix(p)); ok {
+			t.Errorf("Expected nothing for %s got %q", p, v)
+		}
+	}
+	// Host bits are ignored, and replacing a value leaves the count alone
+	tree.Insert(mustPrefix("10.1.2.3/16"), "replaced")
+	if v, _ := tree.Get(mustPrefix("10.1.0.0/16")); v != "replaced" || tree.Len() != len(prefixes) {
+		t.Errorf("Expected 10.1.0.0/16 to be replaced got %q with %d prefixes", v, tree.Len())
+	}
+	// IPv4 and IPv6 are kept apart
+	if _, ok := tree.Get(mustPrefix("::/8")); ok {
+		t.Error("Expected nothing for ::/8")
+	}
+}
+
+func TestZeroTree(t *testing.T) {
+	var tree Tree[int]
+	if _, _, ok := tree.Lookup(netip.MustParseAddr("192.0.2.1")); ok {
+		t.Error("Expected an empty tree to have no match")
+	}
+	if tree.Delete(mustPrefix("10.0.0.0/8")) {
+		t.Error("Expected nothing to delete")
+	}
+	tree.Insert(netip.Prefix{}, 1)
+	if tree.Len() != 0 {
+		t.Error("Expected an invalid prefix to be ignored")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	tree := New[string]()
+	for _, p := range []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24", "2001:db8::/32", "2001:db8:1::/48"} {
+		tree.Insert(mustPrefix(p), p)
+	}
+	cases := map[string]string{
+		"10.1.1.1":      "10.1.1.0/24",
+		"10.1.2.1":      "10.1.0.0/16",
+		"10.2.0.1":      "10.0.0.0/8",
+		"192.0.2.1":     "0.0.0.0/0",
+		"2001:db8:1::1": "2001:db8:1::/48",
+		"2001:db8:2::1": "2001:db8::/32",
+		"2001:db9::1":   "",
+	}
+	for addr, want := range cases {
+		p, v, ok := tree.Lookup(netip.MustParseAddr(addr))
+		if want == "" {
+			if ok {
+				t.Errorf("Expected no match for %s got %s", addr, p)
+			}
+			continue
+		}
+		if !ok || p != mustPrefix(want) || v != want {
+			t.Errorf("Expected %s to match %s got %s %q", addr, want, p, v)
+		}
+	}
+	if p, _, _ := tree.LookupPrefix(mustPrefix("10.1.0.0/20")); p != mustPrefix("10.1.0.0/16") {
+		t.Error("Expected 10.1.0.0/20 to be covered by 10.1.0.0/16 got", p)
+	}
+	if p, _, _ := tree.LookupPrefix(mustPrefix("10.1.1.0/24")); p != mustPrefix("10.1.1.0/24") {
+		t.Error("Expected 10.1.1.0/24 to match itself got", p)
+	}
+}
+
+func TestWalks(t *testing.T) {
+	tree := New[int]()
+	prefixes := []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24", "10.1.128.0/17", "10.2.0.0/16", "11.0.0.0/8", "2001:db8::/32"}
+	for i, p := range prefixes {
+		tree.Insert(mustPrefix(p), i)
+	}
+	collect := func(walk func(f func(p netip.Prefix, v int) bool)) []string {
+		var got []string
+		walk(func(p netip.Prefix, v int) bool {
+			got = append(got, p.String())
+			return true
+		})
+		return got
+	}
+	covering := collect(func(f func(netip.Prefix, int) bool) { tree.WalkCovering(mustPrefix("10.1.1.0/24"), f) })
+	if want := []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24"}; !slices.Equal(covering, want) {
+		t.Errorf("Expected covering %v got %v", want, covering)
+	}
+	covered := collect(func(f func(netip.Prefix, int) bool) { tree.WalkCovered(mustPrefix("10.1.0.0/16"), f) })
+	if want := []string{"10.1.0.0/16", "10.1.1.0/24", "10.1.128.0/17"}; !slices.Equal(covered, want) {
+		t.Errorf("Expected covered %v got %v", want, covered)
+	}
+	covered = collect(func(f func(netip.Prefix, int) bool) { tree.WalkCovered(mustPrefix("10.0.0.0/7"), f) })
+	if want := prefixes[:6]; !slices.Equal(covered, want) {
+		t.Errorf("Expected covered %v got %v", want, covered)
+	}
+	all := collect(tree.Walk)
+	if !slices.Equal(all, prefixes) {
+		t.Errorf("Expected %v got %v", prefixes, all)
+	}
+	// Walks stop when asked to
+	n := 0
+	tree.Walk(func(netip.Prefix, int) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 {
+		t.Errorf("Expected the walk to stop after 2 prefixes got %d", n)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	tree := New[int]()
+	prefixes := []string{"10.0.0.0/8", "10.0.0.0/16", "10.1.0.0/16", "10.128.0.0/9"}
+	for i, p := range prefixes {
+		tree.Insert(mustPrefix(p), i)
+	}
+	if tree.Delete(mustPrefix("10.2.0.0/16")) || tree.Delete(mustPrefix("10.0.0.0/15")) {
+		t.Error("Expected prefixes not in the tree to not be deleted")
+	}
+	for i, p := range prefixes {
+		if !tree.Delete(mustPrefix(p)) {
+			t.Errorf("Expected %s to be deleted", p)
+		}
+		if tree.Delete(mustPrefix(p)) {
+			t.Errorf("Expected %s to be deleted only once", p)
+		}
+		for _, left := range prefixes[i+1:] {
+			if _, ok := tree.Get(mustPrefix(left)); !ok {
+				t.Errorf("Expected %s to be left after deleting %s", left, p)
+			}
+		}
+	}
+	if tree.Len() != 0 || tree.v4 != nil {
+		t.Errorf("Expected an empty tree got %d prefixes", tree.Len())
+	}
+}
+
+// randomPrefix returns a random prefix of the family with the given number
+// of address bytes, at least shortest bits long
+func randomPrefix(r *rand.Rand, size, shortest int) netip.Prefix {
+	b := make([]byte, size)
+	r.Read(b)
+	addr, _ := netip.AddrFromSlice(b)
+	return netip.PrefixFrom(addr, shortest+r.Intn(size*8-shortest+1)).Masked()
+}
+
+// TestAgainstMap checks the tree against a brute force search of the same
+// prefixes
+func TestAgainstMap(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tree := New[int]()
+	want := map[netip.Prefix]int{}
+	// Short prefixes so that plenty of them cover one another
+	for i := range 5000 {
+		p := randomPrefix(r, 4, 0)
+		p = netip.PrefixFrom(p.Addr(), p.Bits()/2).Masked()
+		if i%2 == 1 {
+			p = randomPrefix(r, 16, 0)
+			p = netip.PrefixFrom(p.Addr(), p.Bits()/8).Masked()
+		}
+		tree.Insert(p, i)
+		want[p] = i
+	}
+	deleted := 0
+	for p := range want {
+		if deleted++; deleted > len(want)/3 {
+			break
+		}
+		if !tree.Delete(p) {
+			t.Fatal("Expected to delete", p)
+		}
+		delete(want, p)
+	}
+	if tree.Len() != len(want) {
+		t.Fatalf("Expected %d prefixes got %d", len(want), tree.Len())
+	}
+	for p, v := range want {
+		if got, ok := tree.Get(p); !ok || got != v {
+			t.Fatalf("Expected %s to be %d got %d %t", p, v, got, ok)
+		}
+	}
+	for range 2000 {
+		q := randomPrefix(r, 4, 0)
+		if r.Intn(2) == 1 {
+			q = randomPrefix(r, 16, 0)
+		}
+		var covering, covered []netip.Prefix
+		for p := range want {
+			if p.Addr().Is4() != q.Addr().Is4() {
+				continue
+			}
+			if p.Bits() <= q.Bits() && p.Contains(q.Addr()) {
+				covering = append(covering, p)
+			}
+			if p.Bits() >= q.Bits() && q.Contains(p.Addr()) {
+				covered = append(covered, p)
+			}
+		}
+		slices.SortFunc(covering, func(a, b netip.Prefix) int { return a.Bits() - b.Bits() })
+		slices.SortFunc(covered, func(a, b netip.Prefix) int {
+			if c := a.Addr().Compare(b.Addr()); c != 0 {
+				return c
+			}
+			return a.Bits() - b.Bits()
+		})
+
+		var got []netip.Prefix
+		tree.WalkCovering(q, func(p netip.Prefix, v int) bool {
+			got = append(got, p)
+			return true
+		})
+		if !slices.Equal(got, covering) {
+			t.Fatalf("Expected %s to be covered by %v got %v", q, covering, got)
+		}
+		got = nil
+		tree.WalkCovered(q, func(p netip.Prefix, v int) bool {
+			got = append(got, p)
+			return true
+		})
+		if !slices.Equal(got, covered) {
+			t.Fatalf("Expected %s to cover %v got %v", q, covered, got)
+		}
+		p, _, ok := tree.Lookup(q.Addr())
+		var longest netip.Prefix
+		for c := range want {
+			if c.Addr().Is4() == q.Addr().Is4() && c.Contains(q.Addr()) && (!longest.IsValid() || c.Bits() > longest.Bits()) {
+				longest = c
+			}
+		}
+		if ok != longest.IsValid() || p != longest {
+			t.Fatalf("Expected %s to match %s got %s", q.Addr(), longest, p)
+		}
+	}
+}
+
+// fullTable returns n random prefixes of the family with the given number
+// of address bytes, of the lengths most of the global routing table has
+func fullTable(n, size int) []netip.Prefix {
+	r := rand.New(rand.NewSource(int64(size)))
+	shortest, longest := 8, 24
+	if size == 16 {
+		shortest, longest = 16, 48
+	}
+	seen := make(map[netip.Prefix]bool, n)
+	prefixes := make([]netip.Prefix, 0, n)
+	for len(prefixes) < n {
+		p := randomPrefix(r, size, 0)
+		p = netip.PrefixFrom(p.Addr(), shortest+r.Intn(longest-shortest+1)).Masked()
+		if !seen[p] {
+			seen[p] = true
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes
+}
+
+const (
+	fullIPv4Table = 1_000_000
+	fullIPv6Table = 200_000
+)
+
+func TestFullTables(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping full tables in short mode")
+	}
+	tree := New[int]()
+	v4, v6 := fullTable(fullIPv4Table, 4), fullTable(fullIPv6Table, 16)
+	for i, p := range slices.Concat(v4, v6) {
+		tree.Insert(p, i)
+	}
+	if tree.Len() != fullIPv4Table+fullIPv6Table {
+		t.Fatalf("Expected %d prefixes got %d", fullIPv4Table+fullIPv6Table, tree.Len())
+	}
+	for i, p := range slices.Concat(v4, v6) {
+		if got, ok := tree.Get(p); !ok || got != i {
+			t.Fatalf("Expected %s to be %d got %d %t", p, i, got, ok)
+		}
+		if i%2 == 0 {
+			tree.Delete(p)
+		}
+	}
+	if tree.Len() != (fullIPv4Table+fullIPv6Table)/2 {
+		t.Fatalf("Expected %d prefixes got %d", (fullIPv4Table+fullIPv6Table)/2, tree.Len())
+	}
+}
+
+func benchmarkInsert(b *testing.B, prefixes []netip.Prefix) {
+	b.ReportAllocs()
+	for range b.N {
+		tree := New[int]()
+		for i, p := range prefixes {
+			tree.Insert(p, i)
+		}
+	}
+}
+
+func BenchmarkInsertIPv4(b *testing.B) {
+	benchmarkInsert(b, fullTable(fullIPv4Table, 4))
+}
+
+func BenchmarkInsertIPv6(b *testing.B) {
+	benchmarkInsert(b, fullTable(fullIPv6Table, 16))
+}
+
+func benchmarkLookup(b *testing.B, prefixes []netip.Prefix) {
+	tree := New[int]()
+	for i, p := range prefixes {
+		tree.Insert(p, i)
+	}
+	// Addresses inside the prefixes, so that lookups go deep
+	addrs := make([]netip.Addr, len(prefixes))
+	for i, p := range prefixes {
+		addrs[i] = p.Addr().Next()
+	}
+	b.ResetTimer()
+	for i := range b.N {
+		tree.Lookup(addrs[i%len(addrs)])
+	}
+}
+
+func BenchmarkLookupIPv4(b *testing.B) {
+	benchmarkLookup(b, fullTable(fullIPv4Table, 4))
+}
+
+func BenchmarkLookupIPv6(b *testing.B) {
+	benchmarkLookup(b, fullTable(fullIPv6Table, 16))
+}
+
+func benchmarkGet(b *testing.B, prefixes []netip.Prefix) {
+	tree := New[int]()
+	for i, p := range prefixes {
+		tree.Insert(p, i)
+	}
+	b.ResetTimer()
+	for i := range b.N {
+		tree.Get(prefixes[i%len(prefixes)])
+	}
+}
+
+func BenchmarkGetIPv4(b *testing.B) {
+	benchmarkGet(b, fullTable(fullIPv4Table, 4))
+}
+
+func BenchmarkGetIPv6(b *testing.B) {
+	benchmarkGet(b, fullTable(fullIPv6Table, 16))
+}
+
+func BenchmarkDeleteIPv4(b *testing.B) {
+	prefixes := fullTable(fullIPv4Table, 4)
+	tree := New[int]()
+	b.ResetTimer()
+	for i := range b.N {
+		p := prefixes[i%len(prefixes)]
+		if i%len(prefixes) == 0 {
+			b.StopTimer()
+			for j, p := range prefixes {
+				tree.Insert(p, j)
+			}
+			b.StartTimer()
+		}
+		tree.Delete(p)
+	}
+}
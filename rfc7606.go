@@ -0,0 +1,127 @@
+package kbgp
+
+import (
+	"errors"
+	"log"
+)
+
+// Revised Error Handling for BGP UPDATE Messages
+// https://tools.ietf.org/html/rfc7606
+//
+// Rather than resetting the session on every malformed UPDATE message,
+// each error is handled with the least disruptive approach that still
+// keeps the routing information consistent.
+type errorAction int
+
+// Ordered from least to most severe. When an UPDATE message has more than
+// one error, the most severe approach is the one used.
+// https://tools.ietf.org/html/rfc7606#section-3
+const (
+	_ errorAction = iota
+	// The malformed attribute is discarded and the UPDATE message
+	// is otherwise processed normally
+	attributeDiscard
+	// The routes carried in the UPDATE message are treated as
+	// though they had been withdrawn
+	treatAsWithdraw
+	// A NOTIFICATION is sent and the session is reset, as RFC 4271
+	// prescribes for every error
+	sessionReset
+)
+
+var errorActionLookup = map[errorAction]string{
+	attributeDiscard: "attribute-discard",
+	treatAsWithdraw:  "treat-as-withdraw",
+	sessionReset:     "session-reset",
+}
+
+// String implements strings.Stringer
+func (a errorAction) String() string {
+	return errorActionLookup[a]
+}
+
+// updateError is an UPDATE message error that RFC 7606 allows to be
+// handled without resetting the session
+type updateError struct {
+	bgpError
+	action errorAction
+}
+
+func newUpdateError(action errorAction, subcode int, message string) error {
+	return updateError{bgpError{updateMessageError, subcode, message}, action}
+}
+
+// Error implements error
+func (e updateError) Error() string {
+	return e.action.String() + ": " + e.bgpError.Error()
+}
+
+// Unwrap returns the underlying bgpError
+func (e updateError) Unwrap() error {
+	return e.bgpError
+}
+
+// updateErrorAction returns how an error is to be handled. Errors that
+// are not updateErrors reset the session, and when errors have been
+// joined together the most severe approach wins.
+func updateErrorAction(err error) errorAction {
+	var action errorAction
+	for _, e := range splitErrors(err) {
+		a := sessionReset
+		var ue updateError
+		if errors.As(e, &ue) {
+			a = ue.action
+		}
+		if a > action {
+			action = a
+		}
+	}
+	return action
+}
+
+// splitErrors flattens errors combined with errors.Join
+func splitErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var errs []error
+		for _, e := range joined.Unwrap() {
+			errs = append(errs, splitErrors(e)...)
+		}
+		return errs
+	}
+	return []error{err}
+}
+
+// handleUpdateErrors records each error found in an UPDATE message received
+// from this peer and returns the most severe approach to take along with the
+// error to send in a NOTIFICATION if the session is to be reset
+func (p *Peer) handleUpdateErrors(err error) (errorAction, error) {
+	var action errorAction
+	var reset error
+	for _, e := range splitErrors(err) {
+		a := updateErrorAction(e)
+		log.Println("UPDATE error from", p, "handled as", a, e)
+		p.updateErrors[a].Increment()
+		if a > action {
+			action = a
+		}
+		if a == sessionReset && reset == nil {
+			reset = e
+		}
+	}
+	return action, reset
+}
+
+// UpdateErrors returns the number of errors in UPDATE messages received
+// from this peer, keyed by the RFC 7606 approach used to handle them
+func (p *Peer) UpdateErrors() map[string]uint64 {
+	counts := map[string]uint64{}
+	p.do(func() {
+		for a, c := range p.updateErrors {
+			counts[a.String()] = c.Value()
+		}
+	})
+	return counts
+}
@@ -0,0 +1,88 @@
+package kbgp
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestHandleUpdateErrors(t *testing.T) {
+	p := NewPeer(65001, net.ParseIP("192.0.2.1"))
+	err := errors.Join(
+		newUpdateError(attributeDiscard, attributeLengthError, ""),
+		errors.Join(newUpdateError(treatAsWithdraw, malformedASPath, "")),
+		newUpdateError(attributeDiscard, malformedAttributeList, ""),
+	)
+	action, reset := p.handleUpdateErrors(err)
+	if action != treatAsWithdraw {
+		t.Errorf("Expected treat-as-withdraw got %s", action)
+	}
+	if reset != nil {
+		t.Errorf("Did not expect a session reset error, got %v", reset)
+	}
+	counts := p.UpdateErrors()
+	if counts["attribute-discard"] != 2 || counts["treat-as-withdraw"] != 1 || counts["session-reset"] != 0 {
+		t.Errorf("Unexpected counts %v", counts)
+	}
+
+	fatal := newBGPError(updateMessageError, invalidNetworkField, "")
+	action, reset = p.handleUpdateErrors(errors.Join(err, fatal))
+	if action != sessionReset || reset != fatal {
+		t.Errorf("Expected a session reset with %v, got %s %v", fatal, action, reset)
+	}
+
+	if action, _ := p.handleUpdateErrors(nil); action != 0 {
+		t.Errorf("Expected no action for no errors, got %s", action)
+	}
+}
+
+func TestValidateUpdateFromExternalPeer(t *testing.T) {
+	p := NewPeer(65001, net.ParseIP("192.0.2.1"))
+	p.myAS = 65000
+	u, err := readUpdate([]byte{
+		0, 0,
+		0, 25,
+		0x40, origin, 1, igp,
+		0x40, asPath, 4, asSequence, 1, 0xfd, 0xea,
+		0x40, nextHop, 4, 192, 0, 2, 1,
+		0x40, localPref, 4, 0, 0, 0, 200,
+		8, 10,
+	})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	attrs, err := p.validateUpdate(u)
+	action, _ := p.handleUpdateErrors(err)
+	if action != treatAsWithdraw {
+		t.Errorf("Expected the wrong leftmost AS to be treat-as-withdraw, got %s", action)
+	}
+	if attrs.localPref != nil {
+		t.Error("Expected LOCAL_PREF from an external peer to be discarded")
+	}
+	if p.UpdateErrors()["attribute-discard"] != 1 {
+		t.Errorf("Expected the discarded LOCAL_PREF to be counted, got %v", p.UpdateErrors())
+	}
+}
+
+func TestUpdateErrorsWhileRunning(t *testing.T) {
+	p, conn := establishedPeer(t, 0, 0)
+	attrs := pathAttributes{
+		present: map[uint8]bool{origin: true, asPath: true},
+		asPath:  asPathAttr{sequence(65001)},
+		nextHop: netip.MustParseAddr("192.0.2.2"),
+	}
+	local := uint32(200)
+	attrs.localPref = &local
+	nlri := []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}
+	writeMessage(conn, update, newUpdate(nil, attrs.raw(false), nlri))
+	// The counts are read while the event loop handles the UPDATE
+	deadline := time.Now().Add(2 * time.Second)
+	for p.UpdateErrors()["attribute-discard"] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the discarded LOCAL_PREF to be counted, got %v", p.UpdateErrors())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
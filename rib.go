@@ -0,0 +1,359 @@
+package kbgp
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+)
+
+// Routes are stored in the Routing Information Bases (RIBs): namely,
+// the Adj-RIBs-In, the Loc-RIB, and the Adj-RIBs-Out, as described in
+// Section 3.2.
+// https://tools.ietf.org/html/rfc4271#section-3.1
+//
+// Adj-RIBs-In: The Adj-RIBs-In stores routing information learned from
+// inbound UPDATE messages that were received from other BGP speakers.
+// Their contents represent routes that are available as input to the
+// Decision Process.
+// https://tools.ietf.org/html/rfc4271#section-3.2
+
+// Route pairs a destination with the attributes of a path to it. The
+// attributes are shared between routes and never changed in place.
+type Route struct {
+	prefix netip.Prefix
+	attrs  *pathAttributes
+}
+
+// newRoutes pairs each prefix with attrs, leaving out the NLRI carried in
+// the multiprotocol attributes so that every route can share them. Any
+// host bits a prefix was sent with are cleared, so that it is the same
+// destination however it was sent.
+func newRoutes(prefixes []netip.Prefix, attrs pathAttributes) []Route {
+	if attrs.mpReach != nil {
+		reach := *attrs.mpReach
+		reach.nlri = nil
+		attrs.mpReach = &reach
+	}
+	attrs.mpUnreach = nil
+	routes := make([]Route, len(prefixes))
+	for i, prefix := range prefixes {
+		routes[i] = Route{prefix.Masked(), &attrs}
+	}
+	return routes
+}
+
+// Prefix returns the route's destination
+func (r Route) Prefix() netip.Prefix {
+	return r.prefix
+}
+
+// Family returns the address family of the route
+func (r Route) Family() addressFamily {
+	return familyOf(r.prefix)
+}
+
+// familyOf returns the unicast address family of prefix
+func familyOf(prefix netip.Prefix) addressFamily {
+	if prefix.Addr().Is4() {
+		return IPv4Unicast
+	}
+	return IPv6Unicast
+}
+
+// NextHop returns the address of the router to forward to
+func (r Route) NextHop() netip.Addr {
+	if m := r.attrs.mpReach; m != nil && m.family == r.Family() {
+		return m.nextHop
+	}
+	return r.attrs.nextHop
+}
+
+// ASPathLength returns the number of ASes the route has traversed
+func (r Route) ASPathLength() int {
+	return r.attrs.asPath.pathLength()
+}
+
+// LocalPref returns the route's LOCAL_PREF, if it has one
+func (r Route) LocalPref() (uint32, bool) {
+	if r.attrs.localPref == nil {
+		return 0, false
+	}
+	return *r.attrs.localPref, true
+}
+
+// MED returns the route's MULTI_EXIT_DISC, if it has one
+func (r Route) MED() (uint32, bool) {
+	if r.attrs.multiExitDisc == nil {
+		return 0, false
+	}
+	return *r.attrs.multiExitDisc, true
+}
+
+// WithLocalPref returns a copy of the route with its LOCAL_PREF set
+func (r Route) WithLocalPref(v uint32) Route {
+	return r.with(func(attrs *pathAttributes) {
+		attrs.localPref = &v
+	})
+}
+
+// WithMED returns a copy of the route with its MULTI_EXIT_DISC set
+func (r Route) WithMED(v uint32) Route {
+	return r.with(func(attrs *pathAttributes) {
+		attrs.multiExitDisc = &v
+	})
+}
+
+// with returns a copy of the route with change made to its attributes
+func (r Route) with(change func(attrs *pathAttributes)) Route {
+	attrs := *r.attrs
+	change(&attrs)
+	r.attrs = &attrs
+	return r
+}
+
+// String implements strings.Stringer
+func (r Route) String() string {
+	return fmt.Sprintf("%s %s", r.prefix, r.attrs)
+}
+
+// Policy decides which routes are accepted from a peer, and may change
+// their attributes
+type Policy interface {
+	// Apply returns the route to use in place of r, or false if r is
+	// rejected
+	Apply(r Route) (Route, bool)
+}
+
+// PolicyFunc lets an ordinary function be used as a Policy
+type PolicyFunc func(r Route) (Route, bool)
+
+// Apply implements Policy
+func (f PolicyFunc) Apply(r Route) (Route, bool) {
+	return f(r)
+}
+
+// apply runs policy over r, accepting every route if there is no policy
+func apply(policy Policy, r Route) (Route, bool) {
+	if policy == nil {
+		return r, true
+	}
+	return policy.Apply(r)
+}
+
+// table holds at most one route for each prefix, by address family
+type table map[addressFamily]map[netip.Prefix]Route
+
+// insert adds r, replacing any route for the same prefix
+func (t table) insert(r Route) {
+	family := r.Family()
+	if t[family] == nil {
+		t[family] = map[netip.Prefix]Route{}
+	}
+	t[family][r.prefix] = r
+}
+
+// remove deletes the route for prefix
+func (t table) remove(prefix netip.Prefix) {
+	delete(t[familyOf(prefix)], prefix)
+}
+
+// lookup returns the route for prefix
+func (t table) lookup(prefix netip.Prefix) (Route, bool) {
+	r, ok := t[familyOf(prefix)][prefix]
+	return r, ok
+}
+
+// count returns the number of routes for family
+func (t table) count(family addressFamily) int {
+	return len(t[family])
+}
+
+// walk calls f for each route for family in prefix order, until f returns
+// false
+func (t table) walk(family addressFamily, f func(r Route) bool) {
+	prefixes := make([]netip.Prefix, 0, len(t[family]))
+	for prefix := range t[family] {
+		prefixes = append(prefixes, prefix)
+	}
+	slices.SortFunc(prefixes, comparePrefixes)
+	for _, prefix := range prefixes {
+		if !f(t[family][prefix]) {
+			return
+		}
+	}
+}
+
+// comparePrefixes orders prefixes by address and then length
+func comparePrefixes(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
+
+// adjRIBIn holds the routes learned from a peer, both as they were
+// received and as they were accepted by import policy. Keeping the routes
+// as received lets a change of policy be applied without asking the peer
+// to send them again.
+type adjRIBIn struct {
+	prePolicy  table
+	postPolicy table
+	// Where the routes get their shared attributes from
+	cache *attrCache
+	// Told about each change to the routes accepted by policy
+	changed func(prefix netip.Prefix, r Route, ok bool)
+}
+
+func newAdjRIBIn() *adjRIBIn {
+	return &adjRIBIn{prePolicy: table{}, postPolicy: table{}}
+}
+
+// update records the routes advertised and withdrawn by an UPDATE message
+func (a *adjRIBIn) update(advertised []Route, withdrawn []netip.Prefix, policy Policy) {
+	for _, prefix := range withdrawn {
+		a.cache.drop(a.prePolicy, prefix)
+		a.reject(prefix)
+	}
+	// The routes of an UPDATE message share their attributes, which only
+	// need looking up in the cache once
+	var received, shared *pathAttributes
+	for _, r := range advertised {
+		if r.attrs == received {
+			r.attrs = shared
+		} else {
+			received = r.attrs
+		}
+		r = a.cache.store(a.prePolicy, r)
+		shared = r.attrs
+		a.accept(r, policy)
+	}
+}
+
+// accept puts r in the post-policy view if policy accepts it, replacing
+// whatever was accepted for the prefix before
+func (a *adjRIBIn) accept(r Route, policy Policy) {
+	accepted, ok := apply(policy, r)
+	if !ok {
+		a.reject(r.prefix)
+		return
+	}
+	accepted.prefix = r.prefix
+	accepted = a.cache.store(a.postPolicy, accepted)
+	a.notify(r.prefix, accepted, true)
+}
+
+// reject removes whatever was accepted for prefix
+func (a *adjRIBIn) reject(prefix netip.Prefix) {
+	if _, ok := a.postPolicy.lookup(prefix); !ok {
+		return
+	}
+	a.cache.drop(a.postPolicy, prefix)
+	a.notify(prefix, Route{}, false)
+}
+
+// notify passes on a change to the routes accepted by policy
+func (a *adjRIBIn) notify(prefix netip.Prefix, r Route, ok bool) {
+	if a.changed != nil {
+		a.changed(prefix, r, ok)
+	}
+}
+
+// reapply runs every route as received through policy again
+func (a *adjRIBIn) reapply(policy Policy) {
+	for _, routes := range a.prePolicy {
+		for _, r := range routes {
+			a.accept(r, policy)
+		}
+	}
+}
+
+// flush removes every route
+func (a *adjRIBIn) flush() {
+	for _, routes := range a.postPolicy {
+		for prefix := range routes {
+			a.notify(prefix, Route{}, false)
+		}
+	}
+	a.cache.releaseAll(a.prePolicy)
+	a.cache.releaseAll(a.postPolicy)
+	a.prePolicy = table{}
+	a.postPolicy = table{}
+}
+
+// RIBView selects the routes learned from a peer as they were received, or
+// as they were accepted by import policy
+type RIBView int
+
+const (
+	// Routes as the peer advertised them
+	PrePolicy RIBView = iota
+	// Routes as accepted by import policy
+	PostPolicy
+)
+
+// view returns the table for v
+func (a *adjRIBIn) view(v RIBView) table {
+	if v == PrePolicy {
+		return a.prePolicy
+	}
+	return a.postPolicy
+}
+
+// LookupRoute returns the route learned from the peer for prefix
+func (p *Peer) LookupRoute(v RIBView, prefix netip.Prefix) (Route, bool) {
+	var r Route
+	var ok bool
+	p.do(func() {
+		r, ok = p.adjRIBIn.view(v).lookup(prefix)
+	})
+	return r, ok
+}
+
+// Routes returns the routes learned from the peer for family, in prefix
+// order
+func (p *Peer) Routes(v RIBView, family addressFamily) []Route {
+	var routes []Route
+	p.do(func() {
+		t := p.adjRIBIn.view(v)
+		routes = make([]Route, 0, t.count(family))
+		t.walk(family, func(r Route) bool {
+			routes = append(routes, r)
+			return true
+		})
+	})
+	return routes
+}
+
+// RouteCount returns the number of routes learned from the peer for family
+func (p *Peer) RouteCount(v RIBView, family addressFamily) int {
+	var n int
+	p.do(func() {
+		n = p.adjRIBIn.view(v).count(family)
+	})
+	return n
+}
+
+// SetImportPolicy sets the policy routes learned from the peer are
+// accepted by, overriding its group's. A nil policy accepts every route.
+func (p *Peer) SetImportPolicy(policy Policy) {
+	p.configure(func() { p.settings.importPolicy = policy })
+}
+
+// SetImportPolicy sets the policy routes learned from the group's peers are
+// accepted by
+func (g *PeerGroup) SetImportPolicy(policy Policy) {
+	g.set(func(s *peerSettings) { s.importPolicy = policy })
+}
+
+// learn stores the routes from an UPDATE message in the Adj-RIB-In
+func (p *Peer) learn(advertised []Route, withdrawn []netip.Prefix) {
+	log.Println("Advertised", len(advertised), "withdrawn", len(withdrawn), "by", p)
+	// Withdrawn routes are found by their destination, whatever host bits
+	// they were sent with
+	masked := make([]netip.Prefix, len(withdrawn))
+	for i, prefix := range withdrawn {
+		masked[i] = prefix.Masked()
+	}
+	p.adjRIBIn.update(advertised, masked, p.resolved().importPolicy)
+}
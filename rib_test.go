@@ -0,0 +1,203 @@
+package kbgp
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// testRoutes returns routes for the prefixes with a path through AS65001
+func testRoutes(prefixes ...string) []Route {
+	attrs := pathAttributes{
+		present: map[uint8]bool{origin: true, asPath: true, nextHop: true},
+		asPath:  asPathAttr{sequence(65001)},
+		nextHop: netip.MustParseAddr("192.0.2.2"),
+	}
+	var parsed []netip.Prefix
+	for _, p := range prefixes {
+		parsed = append(parsed, netip.MustParsePrefix(p))
+	}
+	return newRoutes(parsed, attrs)
+}
+
+func TestAdjRIBIn(t *testing.T) {
+	rejected := netip.MustParsePrefix("10.1.0.0/16")
+	policy := PolicyFunc(func(r Route) (Route, bool) {
+		if r.Prefix() == rejected {
+			return r, false
+		}
+		return r.WithLocalPref(200), true
+	})
+	a := newAdjRIBIn()
+	a.update(testRoutes("10.0.0.0/16", "10.1.0.0/16", "2001:db8::/32"), nil, policy)
+
+	cases := []struct {
+		view     RIBView
+		family   addressFamily
+		expected int
+	}{
+		{PrePolicy, IPv4Unicast, 2},
+		{PostPolicy, IPv4Unicast, 1},
+		{PrePolicy, IPv6Unicast, 1},
+		{PostPolicy, IPv6Unicast, 1},
+	}
+	for _, c := range cases {
+		if n := a.view(c.view).count(c.family); n != c.expected {
+			t.Errorf("View %d %s: expected %d routes got %d", c.view, c.family, c.expected, n)
+		}
+	}
+	if _, ok := a.postPolicy.lookup(rejected); ok {
+		t.Error("Expected the rejected route to be left out after policy")
+	}
+	r, ok := a.postPolicy.lookup(netip.MustParsePrefix("10.0.0.0/16"))
+	if lp, _ := r.LocalPref(); !ok || lp != 200 {
+		t.Errorf("Expected a LOCAL_PREF of 200 after policy got %s", r)
+	}
+	r, _ = a.prePolicy.lookup(netip.MustParsePrefix("10.0.0.0/16"))
+	if _, set := r.LocalPref(); set {
+		t.Errorf("Expected the route as received to be unchanged got %s", r)
+	}
+
+	// Replacing and withdrawing routes
+	a.update(testRoutes("10.1.0.0/16"), []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")}, nil)
+	if a.prePolicy.count(IPv4Unicast) != 1 || a.postPolicy.count(IPv4Unicast) != 1 {
+		t.Error("Expected the withdrawn route to be replaced by the one policy accepts")
+	}
+
+	// A change of policy applies to the routes as received
+	a.reapply(policy)
+	if a.postPolicy.count(IPv4Unicast) != 0 || a.postPolicy.count(IPv6Unicast) != 1 {
+		t.Error("Expected policy to be applied again")
+	}
+
+	var walked []netip.Prefix
+	a.update(testRoutes("10.2.0.0/16", "10.1.0.0/24"), nil, nil)
+	a.prePolicy.walk(IPv4Unicast, func(r Route) bool {
+		walked = append(walked, r.Prefix())
+		return true
+	})
+	if len(walked) != 3 || walked[0].String() != "10.1.0.0/16" || walked[1].String() != "10.1.0.0/24" {
+		t.Errorf("Expected routes in prefix order got %v", walked)
+	}
+
+	a.flush()
+	if a.prePolicy.count(IPv4Unicast) != 0 || a.postPolicy.count(IPv6Unicast) != 0 {
+		t.Error("Expected no routes after a flush")
+	}
+}
+
+func TestMPRoutesNextHop(t *testing.T) {
+	attrs := pathAttributes{
+		nextHop: netip.MustParseAddr("192.0.2.2"),
+		mpReach: &mpReachNLRIAttr{
+			family:  IPv6Unicast,
+			nextHop: netip.MustParseAddr("2001:db8::2"),
+			nlri:    []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/48")},
+		},
+		mpUnreach: &mpUnreachNLRIAttr{IPv6Unicast, []netip.Prefix{netip.MustParsePrefix("2001:db8:2::/48")}},
+	}
+	routes := newRoutes([]netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8:1::/48"),
+	}, attrs)
+	if nh := routes[0].NextHop().String(); nh != "192.0.2.2" {
+		t.Errorf("Expected next hop 192.0.2.2 got %s", nh)
+	}
+	if nh := routes[1].NextHop().String(); nh != "2001:db8::2" {
+		t.Errorf("Expected next hop 2001:db8::2 got %s", nh)
+	}
+	if routes[1].attrs.mpReach.nlri != nil || routes[1].attrs.mpUnreach != nil {
+		t.Error("Expected the routes not to carry the NLRI of the UPDATE message")
+	}
+	if attrs.mpReach.nlri == nil {
+		t.Error("Expected the UPDATE message's attributes to be left alone")
+	}
+}
+
+// waitForRoutes waits a while for the peer to have n routes for family
+func waitForRoutes(t *testing.T, p *Peer, v RIBView, family addressFamily, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		current := p.RouteCount(v, family)
+		if current == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d routes got %d", n, current)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRoutesFlushedWithSession(t *testing.T) {
+	p, conn := establishedPeer(t, 0, 0)
+	p.SetImportPolicy(PolicyFunc(func(r Route) (Route, bool) {
+		return r, r.Prefix().Bits() <= 24
+	}))
+	attrs := pathAttributes{
+		present: map[uint8]bool{origin: true, asPath: true},
+		asPath:  asPathAttr{sequence(65001)},
+		nextHop: netip.MustParseAddr("192.0.2.2"),
+	}
+	nlri := []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24"), netip.MustParsePrefix("203.0.113.0/25")}
+	writeMessage(conn, update, newUpdate(nil, attrs.raw(false), nlri))
+	waitForRoutes(t, p, PrePolicy, IPv4Unicast, 2)
+	waitForRoutes(t, p, PostPolicy, IPv4Unicast, 1)
+	if r, ok := p.LookupRoute(PostPolicy, nlri[0]); !ok || r.NextHop() != attrs.nextHop {
+		t.Errorf("Expected %s via %s got %s", nlri[0], attrs.nextHop, r)
+	}
+	if routes := p.Routes(PrePolicy, IPv4Unicast); len(routes) != 2 || routes[1].Prefix() != nlri[1] {
+		t.Errorf("Unexpected routes %v", routes)
+	}
+
+	writeMessage(conn, update, newUpdate(nlri[1:], nil, nil))
+	waitForRoutes(t, p, PrePolicy, IPv4Unicast, 1)
+
+	conn.Close()
+	waitForState(t, p.fsm, idle)
+	if n := p.RouteCount(PrePolicy, IPv4Unicast); n != 0 {
+		t.Errorf("Expected the routes to be removed with the session got %d", n)
+	}
+}
+
+func TestSetImportPolicyWhileRunning(t *testing.T) {
+	p, conn := establishedPeer(t, 0, 0)
+	attrs := pathAttributes{
+		present: map[uint8]bool{origin: true, asPath: true},
+		asPath:  asPathAttr{sequence(65001)},
+		nextHop: netip.MustParseAddr("192.0.2.2"),
+	}
+	nlri := []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24"), netip.MustParsePrefix("203.0.113.0/25")}
+	writeMessage(conn, update, newUpdate(nil, attrs.raw(false), nlri))
+	waitForRoutes(t, p, PostPolicy, IPv4Unicast, 2)
+	// The change is made in the event loop and applies to the routes
+	// already learned
+	p.SetImportPolicy(PolicyFunc(func(r Route) (Route, bool) {
+		return r, r.Prefix().Bits() <= 24
+	}))
+	if n := p.RouteCount(PostPolicy, IPv4Unicast); n != 1 {
+		t.Errorf("Expected 1 route to be accepted got %d", n)
+	}
+}
+
+func TestHostBitsCleared(t *testing.T) {
+	p, conn := establishedPeer(t, 0, 0)
+	attrs := pathAttributes{
+		present: map[uint8]bool{origin: true, asPath: true},
+		asPath:  asPathAttr{sequence(65001)},
+		nextHop: netip.MustParseAddr("192.0.2.2"),
+	}
+	// The same destination sent with different host bits
+	nlri := []netip.Prefix{netip.MustParsePrefix("10.128.0.0/9"), netip.MustParsePrefix("10.129.0.0/9")}
+	writeMessage(conn, update, newUpdate(nil, attrs.raw(false), nlri))
+	waitForRoutes(t, p, PrePolicy, IPv4Unicast, 1)
+	routes := p.Routes(PostPolicy, IPv4Unicast)
+	if len(routes) != 1 || routes[0].Prefix() != netip.MustParsePrefix("10.128.0.0/9") {
+		t.Errorf("Expected a route to 10.128.0.0/9 got %v", routes)
+	}
+
+	// and withdrawn with yet others
+	writeMessage(conn, update, newUpdate([]netip.Prefix{netip.MustParsePrefix("10.255.0.0/9")}, nil, nil))
+	waitForRoutes(t, p, PrePolicy, IPv4Unicast, 0)
+}
@@ -1,81 +1,426 @@
 package kbgp
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
+// BGP listens on TCP port 179
+// https://tools.ietf.org/html/rfc4271#section-8.2.1.3
+const port = 179
+
 // Speaker is a BGP speaking router
 type Speaker struct {
-	as    asn
-	addr  string
+	as       asn
+	addrs    []string
+	routerID bgpIdentifier
+	// Whether WithRouterID was given, even with an address that is not
+	// a valid BGP Identifier
+	routerIDSet bool
+	// Timers for peers that do not set their own
+	timers sessionTimers
+
+	// Guards peers, which are added and removed while running
+	mu    sync.RWMutex
 	peers []*Peer
+	// Where peers are created from as they connect
+	ranges []listenRange
+
+	// The best paths learned from all of the peers
+	igpCost IGPCost
+	locRIB  *locRIB
+	// The path attributes the routes in every RIB share
+	attrs *attrCache
+
+	// Cancelled when the speaker shuts down
+	ctx  context.Context
+	stop context.CancelFunc
+	// Goroutines serving listeners and new connections, added to under mu
+	// so that none are added once shutdown is waiting for them
+	wg sync.WaitGroup
+}
+
+// SpeakerOption configures a Speaker
+type SpeakerOption func(*Speaker)
+
+// WithListenAddrs has the speaker listen on more addresses, each in
+// host:port form
+func WithListenAddrs(addrs ...string) SpeakerOption {
+	return func(s *Speaker) {
+		s.addrs = append(s.addrs, addrs...)
+	}
+}
+
+// WithRouterID sets the BGP Identifier the speaker sends in OPEN messages,
+// which must be an IPv4 address. Start fails with any other.
+func WithRouterID(ip net.IP) SpeakerOption {
+	return func(s *Speaker) {
+		s.routerIDSet = true
+		s.routerID = 0
+		if ip.To4() != nil {
+			s.routerID = newIdentifier(ip)
+		}
+	}
+}
+
+// WithHoldTime sets the hold time offered to peers that do not set their
+// own
+func WithHoldTime(d time.Duration) SpeakerOption {
+	return func(s *Speaker) {
+		s.timers.holdTime = &d
+	}
+}
+
+// WithKeepaliveTime sets how often KEEPALIVEs are sent to peers that do not
+// set their own
+func WithKeepaliveTime(d time.Duration) SpeakerOption {
+	return func(s *Speaker) {
+		s.timers.keepaliveTime = &d
+	}
+}
+
+// WithConnectRetryTime sets how long to wait between attempts to connect to
+// peers that do not set their own
+func WithConnectRetryTime(d time.Duration) SpeakerOption {
+	return func(s *Speaker) {
+		s.timers.connectRetryTime = &d
+	}
+}
+
+// WithIGPCost sets how the cost of reaching a next hop is found. Paths to a
+// next hop that is not reachable are not used. Without it every next hop
+// is reachable at the same cost.
+func WithIGPCost(cost IGPCost) SpeakerOption {
+	return func(s *Speaker) {
+		s.igpCost = cost
+	}
 }
 
-// NewSpeaker creates a new BGP speaking router
-func NewSpeaker(as asn, addr string) *Speaker {
-	return &Speaker{as: as, addr: addr}
+// NewSpeaker creates a new BGP speaking router that listens on addr. An
+// addr of ":179" accepts connections over both IPv4 and IPv6, and an empty
+// addr leaves it to Serve. Without a router ID the highest IPv4 address of
+// the system is used.
+func NewSpeaker(as asn, addr string, options ...SpeakerOption) *Speaker {
+	s := &Speaker{as: as, addrs: []string{addr}, attrs: newAttrCache()}
+	s.ctx, s.stop = context.WithCancel(context.Background())
+	for _, option := range options {
+		option(s)
+	}
+	if !s.routerIDSet {
+		s.routerID = systemRouterID()
+	}
+	s.locRIB = newLocRIB(as, s.igpCost)
+	s.locRIB.changed = s.export
+	return s
 }
 
-// Start the BGP speaker
-func (s *Speaker) Start() {
-	ln, err := net.Listen("tcp", ":179")
+// systemRouterID picks the highest IPv4 unicast address of the system's
+// interfaces as a BGP Identifier, or returns 0 if there is none
+func systemRouterID() bgpIdentifier {
+	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		log.Fatal(err)
+		return 0
+	}
+	var id bgpIdentifier
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if candidate := newIdentifier(ipnet.IP); candidate > id {
+			id = candidate
+		}
+	}
+	return id
+}
+
+// Start listens on the speaker's addresses and serves its peers until ctx
+// is cancelled, the speaker is shut down, or a listener fails. Every peer
+// is then shut down, with a Cease NOTIFICATION message for those with a
+// session, and Start returns once all of the speaker's goroutines have
+// exited.
+func (s *Speaker) Start(ctx context.Context) error {
+	if !s.routerID.valid() {
+		return errors.New("no valid router ID, set one with WithRouterID")
+	}
+	var listeners []net.Listener
+	for _, addr := range s.addrs {
+		if addr == "" {
+			continue
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+	failed := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func() {
+			if err := s.Serve(ln); err != nil {
+				failed <- err
+			}
+		}()
+	}
+	var err error
+	select {
+	case <-ctx.Done():
+	case <-s.ctx.Done():
+	case err = <-failed:
+	}
+	s.shutdown()
+	return err
+}
+
+// Shutdown stops the speaker serving connections and shuts down every
+// peer, with a Cease NOTIFICATION message for those with a session. It
+// returns once all of the speaker's goroutines have exited. A speaker that
+// is only served with Serve is stopped this way.
+func (s *Speaker) Shutdown() {
+	s.shutdown()
+}
+
+// Serve accepts connections from peers on ln until the speaker is shut
+// down, or ln fails. The listener is closed when Serve returns.
+func (s *Speaker) Serve(ln net.Listener) error {
+	defer ln.Close()
+	if !s.track() {
+		return nil
 	}
+	defer s.wg.Done()
+	// Accept returns once the listener is closed
+	defer context.AfterFunc(s.ctx, func() { ln.Close() })()
+	log.Println("listening on", ln.Addr())
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Println(err)
-			continue
+			if s.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if !s.track() {
+			conn.Close()
+			return nil
 		}
-		go s.handleConnection(conn)
+		go func() {
+			defer s.wg.Done()
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+// track counts another goroutine for shutdown to wait for, returning false
+// if the speaker has already been shut down
+func (s *Speaker) track() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.ctx.Err() != nil {
+		return false
 	}
+	s.wg.Add(1)
+	return true
+}
+
+// shutdown stops accepting connections and shuts down every peer, waiting
+// for them to finish
+func (s *Speaker) shutdown() {
+	log.Println("shutting down")
+	s.mu.Lock()
+	s.stop()
+	peers := s.peers
+	s.peers = nil
+	s.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.shutdown(administrativeShutdown)
+		}()
+	}
+	wg.Wait()
+	s.wg.Wait()
 }
 
 func (s *Speaker) handleConnection(conn net.Conn) {
 	log.Println("handling connection from", conn.RemoteAddr())
-	header, body, err := readHeader(conn)
+	// Don't wait on a peer that is slow to send its OPEN message when
+	// shutting down
+	defer context.AfterFunc(s.ctx, func() { conn.Close() })()
+	// Nor wait forever on one that never sends it
+	conn.SetReadDeadline(time.Now().Add(largeHoldTime))
+	open, err := readOpenMessage(conn)
+	conn.SetReadDeadline(time.Time{})
 	if err != nil {
-		log.Println("header error")
-		writeMessage(conn, notification, newNotification(err))
+		log.Println("bad open message", err)
+		var e bgpError
+		if errors.As(err, &e) {
+			writeMessage(conn, notification, newNotification(err))
+		}
 		conn.Close()
 		return
 	}
-	if header.msgType != open {
-		log.Println("expected an open message")
-		writeMessage(conn, notification, newNotification(err))
-		conn.Close()
+	if p := s.match(open.peerAS(), conn.RemoteAddr()); p != nil {
+		log.Println("found a matching peer")
+		p.handleConnection(conn, open)
 		return
 	}
-	open, err := readOpen(body)
-	if err != nil {
-		log.Println("bad open message")
-		writeMessage(conn, notification, newNotification(err))
-		conn.Close()
+	if p := s.dynamicPeer(open.peerAS(), conn.RemoteAddr()); p != nil {
+		p.handleConnection(conn, open)
 		return
 	}
+	log.Println("no matching peer found for", open.peerAS(), conn.RemoteAddr())
+	writeMessage(conn, notification, newNotification(newBGPError(openMessageError, badPeerAS, "")))
+	conn.Close()
+}
+
+// splitAddr returns the IP address and IPv6 zone of a TCP endpoint
+func splitAddr(addr net.Addr) (net.IP, string) {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP, tcp.Zone
+	}
+	// Anything else has to be in host:port form, with IPv6 addresses
+	// in brackets
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, ""
+	}
+	ip, zone, _ := strings.Cut(host, "%")
+	return net.ParseIP(ip), zone
+}
+
+// match finds the peer with the AS number as that a connection from addr
+// is from
+func (s *Speaker) match(as asn, addr net.Addr) *Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	for _, p := range s.peers {
-		if p.remoteAS == open.as && p.remoteIP.Equal(addrToIP(conn.RemoteAddr())) {
-			log.Println("found a matching peer")
-			go p.handleConnection(conn, open)
-			return
+		if p.remoteAS == as && p.matches(addr) {
+			return p
 		}
 	}
-	log.Println("no matching peer found for", open.as, conn.RemoteAddr())
-	writeMessage(conn, notification, newNotification(newBGPError(openMessageError, badPeerAS, "")))
-	conn.Close()
+	return nil
 }
 
-func addrToIP(addr net.Addr) net.IP {
-	return net.ParseIP(strings.Split(addr.String(), ":")[0])
+// find returns the index of the peer at the same address as q, or -1 if
+// there is none
+func (s *Speaker) find(q *Peer) int {
+	return s.findAddr(q.remoteIP, q.zone)
 }
 
-// Peer adds a BGP neighbor to the speaker
-func (s *Speaker) Peer(p *Peer) {
-	log.Println("adding peer to speaker", p)
+// findAddr returns the index of the peer at ip and zone, or -1 if there is
+// none
+func (s *Speaker) findAddr(ip net.IP, zone string) int {
+	for i, p := range s.peers {
+		if p.remoteIP.Equal(ip) && p.zone == zone {
+			return i
+		}
+	}
+	return -1
+}
+
+// adopt makes p one of the speaker's peers, and one of its group's
+func (s *Speaker) adopt(p *Peer) {
 	// Let this peer know who we are
 	p.myAS = s.as
+	p.myID = s.routerID
+	p.speaker = s
+	p.adjRIBIn.cache = s.attrs
+	if p.group != nil {
+		p.group.join(p)
+	}
+	p.apply()
+	p.start()
+}
+
+// AddPeer adds a BGP neighbor to the speaker. There can only be one peer at
+// an address.
+func (s *Speaker) AddPeer(p *Peer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		return errors.New("speaker has been shut down")
+	}
+	if s.find(p) >= 0 {
+		return fmt.Errorf("there is already a peer at %s", p.addr().IP)
+	}
+	log.Println("adding peer to speaker", p)
+	s.adopt(p)
 	s.peers = append(s.peers, p)
+	return nil
+}
+
+// RemovePeer removes the peer at the same address as p from the speaker.
+// Its session is shut down with a Peer De-configured Cease NOTIFICATION
+// message.
+func (s *Speaker) RemovePeer(p *Peer) error {
+	s.mu.Lock()
+	i := s.find(p)
+	if i < 0 {
+		s.mu.Unlock()
+		return fmt.Errorf("no peer at %s", p.addr().IP)
+	}
+	removed := s.peers[i]
+	s.peers = slices.Delete(s.peers, i, i+1)
+	log.Println("removing peer from speaker", removed)
+	s.mu.Unlock()
+	removed.shutdown(peerDeconfigured)
+	return nil
+}
+
+// UpdatePeer changes the settings and group of the peer at the same address
+// as p to those of p, which must be a new Peer that has not been added to a
+// speaker. Changes to what is sent in the OPEN message or how we connect
+// reset the session with an Other Configuration Change Cease NOTIFICATION
+// message. Anything else applies straight away.
+func (s *Speaker) UpdatePeer(p *Peer) error {
+	s.mu.Lock()
+	i := s.find(p)
+	if i < 0 {
+		s.mu.Unlock()
+		return fmt.Errorf("no peer at %s", p.addr().IP)
+	}
+	current := s.peers[i]
+	s.mu.Unlock()
+	if current == p {
+		return errors.New("peer settings must be updated with a new Peer")
+	}
+	current.do(func() {
+		log.Println("updating peer", current)
+		current.reconfigure(func() {
+			current.identify(func() { current.remoteAS = p.remoteAS })
+			current.remotePort = p.remotePort
+			current.localIP = p.localIP
+			current.localPort = p.localPort
+			current.settings = p.settings
+			if current.group != p.group {
+				if current.group != nil {
+					current.group.leave(current)
+				}
+				if p.group != nil {
+					p.group.join(current)
+				}
+				current.group = p.group
+			}
+		})
+	})
+	return nil
+}
+
+// Peers returns the speaker's peers
+func (s *Speaker) Peers() []*Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.peers)
 }
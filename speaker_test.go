@@ -0,0 +1,514 @@
+package kbgp
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stringAddr is a net.Addr that is only known by its string form
+type stringAddr string
+
+func (s stringAddr) Network() string { return "tcp" }
+func (s stringAddr) String() string  { return string(s) }
+
+func TestSplitAddr(t *testing.T) {
+	cases := map[string]struct {
+		addr net.Addr
+		ip   string
+		zone string
+	}{
+		"IPv4":              {&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 179}, "192.0.2.1", ""},
+		"IPv6":              {&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 179}, "2001:db8::1", ""},
+		"link-local":        {&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 179, Zone: "eth0"}, "fe80::1", "eth0"},
+		"IPv4 string":       {stringAddr("192.0.2.1:179"), "192.0.2.1", ""},
+		"IPv6 string":       {stringAddr("[2001:db8::1]:179"), "2001:db8::1", ""},
+		"link-local string": {stringAddr("[fe80::1%eth0]:179"), "fe80::1", "eth0"},
+	}
+	for name, c := range cases {
+		ip, zone := splitAddr(c.addr)
+		if !ip.Equal(net.ParseIP(c.ip)) || zone != c.zone {
+			t.Errorf("%s: expected %s %q got %s %q", name, c.ip, c.zone, ip, zone)
+		}
+	}
+}
+
+func TestPeerMatches(t *testing.T) {
+	p := NewPeer(65001, net.ParseIP("fe80::1"))
+	eth0 := &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 40000, Zone: "eth0"}
+	eth1 := &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 40000, Zone: "eth1"}
+	if !p.matches(eth0) || !p.matches(eth1) {
+		t.Error("Expected a peer without a zone to match any interface")
+	}
+	p.SetZone("eth0")
+	if !p.matches(eth0) || p.matches(eth1) {
+		t.Error("Expected a peer with a zone to only match that interface")
+	}
+	if p.matches(&net.TCPAddr{IP: net.ParseIP("fe80::2"), Zone: "eth0"}) {
+		t.Error("Did not expect a different address to match")
+	}
+	if p.String() != "AS65001/fe80::1%eth0" {
+		t.Errorf("Unexpected peer name %s", p)
+	}
+	if p.addr().String() != "[fe80::1%eth0]:179" {
+		t.Errorf("Unexpected peer address %s", p.addr())
+	}
+}
+
+func TestIPv6Connection(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer conn.Close()
+	p := NewPeer(65001, net.ParseIP("::1"))
+	if !p.matches(conn.RemoteAddr()) {
+		t.Errorf("Expected %s to match %s", p, conn.RemoteAddr())
+	}
+}
+
+func TestSpeakerOptions(t *testing.T) {
+	s := NewSpeaker(65000, "127.0.0.1:1179",
+		WithListenAddrs("[::1]:1179"),
+		WithRouterID(net.ParseIP("192.0.2.10")),
+		WithHoldTime(30*time.Second),
+		WithKeepaliveTime(5*time.Second),
+		WithConnectRetryTime(7*time.Second))
+	if len(s.addrs) != 2 || s.addrs[1] != "[::1]:1179" {
+		t.Errorf("Unexpected listen addresses %v", s.addrs)
+	}
+	inherits := NewPeer(65001, net.ParseIP("192.0.2.1"))
+	overrides := NewPeer(65002, net.ParseIP("192.0.2.2"))
+	overrides.SetHoldTime(9 * time.Second)
+	addPeer(t, s, inherits)
+	addPeer(t, s, overrides)
+
+	cases := []struct {
+		p            *Peer
+		offered      time.Duration
+		holdTime     time.Duration
+		keepalive    time.Duration
+		connectRetry time.Duration
+	}{
+		{inherits, 90 * time.Second, 30 * time.Second, 5 * time.Second, 7 * time.Second},
+		{inherits, 6 * time.Second, 6 * time.Second, 2 * time.Second, 7 * time.Second},
+		{overrides, 90 * time.Second, 9 * time.Second, 3 * time.Second, 7 * time.Second},
+	}
+	for _, c := range cases {
+		o := newOpen(c.p)
+		if o.bgpIdentifier.String() != "192.0.2.10" {
+			t.Errorf("%s: expected BGP Identifier 192.0.2.10 got %s", c.p, o.bgpIdentifier)
+		}
+		if time.Duration(o.holdTime)*time.Second != c.p.sessionTimers().hold() {
+			t.Errorf("%s: unexpected hold time %d in the OPEN", c.p, o.holdTime)
+		}
+		c.p.fsm.negotiateHoldTime(c.offered)
+		if c.p.fsm.holdTime != c.holdTime || c.p.fsm.keepaliveTime != c.keepalive {
+			t.Errorf("%s: expected hold time %s and keepalive time %s got %s and %s", c.p,
+				c.holdTime, c.keepalive, c.p.fsm.holdTime, c.p.fsm.keepaliveTime)
+		}
+		if d := c.p.sessionTimers().connectRetry(); d != c.connectRetry {
+			t.Errorf("%s: expected ConnectRetryTime %s got %s", c.p, c.connectRetry, d)
+		}
+	}
+}
+
+// startSpeaker runs the speaker until the test is over
+func startSpeaker(t *testing.T, s *Speaker) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- s.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-stopped; err != nil {
+			t.Error("Unexpected error", err)
+		}
+	})
+}
+
+// serveSpeaker has the speaker serve a loopback listener until the test is
+// over, and returns the address it listens on
+func serveSpeaker(t *testing.T, s *Speaker) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	served := make(chan error)
+	go func() { served <- s.Serve(ln) }()
+	t.Cleanup(func() {
+		s.Shutdown()
+		if err := <-served; err != nil {
+			t.Error("Unexpected error", err)
+		}
+	})
+	return ln.Addr().String()
+}
+
+// waitForListening waits a while for a speaker to be listening on addr
+func waitForListening(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a speaker listening on", addr, "got", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// freeAddr finds a port that is free to listen on at ip
+func freeAddr(t *testing.T, ip string) string {
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		t.Skip("Cannot listen on", ip, err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestSpeakersOnUnprivilegedPorts(t *testing.T) {
+	addrA, addrB := freeAddr(t, "127.0.0.1"), freeAddr(t, "127.0.0.1")
+	addrA6 := freeAddr(t, "::1")
+	a := NewSpeaker(65000, addrA, WithListenAddrs(addrA6),
+		WithRouterID(net.ParseIP("192.0.2.1")), WithHoldTime(30*time.Second))
+	b := NewSpeaker(65001, addrB, WithRouterID(net.ParseIP("192.0.2.2")),
+		WithConnectRetryTime(50*time.Millisecond))
+
+	// b connects to a over both IPv4 and IPv6
+	var toA, fromB []*Peer
+	for _, addr := range []string{addrA, addrA6} {
+		host, port, _ := net.SplitHostPort(addr)
+		p := NewPeer(65001, net.ParseIP(host))
+		p.SetPassive(true)
+		addPeer(t, a, p)
+		fromB = append(fromB, p)
+
+		p = NewPeer(65000, net.ParseIP(host))
+		remotePort, _ := strconv.Atoi(port)
+		p.SetRemotePort(remotePort)
+		addPeer(t, b, p)
+		toA = append(toA, p)
+	}
+	startSpeaker(t, a)
+	startSpeaker(t, b)
+	// A refused connection holds the peer in Idle for the ConnectRetryTime
+	waitForListening(t, addrA)
+	waitForListening(t, addrA6)
+	for i := range toA {
+		fromB[i].Up()
+		toA[i].Up()
+	}
+	for i := range toA {
+		waitForState(t, fromB[i].fsm, established)
+		waitForState(t, toA[i].fsm, established)
+		var holdTime time.Duration
+		toA[i].do(func() { holdTime = toA[i].fsm.holdTime })
+		if holdTime != 30*time.Second {
+			t.Errorf("Expected a negotiated hold time of 30s got %s", holdTime)
+		}
+	}
+}
+
+// establish plays the remote end of a session that p brings up by
+// connecting to ln
+func establish(t *testing.T, ln net.Listener, p *Peer) net.Conn {
+	t.Helper()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := readOpenMessage(conn); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	remote := NewPeer(65000, net.ParseIP("127.0.0.1"))
+	remote.myAS = 65001
+	remote.myID = newIdentifier(net.ParseIP("192.0.2.2"))
+	writeMessage(conn, open, newOpen(remote))
+	writeMessage(conn, keepalive, newKeepalive())
+	waitForState(t, p.fsm, established)
+	return conn
+}
+
+// expectCease reads a Cease NOTIFICATION message with the given subcode off
+// the connection
+func expectCease(t *testing.T, conn net.Conn, subcode int) {
+	t.Helper()
+	for {
+		h, body, err := readHeader(conn)
+		if err != nil {
+			t.Fatal("Expected a NOTIFICATION message got", err)
+		}
+		if h.msgType != notification {
+			continue
+		}
+		n, _ := readNotification(body)
+		if n.code != cease || int(n.subcode) != subcode {
+			t.Errorf("Expected a Cease with subcode %d got %s", subcode, n)
+		}
+		return
+	}
+}
+
+// addPeer adds p to s, failing the test if it cannot be
+func addPeer(t *testing.T, s *Speaker, p *Peer) {
+	t.Helper()
+	if err := s.AddPeer(p); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+}
+
+func TestSpeakerShutdown(t *testing.T) {
+	s := NewSpeaker(65000, "", WithRouterID(net.ParseIP("192.0.2.1")))
+	ln, p := listen(t)
+	addPeer(t, s, p)
+	idle := NewPeer(65002, net.ParseIP("192.0.2.2"))
+	addPeer(t, s, idle)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- s.Start(ctx) }()
+	speakerLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	served := make(chan error)
+	go func() { served <- s.Serve(speakerLn) }()
+
+	p.Up()
+	conn := establish(t, ln, p)
+
+	// A connection to the speaker that never sends its OPEN message
+	pending, err := net.Dial("tcp", speakerLn.Addr().String())
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer pending.Close()
+
+	cancel()
+	expectCease(t, conn, administrativeShutdown)
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Error("Unexpected error", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected Start to return")
+	}
+	if err := <-served; err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if _, _, err := readHeader(pending); err == nil {
+		t.Error("Expected the pending connection to be closed")
+	}
+	if _, err := speakerLn.Accept(); err == nil {
+		t.Error("Expected the listener to be closed")
+	}
+	select {
+	case <-p.done:
+	default:
+		t.Error("Expected the peer to be shut down")
+	}
+
+	// Nothing is served once the speaker has shut down
+	late, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := s.Serve(late); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if _, err := late.Accept(); err == nil {
+		t.Error("Expected the late listener to be closed")
+	}
+}
+
+func TestStartErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer ln.Close()
+	cases := map[string]*Speaker{
+		"bad router ID":  NewSpeaker(65000, "127.0.0.1:0", WithRouterID(net.ParseIP("127.0.0.1"))),
+		"IPv6 router ID": NewSpeaker(65000, "127.0.0.1:0", WithRouterID(net.ParseIP("2001:db8::1"))),
+		"no router ID":   NewSpeaker(65000, "127.0.0.1:0", WithRouterID(nil)),
+		"address in use": NewSpeaker(65000, "127.0.0.1:0", WithRouterID(net.ParseIP("192.0.2.1")),
+			WithListenAddrs(ln.Addr().String())),
+	}
+	for name, s := range cases {
+		if err := s.Start(context.Background()); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestAddPeer(t *testing.T) {
+	s := NewSpeaker(65000, "", WithRouterID(net.ParseIP("192.0.2.1")))
+	if err := s.AddPeer(NewPeer(65001, net.ParseIP("192.0.2.2"))); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := s.AddPeer(NewPeer(65002, net.ParseIP("192.0.2.2"))); err == nil {
+		t.Error("Expected an error adding a second peer at the same address")
+	}
+	if err := s.AddPeer(NewPeer(65001, net.ParseIP("2001:db8::2"))); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if peers := s.Peers(); len(peers) != 2 {
+		t.Errorf("Expected 2 peers got %d", len(peers))
+	}
+	s.shutdown()
+	if err := s.AddPeer(NewPeer(65001, net.ParseIP("192.0.2.3"))); err == nil {
+		t.Error("Expected an error adding a peer after shutdown")
+	}
+}
+
+func TestRemovePeer(t *testing.T) {
+	s := NewSpeaker(65000, "", WithRouterID(net.ParseIP("192.0.2.1")))
+	startSpeaker(t, s)
+	ln, p := listen(t)
+	addPeer(t, s, p)
+	p.Up()
+	conn := establish(t, ln, p)
+
+	if err := s.RemovePeer(NewPeer(65001, net.ParseIP("127.0.0.1"))); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	expectCease(t, conn, peerDeconfigured)
+	select {
+	case <-p.done:
+	default:
+		t.Error("Expected the peer to be shut down")
+	}
+	if peers := s.Peers(); len(peers) != 0 {
+		t.Errorf("Expected no peers got %d", len(peers))
+	}
+	if err := s.RemovePeer(p); err == nil {
+		t.Error("Expected an error removing a peer that is gone")
+	}
+}
+
+func TestUpdatePeer(t *testing.T) {
+	s := NewSpeaker(65000, "", WithRouterID(net.ParseIP("192.0.2.1")))
+	startSpeaker(t, s)
+	ln, p := listen(t)
+	addPeer(t, s, p)
+	p.Up()
+	conn := establish(t, ln, p)
+
+	// updated returns a copy of p's settings to change
+	updated := func() *Peer {
+		q := NewPeer(65001, net.ParseIP("127.0.0.1"))
+		q.SetRemotePort(p.remotePort)
+		return q
+	}
+
+	// Changing the keepalive time keeps the session
+	q := updated()
+	q.SetKeepaliveTime(time.Second)
+	if err := s.UpdatePeer(q); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	var keepaliveTime time.Duration
+	p.do(func() { keepaliveTime = p.fsm.keepaliveTime })
+	if keepaliveTime != time.Second {
+		t.Errorf("Expected a keepalive time of 1s got %s", keepaliveTime)
+	}
+	if current := fsmState(p.fsm); current != established {
+		t.Errorf("Expected the session to stay established got %s", current)
+	}
+	if peers := s.Peers(); len(peers) != 1 || peers[0] != p {
+		t.Error("Expected the peer to be kept")
+	}
+
+	// Changing the hold time resets the session
+	q = updated()
+	q.SetHoldTime(30 * time.Second)
+	if err := s.UpdatePeer(q); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	expectCease(t, conn, otherConfigurationChange)
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal("Expected the peer to reconnect got", err)
+	}
+	defer conn.Close()
+	o, err := readOpenMessage(conn)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if o.holdTime != 30 {
+		t.Errorf("Expected a hold time of 30 got %d", o.holdTime)
+	}
+
+	if err := s.UpdatePeer(p); err == nil {
+		t.Error("Expected an error updating a peer with itself")
+	}
+	if err := s.UpdatePeer(NewPeer(65001, net.ParseIP("192.0.2.9"))); err == nil {
+		t.Error("Expected an error updating a peer that does not exist")
+	}
+}
+
+func TestConcurrentPeerChanges(t *testing.T) {
+	s := NewSpeaker(65000, "", WithRouterID(net.ParseIP("192.0.2.1")))
+	startSpeaker(t, s)
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := range 8 {
+		ip := net.IPv4(192, 0, 2, byte(10+i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				if err := s.AddPeer(NewPeer(65001, ip)); err != nil {
+					t.Error("Unexpected error", err)
+				}
+				s.Peers()
+				q := NewPeer(65002, ip)
+				q.SetConnectRetryTime(time.Second)
+				if err := s.UpdatePeer(q); err != nil {
+					t.Error("Unexpected error", err)
+				}
+				if err := s.RemovePeer(q); err != nil {
+					t.Error("Unexpected error", err)
+				}
+			}
+		}()
+		// Connections from the peer are matched to it as it changes
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				s.match(65002, &net.TCPAddr{IP: ip})
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	if peers := s.Peers(); len(peers) != 0 {
+		t.Errorf("Expected no peers got %d", len(peers))
+	}
+}
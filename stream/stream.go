@@ -6,25 +6,17 @@ import (
 	"io"
 )
 
-// Read consumes count bytes from the given connection and returns them
-//func Read(conn net.Conn, count int) []byte {
-func Read(r io.Reader, count int) []byte {
-	b := make([]byte, count, count)
-	// Read enough bytes for the message header
+// Read consumes count bytes from the given connection and returns them. An
+// error is returned if the connection fails before they all arrive.
+func Read(r io.Reader, count int) ([]byte, error) {
 	if count == 0 {
-		return nil
+		return nil, nil
 	}
-	for {
-		n, err := r.Read(b)
-		if err != nil {
-			//f.sendEvent(tcpConnectionFails) // This should not be here
-		}
-		if n < count {
-			continue
-		}
-		break
+	b := make([]byte, count)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
 	}
-	return b[:count]
+	return b, nil
 }
 
 // ReadBytes reads n bytes from the byte buffer and returns it
@@ -1,9 +1,23 @@
 package stream
 
-import "testing"
+import (
+	"bytes"
+	"testing"
+	"testing/iotest"
+)
 
 func TestRead(t *testing.T) {
-	// TODO: write this test
+	r := iotest.OneByteReader(bytes.NewReader([]byte{1, 2, 3, 4}))
+	b, err := Read(r, 3)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !bytes.Equal(b, []byte{1, 2, 3}) {
+		t.Errorf("Expected [1 2 3] got %v", b)
+	}
+	if _, err := Read(r, 2); err == nil {
+		t.Error("Expected an error reading past the end")
+	}
 }
 
 func TestReadBytes(t *testing.T) {
@@ -2,71 +2,110 @@ package timer
 
 import (
 	"math/rand"
+	"sync"
 	"time"
 )
 
-// Timer provides a fancier timer than time.Timer
+// Timer provides a fancier timer than time.Timer. It is safe to use from
+// multiple goroutines.
 type Timer struct {
+	mu      sync.Mutex
 	timer   *time.Timer
+	f       func()
 	running bool
+	expired bool
+	// Counts every start and stop so a timer that fires just as it is
+	// being reset or stopped can tell it is out of date
+	generation uint64
 }
 
 // New creates a new timer that will call the given function after
 // the interval has elapsed
 func New(d time.Duration, f func()) *Timer {
-	t := &Timer{
-		running: true,
-	}
-	t.timer = time.AfterFunc(d, t.preflight(f))
+	t := NewStopped(f)
+	t.Reset(d)
 	return t
 }
 
-// preflight takes care of any housekeeping before calling the user's function
-func (t *Timer) preflight(f func()) func() {
-	p := func() {
-		t.running = false
-		f()
+// NewStopped creates a timer that will call the given function once it
+// has been started with Reset
+func NewStopped(f func()) *Timer {
+	return &Timer{f: f}
+}
+
+// fire takes care of any housekeeping before calling the user's function,
+// unless the timer has been reset or stopped since it was started
+func (t *Timer) fire(generation uint64) {
+	t.mu.Lock()
+	if generation != t.generation {
+		t.mu.Unlock()
+		return
 	}
-	return p
+	t.running = false
+	t.expired = true
+	t.mu.Unlock()
+	t.f()
 }
 
-// Reset starts the timer at its initial value
+// Reset starts the timer again with the given interval, whether or not
+// it is running or has already fired
 func (t *Timer) Reset(d time.Duration) {
-	if !t.timer.Stop() {
-		<-t.timer.C
-	}
-	t.timer.Reset(d)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stop()
+	t.running = true
+	generation := t.generation
+	t.timer = time.AfterFunc(d, func() { t.fire(generation) })
 }
 
 // Stop cancels the timer
 func (t *Timer) Stop() {
-	if !t.running {
-		return
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stop()
+}
+
+func (t *Timer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
 	}
-	t.timer.Stop()
+	t.generation++
 	t.running = false
+	t.expired = false
 }
 
 // Running returns true if the timer is counting down, false otherwise
 func (t *Timer) Running() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	return t.running
 }
 
-//    To minimize the likelihood that the distribution of BGP messages by a
-//    given BGP speaker will contain peaks, jitter SHOULD be applied to the
-//    timers associated with MinASOriginationIntervalTimer, KeepaliveTimer,
-//    MinRouteAdvertisementIntervalTimer, and ConnectRetryTimer.  A given
-//    BGP speaker MAY apply the same jitter to each of these quantities,
-//    regardless of the destinations to which the updates are being sent;
-//    that is, jitter need not be configured on a per-peer basis.
+// Expired returns true if the timer has fired and has not been reset or
+// stopped since
+func (t *Timer) Expired() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.expired
+}
 
-//    The suggested default amount of jitter SHALL be determined by
-//    multiplying the base value of the appropriate timer by a random
-//    factor, which is uniformly distributed in the range from 0.75 to 1.0.
-//    A new random value SHOULD be picked each time the timer is set.  The
-//    range of the jitter's random value MAY be configurable.
-func jitter() time.Duration {
-	v := ((rand.Float64() / 4.0) + .75) * 1000
-	j := time.Duration(v) * time.Millisecond
-	return j
+// Jitter returns the interval d scaled by a random factor between 0.75
+// and 1.0
+//
+// To minimize the likelihood that the distribution of BGP messages by a
+// given BGP speaker will contain peaks, jitter SHOULD be applied to the
+// timers associated with MinASOriginationIntervalTimer, KeepaliveTimer,
+// MinRouteAdvertisementIntervalTimer, and ConnectRetryTimer.  A given
+// BGP speaker MAY apply the same jitter to each of these quantities,
+// regardless of the destinations to which the updates are being sent;
+// that is, jitter need not be configured on a per-peer basis.
+//
+// The suggested default amount of jitter SHALL be determined by
+// multiplying the base value of the appropriate timer by a random
+// factor, which is uniformly distributed in the range from 0.75 to 1.0.
+// A new random value SHOULD be picked each time the timer is set.  The
+// range of the jitter's random value MAY be configurable.
+// https://tools.ietf.org/html/rfc4271#section-10
+func Jitter(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * ((rand.Float64() / 4.0) + .75))
 }
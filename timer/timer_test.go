@@ -1,55 +1,56 @@
 package timer
 
 import (
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestNew(t *testing.T) {
-	var ran bool
+	var ran atomic.Bool
 	f := func() {
-		ran = true
+		ran.Store(true)
 	}
 	ts := New(1*time.Second, f)
-	if !ts.running {
+	if !ts.Running() {
 		t.Errorf("Expected timer to be running but it's not")
 	}
 	time.Sleep(1100 * time.Millisecond)
-	if !ran {
+	if !ran.Load() {
 		t.Errorf("Timer did not call our function")
 	}
 }
 
 func TestReset(t *testing.T) {
-	var ran bool
+	var ran atomic.Bool
 	f := func() {
-		ran = true
+		ran.Store(true)
 	}
 	ts := New(1*time.Second, f)
 	time.Sleep(500 * time.Millisecond)
 	ts.Reset(1 * time.Second)
 	time.Sleep(600 * time.Millisecond)
-	if ran {
+	if ran.Load() {
 		t.Errorf("Timer called our function but it shouldn't have")
 	}
 	time.Sleep(500 * time.Millisecond)
-	if !ran {
+	if !ran.Load() {
 		t.Errorf("Timer did not call our function but should have")
 	}
 }
 
 func TestStop(t *testing.T) {
-	var ran bool
+	var ran atomic.Bool
 	f := func() {
-		ran = true
+		ran.Store(true)
 	}
 	ts := New(1*time.Second, f)
 	ts.Stop()
-	if ts.running {
+	if ts.Running() {
 		t.Errorf("Expected timer to be stopped but it's not")
 	}
 	time.Sleep(1100 * time.Millisecond)
-	if ran {
+	if ran.Load() {
 		t.Errorf("Timer called our function but it shouldn't have")
 	}
 }
@@ -66,3 +67,62 @@ func TestRunning(t *testing.T) {
 
 	}
 }
+
+func TestNewStopped(t *testing.T) {
+	ran := make(chan bool, 1)
+	ts := NewStopped(func() { ran <- true })
+	if ts.Running() {
+		t.Errorf("Expected timer to be stopped but it's not")
+	}
+	ts.Reset(10 * time.Millisecond)
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Errorf("Timer did not call our function")
+	}
+}
+
+func TestResetAfterFiring(t *testing.T) {
+	ran := make(chan bool, 2)
+	ts := New(10*time.Millisecond, func() { ran <- true })
+	<-ran
+	ts.Reset(10 * time.Millisecond)
+	if !ts.Running() {
+		t.Errorf("Expected timer to be running but it's not")
+	}
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Errorf("Timer did not call our function again")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		j := Jitter(time.Minute)
+		if j < 45*time.Second || j > time.Minute {
+			t.Errorf("Expected jitter between 45s and 60s got %s", j)
+		}
+	}
+}
+
+func TestExpired(t *testing.T) {
+	ran := make(chan bool, 1)
+	ts := New(10*time.Millisecond, func() { ran <- true })
+	if ts.Expired() {
+		t.Errorf("Expected a running timer not to have expired")
+	}
+	<-ran
+	if !ts.Expired() {
+		t.Errorf("Expected timer to have expired but it hasn't")
+	}
+	ts.Stop()
+	if ts.Expired() {
+		t.Errorf("Expected a stopped timer not to have expired")
+	}
+	ts.Reset(time.Hour)
+	if ts.Expired() || !ts.Running() {
+		t.Errorf("Expected a reset timer to be running")
+	}
+	ts.Stop()
+}
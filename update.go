@@ -0,0 +1,407 @@
+package kbgp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+
+	"github.com/transitorykris/kbgp/stream"
+)
+
+// UPDATE messages are used to transfer routing information between BGP
+// peers.  The information in the UPDATE message can be used to
+// construct a graph that describes the relationships of the various
+// Autonomous Systems.
+// https://tools.ietf.org/html/rfc4271#section-4.3
+type updateMsg struct {
+	withdrawnRoutes []netip.Prefix
+	pathAttributes  []pathAttribute
+	nlri            []netip.Prefix
+}
+
+const minUpdateMessageLength = 23
+
+// The Withdrawn Routes Length and Total Path Attribute Length fields
+const minUpdateBodyLength = minUpdateMessageLength - messageHeaderLength
+
+func newUpdate(withdrawn []netip.Prefix, attributes []pathAttribute, nlri []netip.Prefix) updateMsg {
+	return updateMsg{
+		withdrawnRoutes: withdrawn,
+		pathAttributes:  attributes,
+		nlri:            nlri,
+	}
+}
+
+func readUpdate(msg []byte) (updateMsg, error) {
+	log.Println("Reading UPDATE message")
+	if len(msg) < minUpdateBodyLength {
+		return updateMsg{}, newBGPError(messageHeaderError, badMessageLength,
+			"update message is too short")
+	}
+	buf := bytes.NewBuffer(msg)
+	um := updateMsg{}
+
+	// If the Withdrawn Routes Length or Total Attribute Length is too
+	// large (i.e., if Withdrawn Routes Length + Total Attribute Length
+	// + 23 exceeds the message Length), then the Error Subcode MUST be
+	// set to Malformed Attribute List.
+	withdrawnLength := int(stream.ReadUint16(buf))
+	if withdrawnLength+2 > buf.Len() {
+		return updateMsg{}, newBGPError(updateMessageError, malformedAttributeList,
+			"withdrawn routes length is too large")
+	}
+	withdrawn, err := readPrefixes(stream.ReadBytes(withdrawnLength, buf), afiIPv4)
+	if err != nil {
+		return updateMsg{}, err
+	}
+	um.withdrawnRoutes = withdrawn
+
+	attributesLength := int(stream.ReadUint16(buf))
+	if attributesLength > buf.Len() {
+		return updateMsg{}, newBGPError(updateMessageError, malformedAttributeList,
+			"total path attribute length is too large")
+	}
+	// Errors in the path attributes can be handled without resetting
+	// the session, so we keep going and hand them back with the message
+	attributes, attributesErr := readPathAttributes(stream.ReadBytes(attributesLength, buf))
+	um.pathAttributes = attributes
+
+	// The length, in octets, of the Network Layer Reachability
+	// Information is not encoded explicitly, but is whatever remains
+	nlri, err := readPrefixes(buf.Bytes(), afiIPv4)
+	if err != nil {
+		return updateMsg{}, err
+	}
+	um.nlri = nlri
+
+	log.Println("Got UPDATE message:", um)
+	return um, attributesErr
+}
+
+// bytes implements byter
+func (u updateMsg) bytes() []byte {
+	buf := bytes.NewBuffer([]byte{})
+	withdrawn := prefixesBytes(u.withdrawnRoutes)
+	buf.Write(uint16ToBytes(uint16(len(withdrawn))))
+	buf.Write(withdrawn)
+	attributes := []byte{}
+	for _, a := range u.pathAttributes {
+		attributes = append(attributes, a.bytes()...)
+	}
+	buf.Write(uint16ToBytes(uint16(len(attributes))))
+	buf.Write(attributes)
+	buf.Write(prefixesBytes(u.nlri))
+	return buf.Bytes()
+}
+
+// length implements byter
+func (u updateMsg) length() int { return len(u.bytes()) }
+
+// String implements strings.Stringer
+func (u updateMsg) String() string {
+	return fmt.Sprintf("Withdrawn:%v Attributes:%v NLRI:%v",
+		u.withdrawnRoutes, u.pathAttributes, u.nlri)
+}
+
+// Withdrawn routes and NLRI are each encoded as one or more 2-tuples
+// of the form <length, prefix>.  The Length field indicates the length
+// in bits of the IP address prefix.  The Prefix field contains an IP
+// address prefix, followed by the minimum number of trailing bits
+// needed to make the end of the field fall on an octet boundary.  Note
+// that the value of trailing bits is irrelevant, but we keep them so
+// a message can be written back out exactly as it was read. The
+// multiprotocol attributes encode prefixes of other address families the
+// same way.
+func readPrefixes(b []byte, family afi) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	maxBits := family.addrLength() * 8
+	for len(b) > 0 {
+		bits := int(b[0])
+		octets := prefixOctets(bits)
+		if bits > maxBits || len(b) < 1+octets {
+			return nil, newBGPError(updateMessageError, invalidNetworkField,
+				string(b))
+		}
+		addr := make([]byte, family.addrLength())
+		copy(addr, b[1:1+octets])
+		ip, _ := netip.AddrFromSlice(addr)
+		prefixes = append(prefixes, netip.PrefixFrom(ip, bits))
+		b = b[1+octets:]
+	}
+	return prefixes, nil
+}
+
+// prefixOctets is the number of octets needed to hold a prefix of the
+// given length in bits
+func prefixOctets(bits int) int {
+	return (bits + 7) / 8
+}
+
+func prefixBytes(p netip.Prefix) []byte {
+	return append([]byte{byte(p.Bits())}, p.Addr().AsSlice()[:prefixOctets(p.Bits())]...)
+}
+
+func prefixesBytes(prefixes []netip.Prefix) []byte {
+	b := []byte{}
+	for _, p := range prefixes {
+		b = append(b, prefixBytes(p)...)
+	}
+	return b
+}
+
+// A variable-length sequence of path attributes is present in
+// every UPDATE message, except for an UPDATE message that carries
+// only the withdrawn routes.  Each path attribute is a triple
+// <attribute type, attribute length, attribute value> of variable
+// length.
+type pathAttribute struct {
+	attributeType attributeType
+	value         []byte
+}
+
+// readPathAttributes reads as many path attributes as it can. Any error
+// returned alongside the attributes is one that can be handled without
+// resetting the session.
+func readPathAttributes(b []byte) ([]pathAttribute, error) {
+	var attributes []pathAttribute
+	var errs []error
+	seen := map[uint8]bool{}
+	for len(b) > 0 {
+		a, n, err := readPathAttribute(b)
+		if err != nil {
+			// Once an attribute overruns the list there is no way to find
+			// the rest, so the routes are treated as withdrawn.
+			// https://tools.ietf.org/html/rfc7606#section-4
+			errs = append(errs, err)
+			break
+		}
+		b = b[n:]
+		// If any attribute appears more than once in the UPDATE message,
+		// then the Error Subcode MUST be set to Malformed Attribute List.
+		// RFC 7606 revises this to discard all but the first occurrence.
+		// https://tools.ietf.org/html/rfc7606#section-3
+		if seen[a.attributeType.code] {
+			// If the MP_REACH_NLRI attribute or the MP_UNREACH_NLRI
+			// attribute appears more than once in the UPDATE message,
+			// then a NOTIFICATION message MUST be sent with the Error
+			// Subcode "Malformed Attribute List".
+			code := a.attributeType.code
+			if code == mpReachNLRI || code == mpUnreachNLRI {
+				return nil, newUpdateError(sessionReset, malformedAttributeList,
+					"duplicate "+a.attributeType.String()+" attribute")
+			}
+			errs = append(errs, newUpdateError(attributeDiscard, malformedAttributeList,
+				"duplicate "+a.attributeType.String()+" attribute"))
+			continue
+		}
+		seen[a.attributeType.code] = true
+		attributes = append(attributes, a)
+	}
+	return attributes, errors.Join(errs...)
+}
+
+// readPathAttribute reads a single path attribute off the front of b and
+// returns it along with the number of octets consumed
+func readPathAttribute(b []byte) (pathAttribute, int, error) {
+	if len(b) < 3 {
+		return pathAttribute{}, 0, newUpdateError(treatAsWithdraw, malformedAttributeList,
+			"truncated path attribute")
+	}
+	a := pathAttribute{attributeType: attributeType{flags: b[0], code: b[1]}}
+	headerLength := 3
+	length := int(b[2])
+	if a.attributeType.extendedLength() {
+		if len(b) < 4 {
+			return pathAttribute{}, 0, newUpdateError(treatAsWithdraw, malformedAttributeList,
+				"truncated path attribute")
+		}
+		headerLength = 4
+		length = int(b[2])<<8 | int(b[3])
+	}
+	if len(b) < headerLength+length {
+		return pathAttribute{}, 0, newUpdateError(treatAsWithdraw, attributeLengthError,
+			string(b))
+	}
+	a.value = make([]byte, length)
+	copy(a.value, b[headerLength:headerLength+length])
+	return a, headerLength + length, nil
+}
+
+// bytes implements byter
+func (p pathAttribute) bytes() []byte {
+	t := p.attributeType
+	// The Extended Length bit MAY be set on short attributes, and is
+	// preserved if so, but MUST be set for attributes over 255 octets.
+	if len(p.value) > 255 {
+		t.setExtendedLength()
+	}
+	buf := bytes.NewBuffer([]byte{})
+	buf.WriteByte(t.flags)
+	buf.WriteByte(t.code)
+	if t.extendedLength() {
+		buf.Write(uint16ToBytes(uint16(len(p.value))))
+	} else {
+		buf.WriteByte(byte(len(p.value)))
+	}
+	buf.Write(p.value)
+	return buf.Bytes()
+}
+
+// length implements byter
+func (p pathAttribute) length() int { return len(p.bytes()) }
+
+// String implements strings.Stringer
+func (p pathAttribute) String() string {
+	return fmt.Sprintf("%s:%x", p.attributeType, p.value)
+}
+
+// Attribute Type is a two-octet field that consists of the
+// Attribute Flags octet, followed by the Attribute Type Code
+// octet.
+type attributeType struct {
+	flags uint8
+	code  uint8
+}
+
+// String implements strings.Stringer
+func (a attributeType) String() string {
+	name, ok := pathAttributeName[a.code]
+	if !ok {
+		return fmt.Sprintf("UNKNOWN(%d)", a.code)
+	}
+	return name
+}
+
+// The high-order bit (bit 0) of the Attribute Flags octet is the
+// Optional bit.  It defines whether the attribute is optional (if
+// set to 1) or well-known (if set to 0).
+const optional = 1 << 7
+const wellKnown = 0
+
+func (a attributeType) optional() bool {
+	return a.flags&optional == optional
+}
+
+func (a *attributeType) setOptional() {
+	a.flags = a.flags | optional
+}
+
+func (a attributeType) wellKnown() bool {
+	return a.flags&optional == wellKnown
+}
+
+func (a *attributeType) setWellKnown() {
+	a.flags = a.flags &^ optional
+}
+
+// The second high-order bit (bit 1) of the Attribute Flags octet
+// is the Transitive bit.  It defines whether an optional
+// attribute is transitive (if set to 1) or non-transitive (if set
+// to 0).
+// For well-known attributes, the Transitive bit MUST be set to 1.
+const transitive = 1 << 6
+const nonTransitive = 0
+
+func (a attributeType) transitive() bool {
+	return a.flags&transitive == transitive
+}
+
+func (a *attributeType) setTransitive() {
+	a.flags = a.flags | transitive
+}
+
+func (a attributeType) nonTransitive() bool {
+	return a.flags&transitive == nonTransitive
+}
+
+func (a *attributeType) setNonTransitive() {
+	a.flags = a.flags &^ transitive
+}
+
+// The third high-order bit (bit 2) of the Attribute Flags octet
+// is the Partial bit.  It defines whether the information
+// contained in the optional transitive attribute is partial (if
+// set to 1) or complete (if set to 0).  For well-known attributes
+// and for optional non-transitive attributes, the Partial bit
+// MUST be set to 0.
+const partial = 1 << 5
+const complete = 0
+
+func (a attributeType) partial() bool {
+	return a.flags&partial == partial
+}
+
+func (a *attributeType) setPartial() {
+	a.flags = a.flags | partial
+}
+
+func (a attributeType) complete() bool {
+	return a.flags&partial == complete
+}
+
+func (a *attributeType) setComplete() {
+	a.flags = a.flags &^ partial
+}
+
+// The fourth high-order bit (bit 3) of the Attribute Flags octet
+// is the Extended Length bit.  It defines whether the Attribute
+// Length is one octet (if set to 0) or two octets (if set to 1).
+const extendedLength = 1 << 4
+const notExtendedLength = 0
+
+func (a attributeType) extendedLength() bool {
+	return a.flags&extendedLength == extendedLength
+}
+
+func (a *attributeType) setExtendedLength() {
+	a.flags = a.flags | extendedLength
+}
+
+func (a attributeType) notExtendedLength() bool {
+	return a.flags&extendedLength == notExtendedLength
+}
+
+func (a *attributeType) setNotExtendedLength() {
+	a.flags = a.flags &^ extendedLength
+}
+
+// Attribute Type Codes
+// https://tools.ietf.org/html/rfc4271#section-5
+const (
+	_ = iota
+	origin
+	asPath
+	nextHop
+	multiExitDisc
+	localPref
+	atomicAggregate
+	aggregator
+)
+
+// https://tools.ietf.org/html/rfc4760#section-3
+const (
+	mpReachNLRI   = 14
+	mpUnreachNLRI = 15
+)
+
+// https://tools.ietf.org/html/rfc6793#section-9
+const (
+	as4Path       = 17
+	as4Aggregator = 18
+)
+
+var pathAttributeName = map[uint8]string{
+	origin:          "ORIGIN",
+	asPath:          "AS_PATH",
+	nextHop:         "NEXT_HOP",
+	multiExitDisc:   "MULTI_EXIT_DISC",
+	localPref:       "LOCAL_PREF",
+	atomicAggregate: "ATOMIC_AGGREGATE",
+	aggregator:      "AGGREGATOR",
+	mpReachNLRI:     "MP_REACH_NLRI",
+	mpUnreachNLRI:   "MP_UNREACH_NLRI",
+	as4Path:         "AS4_PATH",
+	as4Aggregator:   "AS4_AGGREGATOR",
+}
@@ -0,0 +1,156 @@
+package kbgp
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestOptionalAttribute(t *testing.T) {
+	a := attributeType{flags: optional}
+	if !a.optional() {
+		t.Error("Expected attribute to be optional")
+	}
+	if a.wellKnown() {
+		t.Error("Did not expect attribute to be well-known")
+	}
+	a.setWellKnown()
+	if !a.wellKnown() {
+		t.Error("Expected attribute to be well-known")
+	}
+}
+
+func TestAttributeFlagsNotSquashed(t *testing.T) {
+	a := attributeType{flags: optional | transitive | partial | extendedLength}
+	a.setNonTransitive()
+	if a.flags != optional|partial|extendedLength {
+		t.Errorf("Expected only the transitive bit to be cleared, got %08b", a.flags)
+	}
+	a.setComplete()
+	a.setNotExtendedLength()
+	if a.flags != optional {
+		t.Errorf("Expected only the optional bit to remain, got %08b", a.flags)
+	}
+	a.setTransitive()
+	a.setPartial()
+	if !a.transitive() || !a.partial() || !a.optional() || a.extendedLength() {
+		t.Errorf("Unexpected flags %08b", a.flags)
+	}
+}
+
+func TestUpdateRoundTrip(t *testing.T) {
+	cases := map[string][]byte{
+		"empty": {0, 0, 0, 0},
+		"withdraw only": {
+			0, 6, 24, 10, 1, 2, 8, 192,
+			0, 0,
+		},
+		"announce": {
+			0, 0,
+			0, 18,
+			0x40, origin, 1, 0,
+			0x40, asPath, 4, 2, 1, 0xfd, 0xe8,
+			0x40, nextHop, 4, 192, 0, 2, 1,
+			16, 172, 16, 32, 10, 0, 0, 0, 0,
+		},
+		"extended length on a short attribute": {
+			0, 0,
+			0, 8,
+			0x50, atomicAggregate, 0, 0,
+			0xc0 | 0x10, 99, 0, 0,
+			0,
+		},
+		"trailing bits preserved": {
+			0, 4, 23, 10, 1, 3,
+			0, 0,
+			9, 255, 128,
+		},
+	}
+	for name, raw := range cases {
+		u, err := readUpdate(raw)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if !bytes.Equal(u.bytes(), raw) {
+			t.Errorf("%s: expected %v got %v", name, raw, u.bytes())
+		}
+	}
+}
+
+func TestUpdateEncode(t *testing.T) {
+	u := newUpdate(
+		[]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		[]pathAttribute{{attributeType{flags: transitive, code: origin}, []byte{0}}},
+		[]netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("192.0.2.1/32")},
+	)
+	expected := []byte{
+		0, 2, 8, 10,
+		0, 4, 0x40, origin, 1, 0,
+		0, 32, 192, 0, 2, 1,
+	}
+	if !bytes.Equal(u.bytes(), expected) {
+		t.Errorf("Expected %v got %v", expected, u.bytes())
+	}
+	if u.length() != len(expected) {
+		t.Errorf("Expected length %d got %d", len(expected), u.length())
+	}
+}
+
+func TestLongAttributeUsesExtendedLength(t *testing.T) {
+	a := pathAttribute{attributeType{flags: optional | transitive, code: 99}, make([]byte, 300)}
+	b := a.bytes()
+	if b[0]&extendedLength == 0 {
+		t.Error("Expected the extended length bit to be set")
+	}
+	if len(b) != 304 {
+		t.Errorf("Expected 304 octets got %d", len(b))
+	}
+}
+
+func TestReadUpdateErrors(t *testing.T) {
+	cases := map[string]struct {
+		raw     []byte
+		code    int
+		subcode int
+		action  errorAction
+	}{
+		"too short":               {[]byte{0, 0, 0}, messageHeaderError, badMessageLength, sessionReset},
+		"withdrawn too long":      {[]byte{0, 9, 0, 0}, updateMessageError, malformedAttributeList, sessionReset},
+		"attributes too long":     {[]byte{0, 0, 0, 9}, updateMessageError, malformedAttributeList, sessionReset},
+		"bad prefix length":       {[]byte{0, 0, 0, 0, 33, 1, 2, 3, 4, 5}, updateMessageError, invalidNetworkField, sessionReset},
+		"truncated prefix":        {[]byte{0, 0, 0, 0, 24, 10, 1}, updateMessageError, invalidNetworkField, sessionReset},
+		"truncated attribute":     {[]byte{0, 0, 0, 2, 0x40, origin}, updateMessageError, malformedAttributeList, treatAsWithdraw},
+		"attribute length":        {[]byte{0, 0, 0, 4, 0x40, origin, 2, 0}, updateMessageError, attributeLengthError, treatAsWithdraw},
+		"duplicate attribute":     {[]byte{0, 0, 0, 8, 0x40, origin, 1, 0, 0x40, origin, 1, 0}, updateMessageError, malformedAttributeList, attributeDiscard},
+		"truncated extended attr": {[]byte{0, 0, 0, 3, 0x50, origin, 0}, updateMessageError, malformedAttributeList, treatAsWithdraw},
+	}
+	for name, c := range cases {
+		_, err := readUpdate(c.raw)
+		var e bgpError
+		if !errors.As(err, &e) {
+			t.Errorf("%s: expected a bgpError got %v", name, err)
+			continue
+		}
+		if e.code != c.code || e.subcode != c.subcode {
+			t.Errorf("%s: expected %d/%d got %d/%d", name, c.code, c.subcode, e.code, e.subcode)
+		}
+		if updateErrorAction(err) != c.action {
+			t.Errorf("%s: expected %s got %s", name, c.action, updateErrorAction(err))
+		}
+	}
+}
+
+func TestDuplicateAttributeKeepsFirst(t *testing.T) {
+	u, err := readUpdate([]byte{0, 0, 0, 8, 0x40, origin, 1, egp, 0x40, origin, 1, igp, 8, 10})
+	if updateErrorAction(err) != attributeDiscard {
+		t.Errorf("Expected attribute-discard got %v", err)
+	}
+	if len(u.pathAttributes) != 1 || u.pathAttributes[0].value[0] != egp {
+		t.Errorf("Expected only the first ORIGIN to be kept, got %v", u.pathAttributes)
+	}
+	if len(u.nlri) != 1 {
+		t.Errorf("Expected the NLRI to still be read, got %v", u.nlri)
+	}
+}